@@ -16,6 +16,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -23,6 +24,8 @@ import (
 	"codeberg.org/dropwhile/mlog"
 	"github.com/alecthomas/kong"
 	"github.com/cactus/go-camo/v2/pkg/camo"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/prefetch"
 	"github.com/cactus/go-camo/v2/pkg/router"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -69,8 +72,11 @@ var (
 )
 
 type CLI struct { // betteralign:ignore
-	HMACKey      string `name:"key" short:"k" group:"general" env:"GOCAMO_HMAC" help:"HMAC key"`
-	AutoMaxProcs bool   `name:"automaxprocs" group:"general" help:"Set GOMAXPROCS automatically to match Linux container CPU quota/limits."`
+	HMACKeys     []string `name:"key" short:"k" sep:"none" group:"general" env:"GOCAMO_HMAC" help:"HMAC key. May be specified multiple times; the first key is the signing key, and all keys are used for verification. The env var holds exactly one key; use keyring to rotate keys from the environment."`
+	Keyring      string   `name:"keyring" placeholder:"PATH" group:"general" env:"GOCAMO_KEYRING" help:"File containing keys with key ids (one '<key-id>:<secret>' or '<key-id>:ed25519:<public-key>' per line). Keys are added after any --key keys."`
+	PublicKeys   []string `name:"public-key" placeholder:"[KEY-ID:]KEY" group:"general" env:"GOCAMO_PUBLIC_KEY" help:"Ed25519 public key (base64) used to verify ed25519 signed urls. May be specified multiple times."`
+	MinAlgorithm string   `name:"min-algorithm" enum:"sha1,sha256,sha512-256" default:"sha1" group:"general" help:"Minimum accepted url signature algorithm. One of: ${enum}"`
+	AutoMaxProcs bool     `name:"automaxprocs" group:"general" help:"Set GOMAXPROCS automatically to match Linux container CPU quota/limits."`
 
 	BindSocket     string `name:"socket-listen" placeholder:"PATH" group:"listeners" help:"Path for unix domain socket to bind to for HTTP"`
 	BindAddress    string `name:"listen" default:"0.0.0.0:8080" group:"listeners" help:"Address:Port to bind to for HTTP"`
@@ -79,21 +85,53 @@ type CLI struct { // betteralign:ignore
 	SSLKey         string `name:"ssl-key" placeholder:"PATH" group:"listeners" help:"ssl private key (key.pem) path"`
 	SSLCert        string `name:"ssl-cert" placeholder:"PATH" group:"listeners" help:"ssl cert (cert.pem) path"`
 
-	MaxSize             int64         `name:"max-size" placeholder:"INT" group:"proxy" help:"Max allowed response size, in KB"`
-	MaxSizeRedirect     string        `name:"max-size-redirect" placeholder:"URL" group:"proxy" help:"redirect to URL when max-size is exceeded"`
-	MaxRedirects        int           `name:"max-redirects" default:"3" group:"proxy" help:"Maximum number of redirects to follow"`
-	EnableXFwdFor       bool          `name:"xfwd4" env:"GOCAMO_XFWD_FOR" group:"proxy" help:"Enable x-forwarded-for passthrough/generation"`
-	DisableKeepAlivesFE bool          `name:"no-fk" group:"proxy" help:"Disable frontend http keep-alive support (frontend)"`
-	DisableKeepAlivesBE bool          `name:"no-bk" group:"proxy" help:"Disable backend http keep-alive support (backend)"`
-	AllowContentVideo   bool          `name:"allow-content-video" group:"proxy" help:"Additionally allow 'video/*' content"`
-	AllowContentAudio   bool          `name:"allow-content-audio" group:"proxy" help:"Additionally allow 'audio/*' content"`
-	AllowCredentialURLs bool          `name:"allow-credential-urls" group:"proxy" help:"Allow urls to contain user/pass credentials"`
-	ReqTimeout          time.Duration `name:"timeout" default:"4s" group:"proxy" help:"Upstream request timeout (backend)"`
-	IdleTimeout         time.Duration `name:"idletimeout" default:"30s" group:"proxy" help:"Maximum amount of time to wait for the next request when keep-alive is enabled (frontend)"`
-	ReadTimeout         time.Duration `name:"readtimeout" default:"30s" group:"proxy" help:"Maximum duration for reading the entire request, including the body (frontend)"`
-	UserAgent           string        `name:"user-agent" default:"go-camo" group:"proxy" help:"user-agent for outgoing requests"`
-	AddHeaders          []string      `name:"header" short:"H" group:"response" help:"Add additional header to each response. This option can be used multiple times to add multiple headers."`
-	FilterRuleset       string        `name:"filter-ruleset" group:"proxy" placeholder:"PATH" help:"Text file containing filtering rules (one per line)"`
+	MaxSize                 int64         `name:"max-size" placeholder:"INT" group:"proxy" help:"Max allowed response size, in KB"`
+	MaxSizeRedirect         string        `name:"max-size-redirect" placeholder:"URL" group:"proxy" help:"redirect to URL when max-size is exceeded"`
+	MaxSignedSize           int64         `name:"max-signed-size" placeholder:"INT" group:"proxy" help:"Max response size that signed url options may allow, in KB. Defaults to max-size."`
+	MaxRedirects            int           `name:"max-redirects" default:"3" group:"proxy" help:"Maximum number of redirects to follow"`
+	EnableXFwdFor           bool          `name:"xfwd4" env:"GOCAMO_XFWD_FOR" group:"proxy" help:"Enable x-forwarded-for passthrough/generation"`
+	DisableKeepAlivesFE     bool          `name:"no-fk" group:"proxy" help:"Disable frontend http keep-alive support (frontend)"`
+	DisableKeepAlivesBE     bool          `name:"no-bk" group:"proxy" help:"Disable backend http keep-alive support (backend)"`
+	AllowContentVideo       bool          `name:"allow-content-video" group:"proxy" help:"Additionally allow 'video/*' content"`
+	AllowContentAudio       bool          `name:"allow-content-audio" group:"proxy" help:"Additionally allow 'audio/*' content"`
+	AllowSignedContentVideo bool          `name:"allow-signed-content-video" group:"proxy" help:"Allow signed url options to additionally allow 'video/*' content"`
+	AllowSignedContentAudio bool          `name:"allow-signed-content-audio" group:"proxy" help:"Allow signed url options to additionally allow 'audio/*' content"`
+	AllowCredentialURLs     bool          `name:"allow-credential-urls" group:"proxy" help:"Allow urls to contain user/pass credentials"`
+	AllowQueryFormat        bool          `name:"allow-query-format" group:"proxy" help:"Additionally allow original camo query string format urls (/<digest>?url=<url>)"`
+	AllowTokenFormat        bool          `name:"allow-token-format" group:"proxy" help:"Additionally allow signed token urls (/<token>), carrying the url and claims"`
+	ReqTimeout              time.Duration `name:"timeout" default:"4s" group:"proxy" help:"Upstream request timeout (backend)"`
+	IdleTimeout             time.Duration `name:"idletimeout" default:"30s" group:"proxy" help:"Maximum amount of time to wait for the next request when keep-alive is enabled (frontend)"`
+	ReadTimeout             time.Duration `name:"readtimeout" default:"30s" group:"proxy" help:"Maximum duration for reading the entire request, including the body (frontend)"`
+	UserAgent               string        `name:"user-agent" default:"go-camo" group:"proxy" help:"user-agent for outgoing requests"`
+	AddHeaders              []string      `name:"header" short:"H" group:"response" help:"Add additional header to each response. This option can be used multiple times to add multiple headers."`
+	FilterRuleset           string        `name:"filter-ruleset" group:"proxy" placeholder:"PATH" help:"Text file containing filtering rules (one per line)"`
+
+	CacheMemSize              int64         `name:"cache-mem-size" placeholder:"INT" group:"cache" help:"Enable an in-memory response cache of at most this size, in KB"`
+	CacheMemEntries           int           `name:"cache-mem-entries" default:"10000" group:"cache" help:"Maximum number of in-memory response cache entries"`
+	CacheDir                  string        `name:"cache-dir" placeholder:"PATH" group:"cache" help:"Enable an on-disk response cache in this directory. Entries are kept across restarts."`
+	CacheDiskSize             int64         `name:"cache-disk-size" default:"1024" group:"cache" help:"Maximum size of the on-disk response cache, in MB"`
+	CacheRedis                string        `name:"cache-redis" placeholder:"URL" group:"cache" help:"Enable a response cache shared between instances, on a Redis-protocol server (redis://[[user]:password@]host[:port][/db], or rediss:// for TLS)"`
+	CacheRedisTTL             time.Duration `name:"cache-redis-ttl" default:"24h" group:"cache" help:"Time responses are kept on the Redis-protocol server, including while stale"`
+	CacheMaxEntrySize         int64         `name:"cache-max-entry-size" placeholder:"INT" group:"cache" help:"Largest response body cached, in KB. Defaults to 10240."`
+	CacheStaleWhileRevalidate time.Duration `name:"cache-stale-while-revalidate" placeholder:"DURATION" group:"cache" help:"Serve cached responses for up to this long after they expire, while they are revalidated in the background"`
+	CacheStaleIfError         time.Duration `name:"cache-stale-if-error" placeholder:"DURATION" group:"cache" help:"Serve cached responses for up to this long after they expire, when the upstream request fails"`
+	NegativeCacheTTL          time.Duration `name:"negative-cache-ttl" placeholder:"DURATION" group:"cache" help:"Enable caching of upstream failures for this long, so repeat requests fail without an upstream request"`
+	NegativeCacheClassTTL     []string      `name:"negative-cache-class-ttl" placeholder:"CLASS=DURATION" group:"cache" help:"Cache upstream failures of a class (not_found, upstream_error, content_type, redirect, rejected, connect, timeout) for this long instead. A zero duration disables the class. May be specified multiple times."`
+	NegativeCacheEntries      int           `name:"negative-cache-entries" default:"10000" group:"cache" help:"Maximum number of negative cache entries, for each of urls and hosts"`
+
+	SignListen   string `name:"sign-listen" placeholder:"HOST_PORT" group:"signing" help:"Address:Port to bind the url signing endpoint to. Served over HTTPS if ssl-key and ssl-cert are set."`
+	SignPath     string `name:"sign-path" placeholder:"PATH" group:"signing" help:"Path of the url signing endpoint. If sign-listen is not set, the endpoint is served on the proxy listeners. Defaults to /sign."`
+	SignToken    string `name:"sign-token" placeholder:"TOKEN" group:"signing" help:"Bearer token that authorizes url signing requests"`
+	SignClientCA string `name:"sign-client-ca" placeholder:"PATH" group:"signing" help:"CA certificates (PEM) used to verify client certificates that authorize url signing requests. Requires sign-listen, ssl-key, and ssl-cert."`
+	SignBaseURL  string `name:"sign-base-url" placeholder:"URL" group:"signing" help:"go-camo url that signed url paths are appended to"`
+
+	PrefetchPath        string `name:"prefetch-path" placeholder:"PATH" group:"signing" help:"Path of the cache prefetch endpoint, served and authorized as the url signing endpoint is. Requires sign-listen or sign-path, and a response cache."`
+	PrefetchConcurrency int    `name:"prefetch-concurrency" default:"8" group:"signing" help:"Maximum number of urls fetched at once, per cache prefetch request"`
+
+	Peers     []string `name:"peer" placeholder:"URL" group:"peers" help:"URL of another go-camo instance to share upstream fetches with. May be specified multiple times."`
+	PeersFile string   `name:"peers-file" placeholder:"PATH" group:"peers" help:"File containing peer urls (one per line). The file is checked for changes every 10 seconds."`
+	PeerSelf  string   `name:"peer-self" placeholder:"URL" group:"peers" help:"URL of this instance, as the other peers know it. Required with peer or peers-file."`
+	PeerKey   string   `name:"peer-key" placeholder:"KEY" group:"peers" help:"Secret shared by the peers, that authenticates forwarded requests. Required with peer or peers-file."`
 
 	ServerName          string `name:"server-name" group:"response" default:"go-camo" help:"Value to use for the HTTP server field"`
 	ExposeServerVersion bool   `name:"expose-server-version" group:"response" help:"Include the server version in the HTTP server response header"`
@@ -135,10 +173,39 @@ func (cli *CLI) Run() {
 
 	config := camo.Config{}
 
-	config.HMACKey = []byte(cli.HMACKey)
-	if len(config.HMACKey) == 0 {
-		mlog.Fatal("HMAC key required")
+	keys := make([]encoding.Key, 0, len(cli.HMACKeys))
+	for _, k := range cli.HMACKeys {
+		keys = append(keys, encoding.Key{Secret: []byte(k)})
 	}
+	for _, k := range cli.PublicKeys {
+		key, err := encoding.ParseEd25519Key(k)
+		if err != nil {
+			mlog.Fatal("Invalid public key", err)
+		}
+		keys = append(keys, key)
+	}
+	if cli.Keyring != "" {
+		fileKeys, err := encoding.ReadKeysFile(cli.Keyring)
+		if err != nil {
+			mlog.Fatal("Could not read keyring", err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if len(keys) == 0 {
+		mlog.Fatal("HMAC key or public key required")
+	}
+
+	keyring, err := encoding.NewKeyring(keys...)
+	if err != nil {
+		mlog.Fatal("Invalid HMAC key", err)
+	}
+	config.Keyring = keyring
+
+	minAlg, err := encoding.ParseMinAlgorithm(cli.MinAlgorithm)
+	if err != nil {
+		mlog.Fatal("Invalid min-algorithm", err)
+	}
+	config.MinAlgorithm = minAlg
 
 	if cli.BindAddress == "" && cli.BindAddressSSL == "" && cli.BindSocket == "" {
 		mlog.Fatal("One of listen or ssl-listen required")
@@ -154,6 +221,40 @@ func (cli *CLI) Run() {
 		mlog.Fatal("ssl-listen is required when specifying quic")
 	}
 
+	enableSign := cli.SignListen != "" || cli.SignPath != ""
+	if !enableSign && (cli.SignToken != "" || cli.SignClientCA != "") {
+		mlog.Fatal("sign-listen or sign-path is required when specifying sign-token or sign-client-ca")
+	}
+	if enableSign && cli.SignToken == "" && cli.SignClientCA == "" {
+		mlog.Fatal("sign-token or sign-client-ca is required for the url signing endpoint")
+	}
+	if cli.SignClientCA != "" && cli.SignListen == "" {
+		mlog.Fatal("sign-listen is required when specifying sign-client-ca")
+	}
+	if cli.SignClientCA != "" && (cli.SSLKey == "" || cli.SSLCert == "") {
+		mlog.Fatal("ssl-key and ssl-cert are required when specifying sign-client-ca")
+	}
+	if cli.SignListen != "" && (cli.SSLKey == "") != (cli.SSLCert == "") {
+		mlog.Fatal("ssl-key and ssl-cert are both required for HTTPS on sign-listen")
+	}
+	if cli.SignPath != "" && !strings.HasPrefix(cli.SignPath, "/") {
+		mlog.Fatal("sign-path must start with '/'")
+	}
+	if cli.PrefetchPath != "" && !enableSign {
+		mlog.Fatal("sign-listen or sign-path is required when specifying prefetch-path")
+	}
+	if cli.PrefetchPath != "" && !strings.HasPrefix(cli.PrefetchPath, "/") {
+		mlog.Fatal("prefetch-path must start with '/'")
+	}
+	if cli.PrefetchPath != "" && cli.CacheMemSize <= 0 && cli.CacheDir == "" && cli.CacheRedis == "" {
+		mlog.Fatal("cache-mem-size, cache-dir, or cache-redis is required when specifying prefetch-path")
+	}
+
+	enablePeers := len(cli.Peers) > 0 || cli.PeersFile != ""
+	if enablePeers && (cli.PeerSelf == "" || cli.PeerKey == "") {
+		mlog.Fatal("peer-self and peer-key are required when specifying peer or peers-file")
+	}
+
 	// set keepalive options
 	config.DisableKeepAlivesBE = cli.DisableKeepAlivesBE
 	config.DisableKeepAlivesFE = cli.DisableKeepAlivesFE
@@ -170,17 +271,109 @@ func (cli *CLI) Run() {
 	// additional content types to allow
 	config.AllowContentVideo = cli.AllowContentVideo
 	config.AllowContentAudio = cli.AllowContentAudio
+	config.AllowSignedContentVideo = cli.AllowSignedContentVideo
+	config.AllowSignedContentAudio = cli.AllowSignedContentAudio
 
 	// other options
 	config.EnableXFwdFor = cli.EnableXFwdFor
 	config.AllowCredentialURLs = cli.AllowCredentialURLs
+	config.AllowQueryFormat = cli.AllowQueryFormat
+	config.AllowTokenFormat = cli.AllowTokenFormat
 	config.MaxSize = cli.MaxSize * 1024 // convert from KB to Bytes
+	config.MaxSignedSize = cli.MaxSignedSize * 1024
 	config.ServerName = ServerName
 	config.UserAgent = cli.UserAgent
 
 	// configure metrics collection in camo
 	config.CollectMetrics = cli.Metrics
 
+	// response cache tiers, memory first
+	caches := make([]camo.Cache, 0, 3)
+	if cli.CacheMemSize > 0 {
+		caches = append(caches, camo.NewMemoryCache(camo.MemoryCacheConfig{
+			MaxBytes:       cli.CacheMemSize * 1024, // convert from KB to Bytes
+			MaxEntries:     cli.CacheMemEntries,
+			CollectMetrics: cli.Metrics,
+		}))
+	}
+	if cli.CacheDir != "" {
+		diskCache, err := camo.NewDiskCache(camo.DiskCacheConfig{
+			Dir:            cli.CacheDir,
+			MaxBytes:       cli.CacheDiskSize * 1024 * 1024, // convert from MB to Bytes
+			CollectMetrics: cli.Metrics,
+		})
+		if err != nil {
+			mlog.Fatal("Could not create disk cache", err)
+		}
+		caches = append(caches, diskCache)
+	}
+	var respCache *camo.RESPCache
+	if cli.CacheRedis != "" {
+		respConfig, err := camo.ParseRESPCacheURL(cli.CacheRedis)
+		if err != nil {
+			mlog.Fatal("Invalid cache-redis url", err)
+		}
+		respConfig.TTL = cli.CacheRedisTTL
+		respCache, err = camo.NewRESPCache(respConfig)
+		if err != nil {
+			mlog.Fatal("Could not create redis cache", err)
+		}
+		caches = append(caches, respCache)
+	}
+	switch {
+	case len(caches) == 1:
+		config.Cache = caches[0]
+	case len(caches) > 1:
+		config.Cache = camo.NewTieredCache(caches...)
+	}
+	config.CacheMaxEntrySize = cli.CacheMaxEntrySize * 1024
+	config.CacheStaleWhileRevalidate = cli.CacheStaleWhileRevalidate
+	config.CacheStaleIfError = cli.CacheStaleIfError
+
+	if cli.NegativeCacheTTL > 0 || len(cli.NegativeCacheClassTTL) > 0 {
+		classTTL := make(map[string]time.Duration)
+		for _, v := range cli.NegativeCacheClassTTL {
+			class, value, ok := strings.Cut(v, "=")
+			if !ok || !slices.Contains(camo.NegativeClasses, class) {
+				mlog.Fatalf("Invalid negative-cache-class-ttl -> '%s'", v)
+			}
+			ttl, err := time.ParseDuration(value)
+			if err != nil {
+				mlog.Fatal("Invalid negative-cache-class-ttl", err)
+			}
+			classTTL[class] = ttl
+		}
+		config.NegativeCache = camo.NewNegativeCache(camo.NegativeCacheConfig{
+			TTL:        cli.NegativeCacheTTL,
+			ClassTTL:   classTTL,
+			MaxEntries: cli.NegativeCacheEntries,
+		})
+	}
+
+	var peerPool *camo.PeerPool
+	if enablePeers {
+		peers := slices.Clone(cli.Peers)
+		if cli.PeersFile != "" {
+			filePeers, err := loadPeersFile(cli.PeersFile)
+			if err != nil {
+				mlog.Fatal("Could not read peers-file", err)
+			}
+			peers = append(peers, filePeers...)
+		}
+		var err error
+		peerPool, err = camo.NewPeerPool(camo.PeerPoolConfig{
+			Self:  cli.PeerSelf,
+			Peers: peers,
+			Key:   []byte(cli.PeerKey),
+			// the owner's upstream request, with some slack
+			Timeout: cli.ReqTimeout + time.Second,
+		})
+		if err != nil {
+			mlog.Fatal("Invalid peers", err)
+		}
+		config.Peers = peerPool
+	}
+
 	// now configure a standard logger
 	mlog.SetFlags(mlog.Lstd)
 	if cli.NoLogTS {
@@ -236,15 +429,26 @@ func (cli *CLI) Run() {
 		mlog.SetEmitter(&mlog.FormatWriterJSON{})
 	}
 
+	if respCache != nil {
+		// not fatal, as the cache is optional and the server may come back
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := respCache.Ping(ctx); err != nil {
+			mlog.Printx("Could not reach redis cache", mlog.A("err", err))
+		}
+		cancel()
+	}
+
 	proxy, err := camo.New(config, filters)
 	if err != nil {
 		mlog.Fatal("Error creating camo", err)
 	}
 
 	var router http.Handler = &router.DumbRouter{
-		ServerName:  ServerResponse,
-		AddHeaders:  AddHeaders,
-		CamoHandler: proxy,
+		ServerName:       ServerResponse,
+		AddHeaders:       AddHeaders,
+		CamoHandler:      proxy,
+		AllowQueryFormat: cli.AllowQueryFormat,
+		AllowTokenFormat: cli.AllowTokenFormat,
 	}
 
 	mux := http.NewServeMux()
@@ -320,6 +524,63 @@ func (cli *CLI) Run() {
 		// mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
 
+	var signSrv *http.Server
+
+	if enableSign {
+		signHandler, err := newSignHandler(cli, keyring, minAlg, proxy)
+		if err != nil {
+			mlog.Fatal("Error creating url signing endpoint", err)
+		}
+
+		signPath := cli.SignPath
+		if signPath == "" {
+			signPath = "/sign"
+		}
+
+		var prefetchHandler *prefetch.Handler
+		if cli.PrefetchPath != "" {
+			prefetchHandler, err = newPrefetchHandler(cli, keyring, minAlg, proxy)
+			if err != nil {
+				mlog.Fatal("Error creating cache prefetch endpoint", err)
+			}
+		}
+
+		if cli.SignListen == "" {
+			mlog.Printf("Enabling url signing at %s", signPath)
+			mux.Handle(signPath, signHandler)
+			if prefetchHandler != nil {
+				mlog.Printf("Enabling cache prefetch at %s", cli.PrefetchPath)
+				mux.Handle(cli.PrefetchPath, prefetchHandler)
+			}
+		} else {
+			signMux := http.NewServeMux()
+			signMux.Handle(signPath, signHandler)
+			if prefetchHandler != nil {
+				signMux.Handle(cli.PrefetchPath, prefetchHandler)
+			}
+			signSrv = &http.Server{
+				Addr:        cli.SignListen,
+				ReadTimeout: config.ReadTimeout,
+				IdleTimeout: config.IdleTimeout,
+				Handler:     signMux,
+			}
+			if cli.SignClientCA != "" {
+				signSrv.TLSConfig, err = loadSignTLSConfig(cli.SignClientCA)
+				if err != nil {
+					mlog.Fatal("Could not load sign-client-ca", err)
+				}
+			}
+		}
+	}
+
+	if peerPool != nil {
+		mlog.Printx("Enabling peers", mlog.A("peers", peerPool.Peers()))
+		mux.HandleFunc(camo.DefaultPeerPath, proxy.ServePeer)
+		if cli.PeersFile != "" {
+			go watchPeersFile(cli.PeersFile, cli.Peers, peerPool, 10*time.Second)
+		}
+	}
+
 	mux.Handle("/", router)
 
 	var httpSrv *http.Server
@@ -395,6 +656,14 @@ func (cli *CLI) Run() {
 			}
 		}
 
+		if signSrv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), closeWait)
+			defer cancel()
+			if err := signSrv.Shutdown(ctx); err != nil {
+				mlog.Info("Error gracefully shutting down url signing server:", err)
+			}
+		}
+
 		close(idleConnsClosed)
 	}()
 
@@ -443,6 +712,21 @@ func (cli *CLI) Run() {
 		}()
 	}
 
+	if signSrv != nil {
+		mlog.Printf("Starting url signing server on: tcp:%s", cli.SignListen)
+		go func() {
+			var err error
+			if cli.SSLCert != "" {
+				err = signSrv.ListenAndServeTLS(cli.SSLCert, cli.SSLKey)
+			} else {
+				err = signSrv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				mlog.Fatal(err)
+			}
+		}()
+	}
+
 	// just block waiting for closure
 	<-idleConnsClosed
 }
@@ -460,6 +744,9 @@ func main() {
 			"listeners":  "Flags for listeners",
 			"proxy":      "Flags for proxy behavior",
 			"response":   "Flags for responses",
+			"cache":      "Flags for response caching",
+			"signing":    "Flags for the url signing endpoint",
+			"peers":      "Flags for sharing upstream fetches between instances",
 			"logmetrics": "Flags for logging and metrics",
 		},
 		kong.Vars{"version": ServerVersion},
@@ -5,82 +5,30 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"net/url"
-	"os"
 	"strings"
 
 	"codeberg.org/dropwhile/mlog"
 	"github.com/cactus/go-camo/v2/pkg/camo"
-	"github.com/cactus/go-camo/v2/pkg/htrie"
+	"github.com/cactus/go-camo/v2/pkg/ruleset"
 )
 
 func loadFilterList(fname string) ([]camo.FilterFunc, error) {
-	// #nosec
-	file, err := os.Open(fname)
+	rs, err := ruleset.Load(fname)
 	if err != nil {
-		return nil, fmt.Errorf("could not open filter-ruleset file: %s", err)
+		return nil, err
 	}
-	// #nosec
-	defer file.Close()
 
-	allowFilter := htrie.NewURLMatcher()
-	denyFilter := htrie.NewURLMatcher()
-	hasAllow := false
-	hasDeny := false
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if strings.HasPrefix(line, "allow|") {
-			line = strings.TrimPrefix(line, "allow")
-			err = allowFilter.AddRule(line)
-			if err != nil {
-				break
-			}
-			hasAllow = true
-		} else if strings.HasPrefix(line, "deny|") {
-			line = strings.TrimPrefix(line, "deny")
-			err = denyFilter.AddRule(line)
-			if err != nil {
-				break
-			}
-			hasDeny = true
-		} else {
-			fmt.Println("ignoring line: ", line)
-		}
-
-		err = scanner.Err()
-		if err != nil {
-			break
-		}
-	}
-	if err != nil {
-		return nil, fmt.Errorf("error building filter ruleset: %s", err)
+	for _, line := range rs.Ignored {
+		fmt.Println("ignoring line: ", line.Text)
 	}
 
-	// append in order. allow first, then deny filters.
-	// first false value aborts the request.
 	filterFuncs := make([]camo.FilterFunc, 0)
-
-	if hasAllow {
-		filterFuncs = append(filterFuncs, allowFilter.CheckURL)
-	}
-
-	// denyFilter returns true on a match. we want to invert this for a deny rule, so
-	// any deny rule match should return true, and anything _not_ matching should return false
-	// so just wrap and invert the bool.
-	if hasDeny {
-		denyF := func(u *url.URL) (bool, error) {
-			chk, err := denyFilter.CheckURL(u)
-			return !chk, err
-		}
-		filterFuncs = append(filterFuncs, denyF)
+	for _, filter := range rs.Filters() {
+		filterFuncs = append(filterFuncs, filter)
 	}
 
-	if hasAllow && hasDeny {
+	if rs.HasAllow() && rs.HasDeny() {
 		mlog.Print(
 			strings.Join(
 				[]string{
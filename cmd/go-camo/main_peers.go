@@ -0,0 +1,72 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"codeberg.org/dropwhile/mlog"
+	"github.com/cactus/go-camo/v2/pkg/camo"
+)
+
+// loadPeersFile returns the peer urls in a file, one per line. Blank lines,
+// and lines starting with '#', are ignored.
+func loadPeersFile(fname string) ([]string, error) {
+	// #nosec G304
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G104
+	defer f.Close()
+
+	peers := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	return peers, scanner.Err()
+}
+
+// watchPeersFile checks the peers file for changes every interval, and
+// replaces the pool peers (the static peers, and those in the file) when it
+// changes. A file that can not be read leaves the peers as they are.
+func watchPeersFile(fname string, static []string, pool *camo.PeerPool, interval time.Duration) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(fname); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(fname)
+		if err != nil {
+			mlog.Printx("Could not read peers-file", mlog.A("err", err))
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+
+		peers, err := loadPeersFile(fname)
+		if err == nil {
+			err = pool.Set(slices.Concat(static, peers))
+		}
+		if err != nil {
+			mlog.Printx("Could not update peers from peers-file", mlog.A("err", err))
+			continue
+		}
+		mlog.Printx("Updated peers from peers-file", mlog.A("peers", pool.Peers()))
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cactus/go-camo/v2/pkg/camo"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/prefetch"
+	"github.com/cactus/go-camo/v2/pkg/signer"
+)
+
+// signAlgorithm returns the algorithm urls are signed with: at least
+// sha256, and never below what the proxy accepts.
+func signAlgorithm(minAlg encoding.Algorithm) (encoding.Algorithm, error) {
+	if minAlg != 0 && !minAlg.IsHMAC() {
+		return minAlg, fmt.Errorf("can not sign urls accepted with min-algorithm %s", minAlg)
+	}
+	alg := encoding.SHA256
+	if !alg.Meets(minAlg) {
+		alg = minAlg
+	}
+	return alg, nil
+}
+
+func newSignHandler(cli *CLI, keyring *encoding.Keyring, minAlg encoding.Algorithm, proxy *camo.Proxy) (*signer.Handler, error) {
+	alg, err := signAlgorithm(minAlg)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.New(signer.Config{
+		Keyring:  keyring,
+		CheckURL: proxy.CheckURL,
+		BaseURL:  cli.SignBaseURL,
+		Token:    cli.SignToken,
+		Options:  encoding.SignOptions{Algorithm: alg},
+	})
+}
+
+func newPrefetchHandler(cli *CLI, keyring *encoding.Keyring, minAlg encoding.Algorithm, proxy *camo.Proxy) (*prefetch.Handler, error) {
+	alg, err := signAlgorithm(minAlg)
+	if err != nil {
+		return nil, err
+	}
+
+	return prefetch.New(prefetch.Config{
+		Handler:     proxy,
+		Keyring:     keyring,
+		Token:       cli.SignToken,
+		Options:     encoding.SignOptions{Algorithm: alg},
+		Concurrency: cli.PrefetchConcurrency,
+	})
+}
+
+func loadSignTLSConfig(fname string) (*tls.Config, error) {
+	// #nosec
+	pem, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not read sign-client-ca file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in sign-client-ca file")
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+		// unauthenticated requests may still use a bearer token
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+// batch output field names
+const (
+	fieldOriginal = "original"
+	fieldSigned   = "signed"
+	fieldError    = "error"
+)
+
+// lines read (and processed in parallel) per job, before results are
+// written out
+const batchChunkLines = 256
+
+// batchFlags holds the options shared by the batch commands
+type batchFlags struct {
+	Format   string   `name:"format" enum:"text,jsonl" default:"text" help:"Input and output format. One of: ${enum}"`
+	Fields   []string `name:"fields" placeholder:"FIELDS" help:"Comma separated output fields (original, signed, error). Defaults to the result url for text, and all fields for jsonl."`
+	URLField string   `name:"url-field" default:"url" help:"Field holding the input url, for jsonl records"`
+	Jobs     int      `name:"jobs" short:"j" placeholder:"INT" help:"Number of urls to process in parallel. Defaults to the number of cpus."`
+	Files    []string `arg:"" optional:"" name:"FILE" help:"Input files. Reads stdin if none are given, or for '-'."`
+}
+
+// batchResult is the result of encoding or decoding a single url
+type batchResult struct {
+	err      error
+	original string
+	signed   string
+}
+
+// field returns the value of the named output field
+func (r *batchResult) field(name string) string {
+	switch name {
+	case fieldOriginal:
+		return r.original
+	case fieldSigned:
+		return r.signed
+	case fieldError:
+		if r.err != nil {
+			return r.err.Error()
+		}
+	}
+	return ""
+}
+
+// batchLine is a single input line, and the result of processing it
+type batchLine struct {
+	record map[string]json.RawMessage
+	result batchResult
+	source string
+	raw    string
+	skip   bool
+}
+
+// batchRunner encodes or decodes urls read from the input files
+type batchRunner struct {
+	out     *bufio.Writer
+	process func(string) batchResult
+	flags   *batchFlags
+	fields  []string
+	total   int
+	failed  int
+}
+
+// run processes each input line with process, writing the results to out.
+// defaultField is the text format output field, if none are set.
+func (b *batchFlags) run(out io.Writer, process func(string) batchResult, defaultField string) error {
+	fields := b.Fields
+	if len(fields) == 0 {
+		fields = []string{defaultField}
+		if b.Format == "jsonl" {
+			fields = []string{fieldOriginal, fieldSigned, fieldError}
+		}
+	}
+	for _, field := range fields {
+		if !slices.Contains([]string{fieldOriginal, fieldSigned, fieldError}, field) {
+			return fmt.Errorf("unknown output field: %q", field)
+		}
+	}
+	if b.Jobs < 0 {
+		return errors.New("jobs must be positive")
+	}
+	if b.Jobs == 0 {
+		b.Jobs = runtime.NumCPU()
+	}
+
+	r := &batchRunner{
+		out:     bufio.NewWriter(out),
+		process: process,
+		flags:   b,
+		fields:  fields,
+	}
+
+	files := b.Files
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if err := r.runFile(name); err != nil {
+			return err
+		}
+	}
+
+	if r.failed > 0 {
+		return fmt.Errorf("%d of %d urls failed", r.failed, r.total)
+	}
+	return nil
+}
+
+// runFile processes the lines of the named file (or stdin, for '-')
+func (r *batchRunner) runFile(name string) error {
+	in := io.Reader(os.Stdin)
+	if name != "-" {
+		// #nosec
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("could not open input file: %s", err)
+		}
+		defer f.Close() // #nosec G307
+		in = f
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	chunk := make([]batchLine, 0, r.flags.Jobs*batchChunkLines)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		chunk = append(chunk, batchLine{
+			source: fmt.Sprintf("%s:%d", name, lineNum),
+			raw:    scanner.Text(),
+		})
+		if len(chunk) == cap(chunk) {
+			if err := r.runChunk(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %s: %s", name, err)
+	}
+	return r.runChunk(chunk)
+}
+
+// runChunk processes the lines in parallel, then writes the results in
+// input order
+func (r *batchRunner) runChunk(chunk []batchLine) error {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(r.flags.Jobs, len(chunk)) {
+		wg.Go(func() {
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(chunk) {
+					return
+				}
+				r.processLine(&chunk[i])
+			}
+		})
+	}
+	wg.Wait()
+
+	for i := range chunk {
+		if err := r.writeLine(&chunk[i]); err != nil {
+			return err
+		}
+	}
+	return r.out.Flush()
+}
+
+// processLine parses the input url from the line, and processes it
+func (r *batchRunner) processLine(line *batchLine) {
+	value := strings.TrimSpace(line.raw)
+	if r.flags.Format != "jsonl" {
+		// blank lines are passed through, to keep output aligned with input
+		line.skip = value == ""
+		if !line.skip {
+			line.result = r.process(value)
+		}
+		return
+	}
+
+	// blank lines are not records
+	if value == "" {
+		line.skip = true
+		return
+	}
+	if err := json.Unmarshal([]byte(value), &line.record); err != nil || line.record == nil {
+		line.record = map[string]json.RawMessage{}
+		line.result.err = errors.New("invalid jsonl record")
+		return
+	}
+	var u string
+	if err := json.Unmarshal(line.record[r.flags.URLField], &u); err != nil || u == "" {
+		line.result.err = fmt.Errorf("missing %q field", r.flags.URLField)
+		return
+	}
+	line.result = r.process(u)
+}
+
+// writeLine writes the line result, reporting any error to stderr
+func (r *batchRunner) writeLine(line *batchLine) error {
+	if line.skip {
+		if r.flags.Format == "jsonl" {
+			return nil
+		}
+		return r.out.WriteByte('\n')
+	}
+
+	r.total++
+	if line.result.err != nil {
+		r.failed++
+		fmt.Fprintf(os.Stderr, "url-tool: %s: %s\n", line.source, line.result.err)
+	}
+
+	if r.flags.Format != "jsonl" {
+		values := make([]string, len(r.fields))
+		for i, field := range r.fields {
+			values[i] = line.result.field(field)
+		}
+		_, err := fmt.Fprintln(r.out, strings.Join(values, "\t"))
+		return err
+	}
+
+	for _, field := range r.fields {
+		value := line.result.field(field)
+		if value == "" {
+			delete(line.record, field)
+			continue
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		line.record[field] = b
+	}
+	b, err := json.Marshal(line.record)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = r.out.Write(b)
+	return err
+}
+
+// BatchEncodeCmd holds command options for the batch encode command
+type BatchEncodeCmd struct {
+	Flags encodeFlags `embed:""`
+	Batch batchFlags  `embed:""`
+}
+
+// Execute runs the batch encode command
+func (cmd *BatchEncodeCmd) Run(cli *CLI) error {
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+	encode, err := cmd.Flags.encoder(keyring)
+	if err != nil {
+		return err
+	}
+
+	return cmd.Batch.run(os.Stdout, func(oURL string) batchResult {
+		outURL, err := encode(oURL)
+		return batchResult{original: oURL, signed: outURL, err: err}
+	}, fieldSigned)
+}
+
+// BatchDecodeCmd holds command options for the batch decode command
+type BatchDecodeCmd struct {
+	Batch batchFlags `embed:""`
+}
+
+// Execute runs the batch decode command
+func (cmd *BatchDecodeCmd) Run(cli *CLI) error {
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+
+	return cmd.Batch.run(os.Stdout, func(sURL string) batchResult {
+		result := batchResult{signed: sURL}
+		var info *encoding.URLInfo
+		if info, result.err = decodeURL(keyring, sURL); result.err == nil {
+			result.original = info.URL
+		}
+		return result
+	}, fieldOriginal)
+}
+
+// BatchCmd holds the batch subcommands
+type BatchCmd struct {
+	Encode BatchEncodeCmd `cmd:"" aliases:"enc" help:"Encode urls and print results"`
+	Decode BatchDecodeCmd `cmd:"" aliases:"dec" help:"Decode urls and print results"`
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/camo"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/ruleset"
+)
+
+// FetchCmd holds command options for the fetch command. The proxy options
+// are the same as for go-camo. Every fetch goes upstream, so the go-camo
+// response cache, negative cache, and peer options are not supported, and
+// neither are the extra response headers (go-camo --header).
+type FetchCmd struct { // betteralign:ignore
+	MinAlgorithm            string        `name:"min-algorithm" enum:"sha1,sha256,sha512-256" default:"sha1" help:"Minimum accepted url signature algorithm. One of: ${enum}"`
+	MaxSize                 int64         `name:"max-size" placeholder:"INT" help:"Max allowed response size, in KB"`
+	MaxSizeRedirect         string        `name:"max-size-redirect" placeholder:"URL" help:"redirect to URL when max-size is exceeded"`
+	MaxSignedSize           int64         `name:"max-signed-size" placeholder:"INT" help:"Max response size that signed url options may allow, in KB. Defaults to max-size."`
+	MaxRedirects            int           `name:"max-redirects" default:"3" help:"Maximum number of redirects to follow"`
+	EnableXFwdFor           bool          `name:"xfwd4" help:"Enable x-forwarded-for passthrough/generation"`
+	DisableKeepAlivesBE     bool          `name:"no-bk" help:"Disable backend http keep-alive support (backend)"`
+	AllowContentVideo       bool          `name:"allow-content-video" help:"Additionally allow 'video/*' content"`
+	AllowContentAudio       bool          `name:"allow-content-audio" help:"Additionally allow 'audio/*' content"`
+	AllowSignedContentVideo bool          `name:"allow-signed-content-video" help:"Allow signed url options to additionally allow 'video/*' content"`
+	AllowSignedContentAudio bool          `name:"allow-signed-content-audio" help:"Allow signed url options to additionally allow 'audio/*' content"`
+	AllowCredentialURLs     bool          `name:"allow-credential-urls" help:"Allow urls to contain user/pass credentials"`
+	AllowQueryFormat        bool          `name:"allow-query-format" help:"Additionally allow original camo query string format urls (/<digest>?url=<url>)"`
+	AllowTokenFormat        bool          `name:"allow-token-format" help:"Additionally allow signed token urls (/<token>), carrying the url and claims"`
+	ReqTimeout              time.Duration `name:"timeout" default:"4s" help:"Upstream request timeout (backend)"`
+	UserAgent               string        `name:"user-agent" default:"go-camo" help:"user-agent for outgoing requests"`
+	FilterRuleset           string        `name:"filter-ruleset" placeholder:"PATH" help:"Text file containing filtering rules (one per line)"`
+	ServerName              string        `name:"server-name" default:"go-camo" help:"Value to use for the HTTP server field"`
+
+	Headers []string `name:"header" short:"H" placeholder:"NAME:VALUE" help:"Add a header to the client request. May be given more than once."`
+	Output  string   `name:"output" short:"o" placeholder:"PATH" help:"Save the client response body to a file"`
+	Url     string   `arg:"" name:"URL" help:"Signed URL (or URL path) to fetch"`
+}
+
+// config returns the proxy config for the command options, as go-camo builds
+// it
+func (cmd *FetchCmd) config(keyring *encoding.Keyring) (camo.Config, error) {
+	minAlg, err := encoding.ParseMinAlgorithm(cmd.MinAlgorithm)
+	if err != nil {
+		return camo.Config{}, err
+	}
+
+	return camo.Config{
+		ServerName:              cmd.ServerName,
+		UserAgent:               cmd.UserAgent,
+		Keyring:                 keyring,
+		MinAlgorithm:            minAlg,
+		MaxSize:                 cmd.MaxSize * 1024, // convert from KB to Bytes
+		MaxSizeRedirect:         cmd.MaxSizeRedirect,
+		MaxSignedSize:           cmd.MaxSignedSize * 1024,
+		MaxRedirects:            cmd.MaxRedirects,
+		RequestTimeout:          cmd.ReqTimeout,
+		DisableKeepAlivesBE:     cmd.DisableKeepAlivesBE,
+		EnableXFwdFor:           cmd.EnableXFwdFor,
+		AllowContentVideo:       cmd.AllowContentVideo,
+		AllowContentAudio:       cmd.AllowContentAudio,
+		AllowSignedContentVideo: cmd.AllowSignedContentVideo,
+		AllowSignedContentAudio: cmd.AllowSignedContentAudio,
+		AllowCredentialURLs:     cmd.AllowCredentialURLs,
+		AllowQueryFormat:        cmd.AllowQueryFormat,
+		AllowTokenFormat:        cmd.AllowTokenFormat,
+	}, nil
+}
+
+// request returns the client request for the signed url
+func (cmd *FetchCmd) request(ctx context.Context) (*http.Request, error) {
+	if len(cmd.Url) == 0 {
+		return nil, errors.New("no url argument provided")
+	}
+	u, err := url.Parse(cmd.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Host == "" {
+		u.Host = "localhost"
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	for _, v := range cmd.Headers {
+		name, value, ok := strings.Cut(v, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("bad header: %q", v)
+		}
+		req.Header.Add(name, value)
+	}
+	return req, nil
+}
+
+// Execute runs the fetch command
+func (cmd *FetchCmd) Run(cli *CLI) error {
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+
+	config, err := cmd.config(keyring)
+	if err != nil {
+		return err
+	}
+
+	var filters []camo.FilterFunc
+	if cmd.FilterRuleset != "" {
+		rules, err := ruleset.Load(cmd.FilterRuleset)
+		if err != nil {
+			return err
+		}
+		for _, filter := range rules.Filters() {
+			filters = append(filters, filter)
+		}
+	}
+
+	proxy, err := camo.New(config, filters)
+	if err != nil {
+		return fmt.Errorf("error creating camo: %s", err)
+	}
+
+	trace := &camo.Trace{
+		OutboundRequest: func(req *http.Request) {
+			fmt.Println("outbound request:")
+			fmt.Printf("  %s %s\n", req.Method, req.URL)
+			printHeaders(req.Header)
+		},
+		UpstreamResponse: func(resp *http.Response) {
+			fmt.Println("upstream response:")
+			fmt.Printf("  %s %s\n", resp.Proto, resp.Status)
+			printHeaders(resp.Header)
+		},
+		UpstreamError: func(err error) {
+			fmt.Printf("upstream error: %s\n", err)
+		},
+		ContentType: func(upstream string, client string) {
+			switch {
+			case upstream == "":
+				fmt.Println("content-type: REJECTED (empty)")
+			case client == "":
+				fmt.Printf("content-type: REJECTED (%s)\n", upstream)
+			default:
+				fmt.Printf("content-type: ok (%s -> %s)\n", upstream, client)
+			}
+		},
+	}
+
+	req, err := cmd.request(camo.WithTrace(context.Background(), trace))
+	if err != nil {
+		return err
+	}
+	fmt.Println("client request:")
+	fmt.Printf("  %s %s\n", req.Method, req.URL.RequestURI())
+	printHeaders(req.Header)
+
+	record := httptest.NewRecorder()
+	proxy.ServeHTTP(record, req)
+	resp := record.Result()
+
+	fmt.Println("client response:")
+	fmt.Printf("  %s %s\n", resp.Proto, resp.Status)
+	printHeaders(resp.Header)
+
+	body := record.Body.Bytes()
+	if resp.StatusCode >= 400 {
+		// error responses are a short plain text reason
+		fmt.Printf("  %s\n", strings.TrimSpace(string(body)))
+	}
+	if cmd.Output == "" {
+		fmt.Printf("body: %d bytes\n", len(body))
+		return nil
+	}
+	if err := os.WriteFile(cmd.Output, body, 0o600); err != nil {
+		return fmt.Errorf("could not write output file: %s", err)
+	}
+	fmt.Printf("body: %d bytes, saved to %s\n", len(body), cmd.Output)
+	return nil
+}
+
+// printHeaders prints the headers, sorted by name, one per line
+func printHeaders(h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Printf("  %s: %s\n", name, v)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/camo"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/htrie"
+	"github.com/cactus/go-camo/v2/pkg/ruleset"
+)
+
+// InspectCmd holds command options for the inspect command
+type InspectCmd struct {
+	FilterRuleset       string `name:"filter-ruleset" placeholder:"PATH" help:"Text file containing filtering rules (one per line), as used by go-camo"`
+	AllowCredentialURLs bool   `name:"allow-credential-urls" help:"Allow urls to contain user/pass credentials, as with go-camo"`
+	NoResolve           bool   `name:"no-resolve" help:"Don't resolve the url hostname"`
+	Url                 string `arg:"" name:"URL" help:"URL to inspect"`
+}
+
+// inspection prints the result of each check
+type inspection struct {
+	failed bool
+}
+
+func (in *inspection) ok(check string, detail string, args ...any) {
+	if detail != "" {
+		detail = " (" + fmt.Sprintf(detail, args...) + ")"
+	}
+	fmt.Printf("%s: ok%s\n", check, detail)
+}
+
+func (in *inspection) fail(check string, detail string, args ...any) {
+	in.failed = true
+	fmt.Printf("%s: REJECTED (%s)\n", check, fmt.Sprintf(detail, args...))
+}
+
+// Execute runs the inspect command
+func (cmd *InspectCmd) Run(cli *CLI) error {
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Url) == 0 {
+		return errors.New("no url argument provided")
+	}
+
+	var rules *ruleset.Ruleset
+	if cmd.FilterRuleset != "" {
+		rules, err = ruleset.Load(cmd.FilterRuleset)
+		if err != nil {
+			return err
+		}
+	}
+
+	in := &inspection{}
+	in.inspect(cmd, keyring, rules)
+	if in.failed {
+		fmt.Println("result: REJECTED")
+		return errors.New("url would be rejected")
+	}
+	fmt.Println("result: ok")
+	return nil
+}
+
+// inspect runs the same checks (in the same order) as go-camo does for a
+// request, stopping after the first check that prevents further checks.
+func (in *inspection) inspect(cmd *InspectCmd, keyring *encoding.Keyring, rules *ruleset.Ruleset) {
+	info, err := decodeURL(keyring, cmd.Url)
+	if err != nil {
+		in.fail("signature", "%s", err)
+		return
+	}
+	detail := info.Algorithm.String()
+	if info.KeyID != "" {
+		detail += fmt.Sprintf(", key id %q", info.KeyID)
+	}
+	in.ok("signature", "%s", detail)
+	fmt.Printf("url: %s\n", info.URL)
+
+	switch err := info.CheckTime(time.Now()); {
+	case errors.Is(err, encoding.ErrExpired):
+		in.fail("validity", "expired at %s", info.Expires.Format(time.RFC3339))
+	case errors.Is(err, encoding.ErrNotYetValid):
+		in.fail("validity", "not valid before %s", info.NotBefore.Format(time.RFC3339))
+	default:
+		in.ok("validity", "")
+	}
+
+	u, err := url.Parse(info.URL)
+	if err != nil {
+		in.fail("url", "%s", err)
+		return
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		in.fail("scheme", "%q is not http or https", u.Scheme)
+	} else {
+		in.ok("scheme", "%s", u.Scheme)
+	}
+
+	hostname := u.Hostname()
+	cleanHostname, err := htrie.CleanHostname(hostname)
+	switch {
+	case hostname == "":
+		in.fail("hostname", "empty hostname")
+		return
+	case err != nil:
+		in.fail("hostname", "malformed hostname: %s", err)
+		return
+	case camo.IsLocalHostname(cleanHostname):
+		in.fail("hostname", "%s is a local hostname", cleanHostname)
+	default:
+		in.ok("hostname", "%s", cleanHostname)
+	}
+
+	if u.User != nil && !cmd.AllowCredentialURLs {
+		in.fail("credentials", "url contains user/pass credentials")
+	} else {
+		in.ok("credentials", "")
+	}
+
+	if rules != nil {
+		result, err := rules.Evaluate(u)
+		switch {
+		case err != nil:
+			in.fail("filter-ruleset", "%s", err)
+		case result.Allowed && result.Rule != nil:
+			in.ok("filter-ruleset", "line %d: %s", result.Rule.Number, result.Rule.Text)
+		case result.Allowed:
+			in.ok("filter-ruleset", "no rule matched")
+		case result.Rule != nil:
+			in.fail("filter-ruleset", "line %d: %s", result.Rule.Number, result.Rule.Text)
+		default:
+			in.fail("filter-ruleset", "no allow rule matched")
+		}
+	}
+
+	if cmd.NoResolve {
+		return
+	}
+	ips := []net.IP{net.ParseIP(hostname)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(hostname)
+		if err != nil {
+			in.fail("resolve", "%s", err)
+			return
+		}
+	}
+	for _, ip := range ips {
+		if camo.IsRejectedIP(ip) {
+			in.fail("address", "%s is a private or reserved address", ip)
+		} else {
+			in.ok("address", "%s", ip)
+		}
+	}
+}
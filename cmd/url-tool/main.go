@@ -6,10 +6,13 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/cactus/go-camo/v2/pkg/encoding"
 
@@ -19,37 +22,288 @@ import (
 // ServerVersion holds the server version string
 var ServerVersion = "no-version"
 
+// outputFlags holds the encode options shared by the encode, sign, and
+// token commands
+type outputFlags struct {
+	Prefix   string        `name:"prefix" short:"p" default:"" help:"Optional url prefix used by encode output"`
+	TTL      time.Duration `name:"ttl" help:"Optional lifetime of the signed url (eg. 24h). The url expires after this time."`
+	Filename bool          `name:"append-filename" short:"f" help:"Append the origin url filename as an (unsigned) trailing path segment"`
+	Content  string        `name:"content" placeholder:"CLASSES" help:"Optional signed content classes the url may be proxied as (comma separated list of image, video, audio)"`
+	MaxSize  int64         `name:"max-size" placeholder:"INT" help:"Optional signed max response size for the url, in KB"`
+}
+
+// signOptions returns the signing options for the flags
+func (o *outputFlags) signOptions() (encoding.SignOptions, error) {
+	opts := encoding.SignOptions{}
+	if o.TTL < 0 {
+		return opts, errors.New("ttl must be positive")
+	}
+	if o.TTL > 0 {
+		opts.Expires = time.Now().Add(o.TTL)
+	}
+	if o.Content != "" {
+		classes, err := encoding.ParseContentClass(o.Content)
+		if err != nil {
+			return opts, err
+		}
+		opts.ContentClasses = classes
+	}
+	if o.MaxSize < 0 {
+		return opts, errors.New("max-size must be positive")
+	}
+	opts.MaxSize = o.MaxSize * 1024 // convert from KB to Bytes
+	return opts, nil
+}
+
+// format returns the encoded url path partial, with any prefix and filename
+func (o *outputFlags) format(outURL string, oURL string) string {
+	if o.Filename {
+		outURL += encoding.FilenameSegment(oURL)
+	}
+	return strings.TrimRight(o.Prefix, "/") + outURL
+}
+
+// print prints the encoded url path partial, with any prefix and filename
+func (o *outputFlags) print(outURL string, oURL string) {
+	fmt.Println(o.format(outURL, oURL))
+}
+
+// encodeFlags holds the options shared by the encode and batch encode
+// commands
+type encodeFlags struct {
+	Output    outputFlags `embed:""`
+	Base      string      `name:"base" short:"b" enum:"hex,base64" default:"hex" help:"Encode/Decode base. One of: ${enum}"`
+	Algorithm string      `name:"algorithm" short:"a" enum:"sha1,sha256,sha512-256" default:"sha1" help:"Signature algorithm. One of: ${enum}"`
+	Encrypt   bool        `name:"encrypt" help:"Encrypt the url (with XChaCha20-Poly1305), instead of signing it. Algorithm is ignored."`
+}
+
+// encoder returns a function that encodes a url with the keyring, and
+// formats it for output
+func (o *encodeFlags) encoder(keyring *encoding.Keyring) (func(string) (string, error), error) {
+	opts, err := o.Output.signOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.Algorithm, err = encoding.ParseAlgorithm(o.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var encode func(string, encoding.SignOptions) (string, error)
+	switch {
+	case o.Base == "base64" && o.Encrypt:
+		encode = keyring.B64EncryptURL
+	case o.Base == "base64":
+		encode = keyring.B64EncodeURL
+	case o.Base == "hex" && o.Encrypt:
+		encode = keyring.HexEncryptURL
+	case o.Base == "hex":
+		encode = keyring.HexEncodeURL
+	default:
+		return nil, errors.New("invalid base provided")
+	}
+
+	return func(oURL string) (string, error) {
+		if len(oURL) == 0 {
+			return "", errors.New("empty url")
+		}
+		outURL, err := encode(oURL, opts)
+		if err != nil {
+			return "", err
+		}
+		return o.Output.format(outURL, oURL), nil
+	}, nil
+}
+
 // EncodeCommand holds command options for the encode command
 type EncodeCmd struct {
-	Base   string `name:"base" short:"b" enum:"hex,base64" default:"hex" help:"Encode/Decode base. One of: ${enum}"`
-	Prefix string `name:"prefix" short:"p" default:"" help:"Optional url prefix used by encode output"`
-	Url    string `arg:"" name:"URL" help:"URL to encode"`
+	Flags encodeFlags `embed:""`
+	Url   string      `arg:"" name:"URL" help:"URL to encode"`
 }
 
 // Execute runs the encode command
 func (cmd *EncodeCmd) Run(cli *CLI) error {
-	if cli.HmacKey == "" {
-		return errors.New("empty HMAC")
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Url) == 0 {
+		return errors.New("no url argument provided")
+	}
+
+	encode, err := cmd.Flags.encoder(keyring)
+	if err != nil {
+		return err
+	}
+	outURL, err := encode(cmd.Url)
+	if err != nil {
+		return err
+	}
+	fmt.Println(outURL)
+	return nil
+}
+
+// SignCmd holds command options for the sign command
+type SignCmd struct {
+	Output         outputFlags `embed:""`
+	Base           string      `name:"base" short:"b" enum:"hex,base64" default:"hex" help:"Encode/Decode base. One of: ${enum}"`
+	PrivateKey     string      `name:"private-key" env:"GOCAMO_PRIVATE_KEY" help:"Ed25519 private key (base64), as printed by keygen"`
+	PrivateKeyFile string      `name:"private-key-file" placeholder:"PATH" help:"File containing the Ed25519 private key"`
+	KeyID          string      `name:"key-id" help:"Optional key id to include in the signature"`
+	Url            string      `arg:"" name:"URL" help:"URL to sign"`
+}
+
+// readPrivateKey returns the Ed25519 private key from either the key
+// option, or the key file option if set
+func readPrivateKey(privKey string, privKeyFile string) (ed25519.PrivateKey, error) {
+	if privKeyFile != "" {
+		// #nosec
+		b, err := os.ReadFile(privKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read private key file: %s", err)
+		}
+		privKey = strings.TrimSpace(string(b))
+	}
+	if privKey == "" {
+		return nil, errors.New("empty private key")
+	}
+	return encoding.ParseEd25519PrivateKey(privKey)
+}
+
+// Execute runs the sign command
+func (cmd *SignCmd) Run() error {
+	priv, err := readPrivateKey(cmd.PrivateKey, cmd.PrivateKeyFile)
+	if err != nil {
+		return err
 	}
 
 	if len(cmd.Url) == 0 {
 		return errors.New("no url argument provided")
 	}
 
-	hmacKeyBytes := []byte(cli.HmacKey)
+	opts, err := cmd.Output.signOptions()
+	if err != nil {
+		return err
+	}
+	opts.KeyID = cmd.KeyID
+
 	var outURL string
 	switch cmd.Base {
 	case "base64":
-		outURL = encoding.B64EncodeURL(hmacKeyBytes, cmd.Url)
+		outURL = encoding.Ed25519B64EncodeURL(priv, cmd.Url, opts)
 	case "hex":
-		outURL = encoding.HexEncodeURL(hmacKeyBytes, cmd.Url)
+		outURL = encoding.Ed25519HexEncodeURL(priv, cmd.Url, opts)
 	default:
 		return errors.New("invalid base provided")
 	}
-	fmt.Println(strings.TrimRight(cmd.Prefix, "/") + outURL)
+	cmd.Output.print(outURL, cmd.Url)
+	return nil
+}
+
+// TokenCmd holds command options for the token command
+type TokenCmd struct {
+	Output         outputFlags `embed:""`
+	Tenant         string      `name:"tenant" help:"Optional tenant claim"`
+	PrivateKey     string      `name:"private-key" env:"GOCAMO_PRIVATE_KEY" help:"Ed25519 private key (base64), to sign an EdDSA token instead of an HS256 one"`
+	PrivateKeyFile string      `name:"private-key-file" placeholder:"PATH" help:"File containing the Ed25519 private key"`
+	KeyID          string      `name:"key-id" help:"Optional key id to include in an EdDSA token"`
+	Url            string      `arg:"" name:"URL" help:"URL to include in the token"`
+}
+
+// Execute runs the token command
+func (cmd *TokenCmd) Run(cli *CLI) error {
+	if len(cmd.Url) == 0 {
+		return errors.New("no url argument provided")
+	}
+
+	opts, err := cmd.Output.signOptions()
+	if err != nil {
+		return err
+	}
+	claims := encoding.TokenClaims{
+		URL:     cmd.Url,
+		Tenant:  cmd.Tenant,
+		MaxSize: opts.MaxSize,
+	}
+	if opts.ContentClasses != 0 {
+		claims.Content = opts.ContentClasses.String()
+	}
+	if !opts.Expires.IsZero() {
+		claims.Expires = opts.Expires.Unix()
+	}
+
+	var outURL string
+	if cmd.PrivateKey != "" || cmd.PrivateKeyFile != "" {
+		priv, err := readPrivateKey(cmd.PrivateKey, cmd.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		outURL, err = encoding.EdDSAEncodeToken(priv, cmd.KeyID, claims)
+		if err != nil {
+			return err
+		}
+	} else {
+		keyring, err := cli.keyring()
+		if err != nil {
+			return err
+		}
+		outURL, err = keyring.EncodeToken(claims)
+		if err != nil {
+			return err
+		}
+	}
+	cmd.Output.print(outURL, cmd.Url)
+	return nil
+}
+
+// KeygenCmd holds command options for the keygen command
+type KeygenCmd struct {
+	KeyID string `name:"key-id" help:"Optional key id, used to also print a keyring file line"`
+}
+
+// Execute runs the keygen command
+func (cmd *KeygenCmd) Run() error {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("private-key: %s\n", encoding.EncodeEd25519PrivateKey(priv))
+	fmt.Printf("public-key: %s\n", encoding.EncodeEd25519PublicKey(pub))
+	if cmd.KeyID != "" {
+		fmt.Printf("keyring: %s:ed25519:%s\n", cmd.KeyID, encoding.EncodeEd25519PublicKey(pub))
+	}
 	return nil
 }
 
+// decodeURL verifies (or decrypts) a signed url with the keyring
+func decodeURL(keyring *encoding.Keyring, sURL string) (*encoding.URLInfo, error) {
+	u, err := url.Parse(sURL)
+	if err != nil {
+		return nil, err
+	}
+	// /<token>[/<filename>], /<digest>/<encoded-url>[/<filename>], or
+	// /<digest>?url=<escaped-url>
+	var info *encoding.URLInfo
+	for _, codec := range []encoding.Codec{
+		&encoding.TokenCodec{Keyring: keyring},
+		&encoding.PathCodec{Keyring: keyring},
+		&encoding.QueryCodec{Keyring: keyring},
+	} {
+		info, err = codec.Decode(u)
+		if !errors.Is(err, encoding.ErrUnknownFormat) {
+			break
+		}
+	}
+	if errors.Is(err, encoding.ErrUnknownFormat) {
+		return nil, errors.New("malformed url path")
+	}
+	if err != nil {
+		return nil, errors.New("signature is invalid")
+	}
+	return info, nil
+}
+
 // DecodeCommand holds command options for the decode command
 type DecodeCmd struct {
 	Url string `arg:"" name:"URL" help:"URL to decode"`
@@ -57,37 +311,92 @@ type DecodeCmd struct {
 
 // Execute runs the decode command
 func (cmd *DecodeCmd) Run(cli *CLI) error {
-	if cli.HmacKey == "" {
-		return errors.New("empty HMAC")
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
 	}
 
 	if len(cmd.Url) == 0 {
 		return errors.New("no url argument provided")
 	}
 
-	hmacKeyBytes := []byte(cli.HmacKey)
-
-	u, err := url.Parse(cmd.Url)
+	info, err := decodeURL(keyring, cmd.Url)
 	if err != nil {
 		return err
 	}
-	comp := strings.SplitN(u.Path, "/", 3)
-	decURL, valid := encoding.DecodeURL(hmacKeyBytes, comp[1], comp[2])
-	if !valid {
-		return errors.New("hmac is invalid")
+	fmt.Println(info.URL)
+
+	if info.Claims != nil && info.Claims.Tenant != "" {
+		fmt.Printf("tenant: %s\n", info.Claims.Tenant)
+	}
+
+	now := time.Now()
+	if !info.NotBefore.IsZero() {
+		fmt.Printf("not-before: %s\n", info.NotBefore.Format(time.RFC3339))
+	}
+	if !info.Expires.IsZero() {
+		status := ""
+		if errors.Is(info.CheckTime(now), encoding.ErrExpired) {
+			status = " (expired)"
+		}
+		fmt.Printf("expires: %s%s\n", info.Expires.Format(time.RFC3339), status)
+	}
+	if info.ContentClasses != 0 {
+		fmt.Printf("content: %s\n", info.ContentClasses)
+	}
+	if info.MaxSize > 0 {
+		fmt.Printf("max-size: %d bytes\n", info.MaxSize)
 	}
-	fmt.Println(decURL)
 	return nil
 }
 
 type CLI struct { // betteralign:ignore
 	// global options
-	Version kong.VersionFlag `name:"version" short:"V" help:"Print version information and quit"`
-	HmacKey string           `name:"key" short:"k" help:"HMAC key"`
+	Version   kong.VersionFlag `name:"version" short:"V" help:"Print version information and quit"`
+	HmacKey   string           `name:"key" short:"k" help:"HMAC key"`
+	PublicKey string           `name:"public-key" placeholder:"[KEY-ID:]KEY" help:"Ed25519 public key (base64), used to verify ed25519 signed urls"`
+	Keyring   string           `name:"keyring" placeholder:"PATH" help:"File containing keys with key ids (one '<key-id>:<secret>' or '<key-id>:ed25519:<public-key>' per line). Keys are added after any --key key."`
 
 	// subcommands
-	Encode EncodeCmd `cmd:"" aliases:"enc" help:"Encode a url and print result"`
-	Decode DecodeCmd `cmd:"" aliases:"dec" help:"Decode a url and print result"`
+	Encode          EncodeCmd          `cmd:"" aliases:"enc" help:"Encode a url and print result"`
+	Decode          DecodeCmd          `cmd:"" aliases:"dec" help:"Decode a url and print result"`
+	Sign            SignCmd            `cmd:"" help:"Sign a url with an Ed25519 private key and print result"`
+	Token           TokenCmd           `cmd:"" help:"Encode a url, with claims, as a signed token and print result"`
+	Keygen          KeygenCmd          `cmd:"" help:"Generate an Ed25519 key pair"`
+	Batch           BatchCmd           `cmd:"" help:"Encode or decode urls in bulk, from stdin or files"`
+	RewriteHTML     RewriteHTMLCmd     `cmd:"" name:"rewrite-html" help:"Rewrite image and media urls in html into signed urls"`
+	RewriteMarkdown RewriteMarkdownCmd `cmd:"" name:"rewrite-markdown" help:"Rewrite image urls in markdown into signed urls"`
+	Rules           RulesCmd           `cmd:"" help:"Lint or test a go-camo filter ruleset file"`
+	Inspect         InspectCmd         `cmd:"" help:"Explain whether go-camo would accept or reject a signed url"`
+	Fetch           FetchCmd           `cmd:"" help:"Fetch a signed url through an in-process go-camo proxy (without its cache, negative cache, or peers), and print the decision trace"`
+	Prefetch        PrefetchCmd        `cmd:"" help:"Warm the go-camo response cache, by fetching urls through the cache prefetch endpoint"`
+}
+
+// keyring returns a keyring built from the key and keyring options.
+// The first key is used for signing.
+func (cli *CLI) keyring() (*encoding.Keyring, error) {
+	keys := make([]encoding.Key, 0)
+	if cli.HmacKey != "" {
+		keys = append(keys, encoding.Key{Secret: []byte(cli.HmacKey)})
+	}
+	if cli.PublicKey != "" {
+		key, err := encoding.ParseEd25519Key(cli.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if cli.Keyring != "" {
+		fileKeys, err := encoding.ReadKeysFile(cli.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("empty HMAC and public key")
+	}
+	return encoding.NewKeyring(keys...)
 }
 
 // #nosec G104
@@ -0,0 +1,174 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/prefetch"
+)
+
+// PrefetchCmd holds command options for the prefetch command
+type PrefetchCmd struct {
+	Endpoint string        `name:"endpoint" short:"e" placeholder:"URL" required:"" help:"go-camo cache prefetch endpoint url (eg. https://img.example.org/prefetch)"`
+	Token    string        `name:"token" env:"GOCAMO_SIGN_TOKEN" help:"Bearer token that authorizes prefetch requests"`
+	Origin   bool          `name:"origin" help:"The urls are origin urls, signed by go-camo, rather than signed urls"`
+	Format   string        `name:"format" enum:"text,jsonl" default:"text" help:"Output format. One of: ${enum}"`
+	Chunk    int           `name:"chunk" default:"100" help:"Number of urls sent per request"`
+	Timeout  time.Duration `name:"timeout" default:"5m" help:"Timeout of each request to the endpoint"`
+	Files    []string      `arg:"" optional:"" name:"FILE" help:"Input files, with one url per line. Reads stdin if none are given, or for '-'."`
+}
+
+// prefetchResult is the result of prefetching a url, as returned by the
+// endpoint
+type prefetchResult struct {
+	URL     string `json:"url"`
+	CamoURL string `json:"camo_url,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// readURLs returns the urls in the input files (or stdin, for '-'). Blank
+// lines, and lines starting with '#', are ignored.
+func readURLs(files []string) ([]string, error) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	urls := make([]string, 0)
+	for _, name := range files {
+		in := io.Reader(os.Stdin)
+		if name != "-" {
+			// #nosec
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, fmt.Errorf("could not open input file: %s", err)
+			}
+			defer f.Close() // #nosec G307
+			in = f
+		}
+
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			urls = append(urls, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", name, err)
+		}
+	}
+	return urls, nil
+}
+
+// prefetch sends the urls to the endpoint, and returns the results
+func (cmd *PrefetchCmd) prefetch(client *http.Client, urls []string) ([]prefetchResult, error) {
+	body, err := json.Marshal(map[string]any{"urls": urls, "origin": cmd.Origin})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, cmd.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cmd.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cmd.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // #nosec G307
+
+	var out struct {
+		Error string           `json:"error"`
+		URLs  []prefetchResult `json:"urls"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid response from endpoint (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("endpoint error (%s): %s", resp.Status, out.Error)
+	}
+	if len(out.URLs) != len(urls) {
+		return nil, fmt.Errorf("endpoint returned %d results for %d urls", len(out.URLs), len(urls))
+	}
+	return out.URLs, nil
+}
+
+// Execute runs the prefetch command
+func (cmd *PrefetchCmd) Run() error {
+	if cmd.Chunk <= 0 || cmd.Chunk > prefetch.DefaultMaxURLs {
+		return fmt.Errorf("chunk must be between 1 and %d", prefetch.DefaultMaxURLs)
+	}
+
+	urls, err := readURLs(cmd.Files)
+	if err != nil {
+		return err
+	}
+	if len(urls) == 0 {
+		return errors.New("no urls provided")
+	}
+
+	client := &http.Client{Timeout: cmd.Timeout}
+	out := bufio.NewWriter(os.Stdout)
+	failed := 0
+	for chunk := range slices.Chunk(urls, cmd.Chunk) {
+		results, err := cmd.prefetch(client, chunk)
+		if err != nil {
+			return err
+		}
+
+		for _, res := range results {
+			if res.Error != "" {
+				failed++
+				fmt.Fprintf(os.Stderr, "url-tool: %s: %s\n", res.URL, res.Error)
+			}
+			if cmd.Format == "jsonl" {
+				b, err := json.Marshal(res)
+				if err != nil {
+					return err
+				}
+				b = append(b, '\n')
+				if _, err := out.Write(b); err != nil {
+					return err
+				}
+				continue
+			}
+			status := "-"
+			if res.Status != 0 {
+				status = strconv.Itoa(res.Status)
+			}
+			if _, err := fmt.Fprintf(out, "%s\t%d\t%s\n", status, res.Size, res.URL); err != nil {
+				return err
+			}
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d urls failed", failed, len(urls))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/rewrite"
+)
+
+// rewriteFlags holds the options shared by the rewrite commands
+type rewriteFlags struct {
+	Output           outputFlags `embed:""`
+	Algorithm        string      `name:"algorithm" short:"a" enum:"sha1,sha256,sha512-256" default:"sha1" help:"Signature algorithm. One of: ${enum}"`
+	PassthroughHTTPS bool        `name:"passthrough-https" help:"Leave https urls as they are, rather than proxying them"`
+	ExcludeHosts     []string    `name:"exclude-host" placeholder:"HOST" help:"Leave urls for this host as they are. A leading '*.' matches any subdomain. May be given more than once."`
+	Files            []string    `arg:"" optional:"" name:"FILE" help:"Input files. Reads stdin if none are given, or for '-'."`
+}
+
+// rewriter returns a rewriter that signs urls with the keyring (as base64
+// path format urls)
+func (o *rewriteFlags) rewriter(keyring *encoding.Keyring) (*rewrite.Rewriter, error) {
+	opts, err := o.Output.signOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.Algorithm, err = encoding.ParseAlgorithm(o.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return rewrite.New(rewrite.Config{
+		Encoder: func(oURL string) (string, error) {
+			encURL, err := keyring.B64EncodeURL(oURL, opts)
+			if err != nil {
+				return "", err
+			}
+			if o.Output.Filename {
+				encURL += encoding.FilenameSegment(oURL)
+			}
+			return encURL, nil
+		},
+		Prefix:           o.Output.Prefix,
+		ExcludeHosts:     o.ExcludeHosts,
+		PassthroughHTTPS: o.PassthroughHTTPS,
+	})
+}
+
+// run rewrites each input file (or stdin) to stdout with rewriteFn
+func (o *rewriteFlags) run(rewriteFn func(io.Writer, io.Reader) error) error {
+	out := bufio.NewWriter(os.Stdout)
+
+	files := o.Files
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if name == "-" {
+			if err := rewriteFn(out, os.Stdin); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// #nosec
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("could not open input file: %s", err)
+		}
+		err = rewriteFn(out, f)
+		f.Close() // #nosec G104
+		if err != nil {
+			return fmt.Errorf("could not rewrite %s: %s", name, err)
+		}
+	}
+	return out.Flush()
+}
+
+// RewriteHTMLCmd holds command options for the rewrite-html command
+type RewriteHTMLCmd struct {
+	Flags rewriteFlags `embed:""`
+}
+
+// Execute runs the rewrite-html command
+func (cmd *RewriteHTMLCmd) Run(cli *CLI) error {
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+	r, err := cmd.Flags.rewriter(keyring)
+	if err != nil {
+		return err
+	}
+	return cmd.Flags.run(r.HTML)
+}
+
+// RewriteMarkdownCmd holds command options for the rewrite-markdown command
+type RewriteMarkdownCmd struct {
+	Flags rewriteFlags `embed:""`
+}
+
+// Execute runs the rewrite-markdown command
+func (cmd *RewriteMarkdownCmd) Run(cli *CLI) error {
+	keyring, err := cli.keyring()
+	if err != nil {
+		return err
+	}
+	r, err := cmd.Flags.rewriter(keyring)
+	if err != nil {
+		return err
+	}
+	return cmd.Flags.run(r.Markdown)
+}
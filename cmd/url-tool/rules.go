@@ -0,0 +1,118 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cactus/go-camo/v2/pkg/ruleset"
+)
+
+// RulesLintCmd holds command options for the rules lint command
+type RulesLintCmd struct {
+	Strict  bool   `name:"strict" help:"Exit non-zero on warnings, as well as errors"`
+	Ruleset string `arg:"" name:"RULESET" help:"Filter ruleset file, as used with go-camo --filter-ruleset"`
+}
+
+// Execute runs the rules lint command
+func (cmd *RulesLintCmd) Run() error {
+	// #nosec
+	f, err := os.Open(cmd.Ruleset)
+	if err != nil {
+		return fmt.Errorf("could not open filter-ruleset file: %s", err)
+	}
+	// #nosec
+	defer f.Close()
+
+	issues, err := ruleset.Lint(f)
+	if err != nil {
+		return err
+	}
+
+	errCount, warnCount := 0, 0
+	for _, issue := range issues {
+		fmt.Printf("%s: %s\n", cmd.Ruleset, issue)
+		if issue.Severity == ruleset.Error {
+			errCount++
+		} else {
+			warnCount++
+		}
+	}
+	if errCount > 0 || (cmd.Strict && warnCount > 0) {
+		return fmt.Errorf("%d errors, %d warnings", errCount, warnCount)
+	}
+	return nil
+}
+
+// RulesTestCmd holds command options for the rules test command
+type RulesTestCmd struct {
+	Verbose bool   `name:"verbose" short:"v" help:"Also print passing cases"`
+	Ruleset string `arg:"" name:"RULESET" help:"Filter ruleset file, as used with go-camo --filter-ruleset"`
+	Cases   string `arg:"" name:"CASES" help:"Test cases file, with one 'allow <url>' or 'deny <url>' per line"`
+}
+
+// Execute runs the rules test command
+func (cmd *RulesTestCmd) Run() error {
+	rules, err := ruleset.Load(cmd.Ruleset)
+	if err != nil {
+		return err
+	}
+
+	// #nosec
+	f, err := os.Open(cmd.Cases)
+	if err != nil {
+		return fmt.Errorf("could not open test cases file: %s", err)
+	}
+	// #nosec
+	defer f.Close()
+
+	cases, err := ruleset.ParseCases(f)
+	if err != nil {
+		return fmt.Errorf("error reading test cases: %s", err)
+	}
+
+	failed := 0
+	for _, c := range cases {
+		result, err := rules.Evaluate(c.URL)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s:%d: %s: %s\n", cmd.Cases, c.Number, c.URL, err)
+			continue
+		}
+
+		want := "deny"
+		if c.Allow {
+			want = "allow"
+		}
+		got, reason := "deny", "no allow rule matched"
+		if result.Allowed {
+			got, reason = "allow", "no rule matched"
+		}
+		if result.Rule != nil {
+			reason = fmt.Sprintf("%s:%d: %s", cmd.Ruleset, result.Rule.Number, result.Rule.Text)
+		}
+
+		switch {
+		case result.Allowed != c.Allow:
+			failed++
+			fmt.Printf("FAIL %s:%d: %s: expected %s, got %s (%s)\n", cmd.Cases, c.Number, c.URL, want, got, reason)
+		case cmd.Verbose:
+			fmt.Printf("ok   %s:%d: %s: %s (%s)\n", cmd.Cases, c.Number, c.URL, got, reason)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cases failed", failed, len(cases))
+	}
+	fmt.Printf("%d cases passed\n", len(cases))
+	return nil
+}
+
+// RulesCmd holds the rules subcommands
+type RulesCmd struct {
+	Lint RulesLintCmd `cmd:"" help:"Check a filter ruleset file for malformed, shadowed, and never matching rules"`
+	Test RulesTestCmd `cmd:"" help:"Check a filter ruleset against a file of expected allow/deny results"`
+}
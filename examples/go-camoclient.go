@@ -0,0 +1,33 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+// +build ignore
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cactus/go-camo/v2/pkg/camoclient"
+)
+
+func main() {
+	client, err := camoclient.New(camoclient.Config{
+		BaseURL:          "https://img.example.com",
+		HMACKey:          []byte("test"),
+		Encoding:         "base64",
+		PassthroughHTTPS: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	camoURL, err := client.URL("http://golang.org/doc/gopher/frontpage.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(camoURL)
+}
@@ -0,0 +1,630 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/dropwhile/mlog"
+)
+
+// DefaultCacheMaxEntrySize is the default largest response body (in bytes)
+// stored in a Cache.
+const DefaultCacheMaxEntrySize = 10 << 20
+
+// Warning headers added to stale responses
+const (
+	staleWarning              = `110 - "Response is Stale"`
+	revalidationFailedWarning = `111 - "Revalidation Failed"`
+)
+
+// ErrCacheMiss is returned by Cache.Get when there is no entry for a key.
+var ErrCacheMiss = errors.New("cache miss")
+
+// A Cache stores upstream responses, keyed by origin url.
+//
+// Entries are not modified once they are passed to Set, or returned by Get.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the entry for the key, or ErrCacheMiss if there is none.
+	// Stale entries may be returned, so they can be revalidated.
+	Get(ctx context.Context, key string) (*CacheEntry, error)
+	// Set stores the entry for the key, replacing any existing entry.
+	Set(ctx context.Context, key string, entry *CacheEntry) error
+	// Delete removes the entry for the key, if there is one.
+	Delete(ctx context.Context, key string) error
+}
+
+// A TieredCache is a Cache made of other caches (eg. a MemoryCache in front
+// of a DiskCache). Entries are looked up in each tier in order, and entries
+// found in a later tier are added to the earlier ones. Entries are stored in
+// every tier.
+type TieredCache struct {
+	tiers []Cache
+}
+
+// NewTieredCache returns a new TieredCache, with the tiers in lookup order.
+func NewTieredCache(tiers ...Cache) *TieredCache {
+	return &TieredCache{tiers: tiers}
+}
+
+// Get returns the entry for the key from the first tier that has it, or
+// ErrCacheMiss.
+func (c *TieredCache) Get(ctx context.Context, key string) (*CacheEntry, error) {
+	var errs []error
+	for i, tier := range c.tiers {
+		entry, err := tier.Get(ctx, key)
+		if errors.Is(err, ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, earlier := range c.tiers[:i] {
+			// #nosec G104
+			earlier.Set(ctx, key, entry)
+		}
+		return entry, nil
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrCacheMiss
+}
+
+// Set stores the entry for the key in every tier.
+func (c *TieredCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	var errs []error
+	for _, tier := range c.tiers {
+		errs = append(errs, tier.Set(ctx, key, entry))
+	}
+	return errors.Join(errs...)
+}
+
+// Delete removes the entry for the key from every tier.
+func (c *TieredCache) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, tier := range c.tiers {
+		errs = append(errs, tier.Delete(ctx, key))
+	}
+	return errors.Join(errs...)
+}
+
+// A CacheEntry is a cached upstream (200 OK) response.
+type CacheEntry struct {
+	// Stored is the time the response was received, or last revalidated.
+	Stored time.Time
+	// Expires is the time the response becomes stale, and must be
+	// revalidated before it is used.
+	Expires time.Time
+	// Header holds the response headers, filtered by ValidRespHeaders.
+	Header http.Header
+	// Body is the response body.
+	Body []byte
+}
+
+// Fresh reports whether the entry can be used without revalidation at
+// time now.
+func (e *CacheEntry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Size returns the approximate memory size of the entry, in bytes.
+func (e *CacheEntry) Size() int64 {
+	size := int64(len(e.Body))
+	for k, vv := range e.Header {
+		for _, v := range vv {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// canRevalidate reports whether the entry has a validator (ETag or
+// Last-Modified) for conditional requests.
+func (e *CacheEntry) canRevalidate() bool {
+	return e.Header.Get("Etag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// revalidated returns a copy of the entry, updated from the headers of a 304
+// response to a conditional request.
+func (e *CacheEntry) revalidated(h http.Header, now time.Time) *CacheEntry {
+	header := e.Header.Clone()
+	for _, k := range []string{"Cache-Control", "Etag", "Expires", "Last-Modified"} {
+		if v := h.Values(k); len(v) > 0 {
+			header[k] = v
+		}
+	}
+	lifetime, _ := freshnessLifetime(h, now)
+	return &CacheEntry{
+		Stored:  now,
+		Expires: now.Add(lifetime),
+		Header:  header,
+		Body:    e.Body,
+	}
+}
+
+// response returns an http.Response for the entry, as a response to req. If
+// the request is conditional (If-None-Match or If-Modified-Since), and the
+// entry matches, a 304 Not Modified response is returned.
+func (e *CacheEntry) response(req *http.Request) *http.Response {
+	h := e.Header.Clone()
+	status, body := http.StatusOK, e.Body
+	if notModified(req.Header, h) {
+		status, body = http.StatusNotModified, nil
+		h.Del("Content-Length")
+	} else {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// staleWarningKey is the context key of the Warning header for a stale
+// response, set on the response request. Upstream Warning headers are not
+// passed on, so only stale responses (see responseWarning) get one.
+type staleWarningKey struct{}
+
+// staleResponse returns an http.Response for a stale entry (see response),
+// marked with a Warning header value.
+func (e *CacheEntry) staleResponse(req *http.Request, warning string) *http.Response {
+	return e.response(req.WithContext(context.WithValue(req.Context(), staleWarningKey{}, warning)))
+}
+
+// responseWarning returns the Warning header value for a stale response, or
+// an empty string.
+func responseWarning(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	warning, _ := resp.Request.Context().Value(staleWarningKey{}).(string)
+	return warning
+}
+
+// setWarning sets the Warning header on h, if resp is a stale response
+func setWarning(h http.Header, resp *http.Response) {
+	if warning := responseWarning(resp); warning != "" {
+		h.Set("Warning", warning)
+	}
+}
+
+// staleWindow returns how long after it expires the entry may be served
+// stale, for a Cache-Control directive (stale-while-revalidate or
+// stale-if-error). The directive may shorten the window, but not lengthen
+// it past limit. Entries that must be revalidated (no-cache,
+// must-revalidate, or a zero lifetime) are never served stale.
+func (e *CacheEntry) staleWindow(directive string, limit time.Duration) time.Duration {
+	if limit <= 0 || !e.Expires.After(e.Stored) {
+		return 0
+	}
+	cc := cacheControl(e.Header)
+	for _, name := range []string{"no-cache", "must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[name]; ok {
+			return 0
+		}
+	}
+	if v, ok := cc[directive]; ok {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds <= 0 {
+			return 0
+		}
+		if seconds >= int64(limit/time.Second) {
+			return limit
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return limit
+}
+
+// usableStale reports whether the stale entry may be served at time now,
+// for a Cache-Control directive (see staleWindow).
+func (e *CacheEntry) usableStale(now time.Time, directive string, limit time.Duration) bool {
+	return now.Before(e.Expires.Add(e.staleWindow(directive, limit)))
+}
+
+// notModified reports whether a conditional request matches the response
+// headers, so a 304 Not Modified can be sent.
+func notModified(reqHeader http.Header, h http.Header) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// cacheControl returns the Cache-Control directives, with lower case names
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// freshnessLifetime returns how long a response with the headers can be
+// used without revalidation, and whether it can be cached at all.
+//
+// The lifetime is from Cache-Control s-maxage or max-age, then Expires,
+// then a heuristic of 10% of the time since Last-Modified (at most a day).
+// Responses with a zero lifetime are only cached if they can be
+// revalidated.
+func freshnessLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	if h.Get("Vary") == "*" {
+		return 0, false
+	}
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+
+	canRevalidate := h.Get("Etag") != "" || h.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return 0, canRevalidate
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[name]; ok {
+			seconds, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || seconds <= 0 {
+				return 0, canRevalidate
+			}
+			return time.Duration(min(seconds, int64(365*24*time.Hour/time.Second))) * time.Second, true
+		}
+	}
+
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil || !expires.After(date) {
+			return 0, canRevalidate
+		}
+		return expires.Sub(date), true
+	}
+
+	if lastModified, err := http.ParseTime(h.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		return min(date.Sub(lastModified)/10, 24*time.Hour), true
+	}
+
+	return 0, canRevalidate
+}
+
+// flight is an in progress upstream fetch of a cache entry
+type flight struct {
+	done  chan struct{}
+	entry *CacheEntry
+	err   error
+}
+
+// flightGroup coalesces concurrent fetches of the same cache entry
+type flightGroup struct {
+	flights map[string]*flight
+	mu      sync.Mutex
+}
+
+// do calls fn, unless a call for the same key is already in progress, in
+// which case it waits for that call and returns its result. Reports
+// whether the result was shared from another call.
+func (g *flightGroup) do(key string, fn func() (*CacheEntry, error)) (*CacheEntry, bool, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.entry, true, f.err
+	}
+	f := g.start(key)
+	g.mu.Unlock()
+
+	defer g.finish(key, f)
+	f.entry, f.err = fn()
+	return f.entry, false, f.err
+}
+
+// goDo calls fn in a new goroutine, unless a call for the same key is
+// already in progress. Calls to do for the key wait for it.
+func (g *flightGroup) goDo(key string, fn func() (*CacheEntry, error)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.flights[key]; ok {
+		return
+	}
+	f := g.start(key)
+	go func() {
+		defer g.finish(key, f)
+		f.entry, f.err = fn()
+	}()
+}
+
+// start adds an in progress call. The lock must be held.
+func (g *flightGroup) start(key string) *flight {
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f
+}
+
+// finish removes a call, and wakes its waiters
+func (g *flightGroup) finish(key string, f *flight) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// readCloser is an io.ReadCloser from separate reader and closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// send sends an upstream request
+func (p *Proxy) send(req *http.Request) (*http.Response, error) {
+	contextTrace(req.Context()).outboundRequest(req)
+	return p.client.Do(req) // #nosec G704
+}
+
+// do sends the upstream request, consulting the cache (if any) first.
+// Concurrent cache misses for the same url are coalesced into a single
+// upstream request. Requests for urls owned by another peer (if any) are
+// forwarded to it instead.
+func (p *Proxy) do(req *http.Request, opts *requestOptions) (*http.Response, error) {
+	if p.peers != nil && req.Header.Get("Range") == "" &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		req.Context().Value(peerRequestKey{}) == nil {
+		if owner := p.peers.Owner(req.URL.String()); owner != p.peers.self {
+			resp, err := p.forward(req, owner, opts)
+			if !errors.Is(err, errPeerUnavailable) {
+				if p.config.CollectMetrics {
+					peerForwards.WithLabelValues("ok").Inc()
+				}
+				return resp, err
+			}
+			// fall back to fetching it here
+			mlog.Printx("peer request failed", mlog.A("peer", owner), mlog.A("err", err))
+			if p.config.CollectMetrics {
+				peerForwards.WithLabelValues("fallback").Inc()
+			}
+		}
+	}
+
+	// range requests are passed through
+	if p.cache == nil || req.Header.Get("Range") != "" ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return p.send(req)
+	}
+
+	ctx := req.Context()
+	key := req.URL.String()
+	entry, err := p.cache.Get(ctx, key)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		mlog.Printx("cache lookup failed", mlog.A("err", err))
+	}
+	now := time.Now()
+	if entry != nil && entry.Fresh(now) {
+		if p.config.CollectMetrics {
+			cacheHits.Inc()
+		}
+		if mlog.HasDebug() {
+			mlog.Debugx("cache hit", mlog.A("url", key))
+		}
+		return entry.response(req), nil
+	}
+	if req.Method != http.MethodGet {
+		return p.send(req)
+	}
+
+	// fetches for different request options are not shared, as the
+	// options decide whether a response is cached
+	flightKey := key + " " + opts.accept.header + " " + strconv.FormatInt(opts.maxSize, 10)
+
+	if entry != nil && entry.usableStale(now, "stale-while-revalidate", p.config.CacheStaleWhileRevalidate) {
+		if p.config.CollectMetrics {
+			cacheStale.WithLabelValues("revalidate").Inc()
+		}
+		if mlog.HasDebug() {
+			mlog.Debugx("cache stale hit, revalidating", mlog.A("url", key))
+		}
+		p.flights.goDo(flightKey, func() (*CacheEntry, error) {
+			resp, fetched, err := p.fetch(req, key, entry, opts)
+			if resp != nil {
+				// #nosec G104
+				resp.Body.Close()
+			}
+			if err != nil {
+				mlog.Printx("background revalidation failed", mlog.A("url", key), mlog.A("err", err))
+			}
+			return fetched, err
+		})
+		return entry.staleResponse(req, staleWarning), nil
+	}
+
+	resp, err := p.fetchShared(req, key, flightKey, entry, opts)
+	if entry != nil && (err != nil || resp.StatusCode >= 500) &&
+		!errors.Is(err, context.Canceled) &&
+		entry.usableStale(now, "stale-if-error", p.config.CacheStaleIfError) {
+		if resp != nil {
+			// #nosec G104
+			resp.Body.Close()
+		}
+		if p.config.CollectMetrics {
+			cacheStale.WithLabelValues("error").Inc()
+		}
+		if mlog.HasDebug() {
+			mlog.Debugx("upstream failed, serving stale", mlog.A("url", key), mlog.A("err", err))
+		}
+		return entry.staleResponse(req, revalidationFailedWarning), nil
+	}
+	return resp, err
+}
+
+// fetchShared sends an upstream request for a cache miss (or stale cache
+// entry), coalesced with concurrent requests for the same flight key.
+func (p *Proxy) fetchShared(req *http.Request, key, flightKey string, entry *CacheEntry, opts *requestOptions) (*http.Response, error) {
+	var resp *http.Response
+	fetched, shared, err := p.flights.do(flightKey, func() (*CacheEntry, error) {
+		var fetched *CacheEntry
+		var err error
+		resp, fetched, err = p.fetch(req, key, entry, opts)
+		return fetched, err
+	})
+	if p.config.CollectMetrics {
+		if shared {
+			cacheCoalesced.Inc()
+		} else {
+			cacheMisses.Inc()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fetched != nil {
+		return fetched.response(req), nil
+	}
+	if resp != nil {
+		return resp, nil
+	}
+	// the upstream response could not be cached, so it was not shared
+	return p.send(req)
+}
+
+// fetch sends an upstream request for a cache miss (or stale cache entry),
+// and caches the response if possible. Returns the entry if the response
+// was cached, otherwise the response.
+func (p *Proxy) fetch(req *http.Request, key string, stale *CacheEntry, opts *requestOptions) (*http.Response, *CacheEntry, error) {
+	// the fetch may be shared with other requests, so it is not cancelled
+	// with this one. the client timeout still applies.
+	ureq := req.Clone(context.WithoutCancel(req.Context()))
+	ureq.Header.Del("If-None-Match")
+	ureq.Header.Del("If-Modified-Since")
+	revalidate := stale != nil && stale.canRevalidate()
+	if revalidate {
+		if etag := stale.Header.Get("Etag"); etag != "" {
+			ureq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+			ureq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := p.send(ureq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if revalidate && resp.StatusCode == http.StatusNotModified {
+		// #nosec G104
+		resp.Body.Close()
+		if p.config.CollectMetrics {
+			cacheRevalidations.WithLabelValues("not_modified").Inc()
+		}
+		entry := stale.revalidated(resp.Header, now)
+		p.store(ureq.Context(), key, entry)
+		return nil, entry, nil
+	}
+	if revalidate && p.config.CollectMetrics {
+		cacheRevalidations.WithLabelValues("modified").Inc()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, nil
+	}
+	lifetime, ok := freshnessLifetime(resp.Header, now)
+	if !ok {
+		return resp, nil, nil
+	}
+	// only cache responses this request would accept
+	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !opts.accept.filter.CheckPath(mediatype) {
+		return resp, nil, nil
+	}
+
+	limit := p.cacheMaxEntrySize
+	if opts.maxSize > 0 && opts.maxSize < limit {
+		limit = opts.maxSize
+	}
+	if resp.ContentLength > limit {
+		return resp, nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		// #nosec G104
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if int64(len(body)) > limit {
+		// too large to cache. pass on what was read, along with the rest.
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil, nil
+	}
+	// #nosec G104
+	resp.Body.Close()
+
+	header := make(http.Header)
+	p.copyHeaders(&header, &resp.Header, &ValidRespHeaders)
+	header.Del("Transfer-Encoding")
+	entry := &CacheEntry{
+		Stored:  now,
+		Expires: now.Add(lifetime),
+		Header:  header,
+		Body:    body,
+	}
+	p.store(ureq.Context(), key, entry)
+	return nil, entry, nil
+}
+
+// store adds an entry to the cache
+func (p *Proxy) store(ctx context.Context, key string, entry *CacheEntry) {
+	if err := p.cache.Set(ctx, key, entry); err != nil {
+		mlog.Printx("cache store failed", mlog.A("err", err))
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bufio"
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCacheMagic is the first line of a disk cache entry file
+const diskCacheMagic = "go-camo-cache 1\n"
+
+// DiskCacheConfig holds configuration data used when creating a DiskCache
+// with NewDiskCache.
+type DiskCacheConfig struct {
+	// Dir is the directory entries are stored in. It is created if needed.
+	Dir string
+	// MaxBytes is the maximum total size of the entry files, in bytes.
+	MaxBytes int64
+	// Whether to call/increment metrics
+	CollectMetrics bool
+}
+
+// A DiskCache is a Cache that stores entries as files in a directory,
+// bounded by total size. The least recently used entries are evicted first.
+// Entries are kept across restarts.
+type DiskCache struct {
+	files          map[string]*list.Element
+	lru            *list.List
+	dir            string
+	maxBytes       int64
+	size           int64
+	mu             sync.Mutex
+	collectMetrics bool
+}
+
+// diskItem is a DiskCache list item
+type diskItem struct {
+	name string
+	size int64
+}
+
+// diskMeta is the metadata stored ahead of the body in an entry file
+type diskMeta struct {
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+	Header  http.Header `json:"header"`
+	Key     string      `json:"key"`
+}
+
+// NewDiskCache returns a new DiskCache, with the existing entries in the
+// directory (if any).
+func NewDiskCache(config DiskCacheConfig) (*DiskCache, error) {
+	if config.Dir == "" {
+		return nil, errors.New("cache directory required")
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %s", err)
+	}
+
+	c := &DiskCache{
+		files:          make(map[string]*list.Element),
+		lru:            list.New(),
+		dir:            config.Dir,
+		maxBytes:       config.MaxBytes,
+		collectMetrics: config.CollectMetrics,
+	}
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("could not read cache directory: %s", err)
+	}
+	return c, nil
+}
+
+// load indexes the existing entry files, least recently used (by
+// modification time) first, and evicts entries over the size limit.
+func (c *DiskCache) load() error {
+	type file struct {
+		modTime time.Time
+		diskItem
+	}
+	files := make([]file, 0)
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// remove partially written files
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+		if len(d.Name()) != sha256.Size*2 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{
+			modTime:  info.ModTime(),
+			diskItem: diskItem{name: d.Name(), size: info.Size()},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(files, func(a, b file) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		item := f.diskItem
+		c.files[item.name] = c.lru.PushFront(&item)
+		c.size += item.size
+	}
+	c.evict()
+	return nil
+}
+
+// name returns the entry file name for a key
+func (c *DiskCache) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns the path of an entry file
+func (c *DiskCache) path(name string) string {
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// Get returns the entry for the key, or ErrCacheMiss.
+func (c *DiskCache) Get(ctx context.Context, key string) (*CacheEntry, error) {
+	name := c.name(key)
+	c.mu.Lock()
+	elem, ok := c.files[name]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	path := c.path(name)
+	// #nosec G304
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.mu.Lock()
+		// re-checked under the lock, as a concurrent Set may have added it
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			c.forget(name)
+		}
+		c.mu.Unlock()
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G104
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, err := r.ReadString('\n')
+	if err == nil && magic != diskCacheMagic {
+		err = errors.New("unknown format")
+	}
+	if err != nil {
+		return nil, c.corrupt(name, err)
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, c.corrupt(name, err)
+	}
+	meta := &diskMeta{}
+	if err := json.Unmarshal(line, meta); err != nil {
+		return nil, c.corrupt(name, err)
+	}
+	if meta.Key != key {
+		return nil, ErrCacheMiss
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the access order across restarts. best effort.
+	now := time.Now()
+	// #nosec G104
+	os.Chtimes(path, now, now)
+
+	return &CacheEntry{
+		Stored:  meta.Stored,
+		Expires: meta.Expires,
+		Header:  meta.Header,
+		Body:    body,
+	}, nil
+}
+
+// Set stores the entry for the key, evicting the least recently used
+// entries as needed. Entries larger than MaxBytes are not stored.
+func (c *DiskCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	name := c.name(key)
+	meta, err := json.Marshal(&diskMeta{
+		Stored:  entry.Stored,
+		Expires: entry.Expires,
+		Header:  entry.Header,
+		Key:     key,
+	})
+	if err != nil {
+		return err
+	}
+	size := int64(len(diskCacheMagic)+len(meta)+1) + int64(len(entry.Body))
+	if size > c.maxBytes {
+		return c.Delete(ctx, key)
+	}
+
+	path := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	// bufio.Writer errors are sticky, so are returned by Flush
+	// #nosec G104
+	w.WriteString(diskCacheMagic)
+	// #nosec G104
+	w.Write(meta)
+	// #nosec G104
+	w.WriteByte('\n')
+	// #nosec G104
+	w.Write(entry.Body)
+	if err := cmp.Or(w.Flush(), f.Close()); err != nil {
+		// #nosec G104
+		os.Remove(f.Name())
+		return err
+	}
+
+	// the file is renamed into place and indexed under the lock, so the
+	// index stays in step with the files for concurrent Sets and Deletes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(f.Name(), path); err != nil {
+		// #nosec G104
+		os.Remove(f.Name())
+		return err
+	}
+	if elem, ok := c.files[name]; ok {
+		c.remove(elem)
+	}
+	c.files[name] = c.lru.PushFront(&diskItem{name: name, size: size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// Delete removes the entry for the key.
+func (c *DiskCache) Delete(ctx context.Context, key string) error {
+	name := c.name(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forget(name)
+	err := os.Remove(c.path(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of entries.
+func (c *DiskCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// forget removes an entry file from the index. The lock must be held.
+func (c *DiskCache) forget(name string) {
+	if elem, ok := c.files[name]; ok {
+		c.remove(elem)
+	}
+}
+
+// corrupt removes an unreadable entry file, and returns an error for it
+func (c *DiskCache) corrupt(name string, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forget(name)
+	// #nosec G104
+	os.Remove(c.path(name))
+	return fmt.Errorf("corrupt cache file %s: %s", name, err)
+}
+
+// evict removes the least recently used entry files until the cache is
+// within MaxBytes. The lock must be held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		item := c.remove(c.lru.Back())
+		// #nosec G104
+		os.Remove(c.path(item.name))
+		if c.collectMetrics {
+			cacheEvictions.WithLabelValues("disk").Inc()
+		}
+	}
+}
+
+// remove removes a list element. The lock must be held.
+func (c *DiskCache) remove(elem *list.Element) *diskItem {
+	item := c.lru.Remove(elem).(*diskItem)
+	delete(c.files, item.name)
+	c.size -= item.size
+	return item
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	now := time.Now().Round(0).UTC()
+
+	c, err := NewDiskCache(DiskCacheConfig{Dir: dir, MaxBytes: 1 << 20})
+	assert.Nil(t, err)
+
+	_, err = c.Get(ctx, "http://example.org/a.png")
+	assert.Equal(t, err, ErrCacheMiss)
+
+	entry := &CacheEntry{
+		Stored:  now,
+		Expires: now.Add(time.Minute),
+		Header:  http.Header{"Content-Type": {"image/png"}, "Etag": {`"a"`}},
+		Body:    []byte("image\ndata"),
+	}
+	assert.Nil(t, c.Set(ctx, "http://example.org/a.png", entry))
+	got, err := c.Get(ctx, "http://example.org/a.png")
+	assert.Nil(t, err)
+	assert.Equal(t, got, entry)
+
+	// entries are kept across restarts, and partial files are removed
+	tmp := filepath.Join(dir, ".tmp-1234")
+	assert.Nil(t, os.WriteFile(tmp, []byte("partial"), 0o600))
+	c, err = NewDiskCache(DiskCacheConfig{Dir: dir, MaxBytes: 1 << 20})
+	assert.Nil(t, err)
+	assert.Equal(t, c.Len(), 1)
+	got, err = c.Get(ctx, "http://example.org/a.png")
+	assert.Nil(t, err)
+	assert.Equal(t, got, entry)
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, c.Delete(ctx, "http://example.org/a.png"))
+	_, err = c.Get(ctx, "http://example.org/a.png")
+	assert.Equal(t, err, ErrCacheMiss)
+	assert.Nil(t, c.Delete(ctx, "http://example.org/a.png"))
+
+	// corrupt files are removed
+	assert.Nil(t, c.Set(ctx, "http://example.org/b.png", entry))
+	name := c.name("http://example.org/b.png")
+	assert.Nil(t, os.WriteFile(c.path(name), []byte("junk"), 0o600))
+	_, err = c.Get(ctx, "http://example.org/b.png")
+	assert.NotNil(t, err)
+	assert.Equal(t, c.Len(), 0)
+	_, err = os.Stat(c.path(name))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	entry := &CacheEntry{Header: http.Header{}, Body: make([]byte, 1000)}
+
+	c, err := NewDiskCache(DiskCacheConfig{Dir: dir, MaxBytes: 3500})
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, c.Set(ctx, key, entry))
+	}
+	// touch a, so b is the least recently used
+	_, err = c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Nil(t, c.Set(ctx, "d", entry))
+	assert.Equal(t, c.Len(), 3)
+	_, err = c.Get(ctx, "b")
+	assert.Equal(t, err, ErrCacheMiss)
+	_, err = os.Stat(c.path(c.name("b")))
+	assert.True(t, os.IsNotExist(err))
+
+	// a smaller limit on restart evicts the least recently used entries,
+	// by file modification time
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(c.path(c.name("c")), old, old))
+	c, err = NewDiskCache(DiskCacheConfig{Dir: dir, MaxBytes: 2500})
+	assert.Nil(t, err)
+	assert.Equal(t, c.Len(), 2)
+	_, err = c.Get(ctx, "c")
+	assert.Equal(t, err, ErrCacheMiss)
+
+	// too large to store
+	assert.Nil(t, c.Set(ctx, "e", &CacheEntry{Body: make([]byte, 3000)}))
+	_, err = c.Get(ctx, "e")
+	assert.Equal(t, err, ErrCacheMiss)
+}
+
+func TestDiskCacheConcurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := NewDiskCache(DiskCacheConfig{Dir: dir, MaxBytes: 5000})
+	assert.Nil(t, err)
+
+	// concurrent Sets (of differing sizes), Deletes, and evictions of the
+	// same keys leave the index in step with the files
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for n := range 50 {
+				key := strconv.Itoa(n % 4)
+				if (i+n)%5 == 0 {
+					assert.Nil(t, c.Delete(ctx, key))
+					continue
+				}
+				entry := &CacheEntry{Header: http.Header{}, Body: make([]byte, 500*(1+i%3))}
+				assert.Nil(t, c.Set(ctx, key, entry))
+			}
+		})
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var size int64
+	files := 0
+	for _, key := range []string{"0", "1", "2", "3"} {
+		name := c.name(key)
+		info, err := os.Stat(c.path(name))
+		_, indexed := c.files[name]
+		assert.Equal(t, indexed, err == nil, key)
+		if err == nil {
+			size += info.Size()
+			files++
+		}
+	}
+	assert.Equal(t, c.size, size)
+	assert.Equal(t, c.lru.Len(), files)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// MemoryCacheConfig holds configuration data used when creating a
+// MemoryCache with NewMemoryCache.
+type MemoryCacheConfig struct {
+	// MaxBytes is the maximum total size of the entries, in bytes.
+	MaxBytes int64
+	// MaxEntries, if non-zero, is the maximum number of entries.
+	MaxEntries int
+	// Whether to call/increment metrics
+	CollectMetrics bool
+}
+
+// A MemoryCache is a Cache that holds entries in memory, bounded by total
+// size and entry count. The least recently used entries are evicted first.
+type MemoryCache struct {
+	entries        map[string]*list.Element
+	lru            *list.List
+	maxBytes       int64
+	size           int64
+	maxEntries     int
+	mu             sync.Mutex
+	collectMetrics bool
+}
+
+// memoryItem is a MemoryCache list item
+type memoryItem struct {
+	entry *CacheEntry
+	key   string
+	size  int64
+}
+
+// NewMemoryCache returns a new MemoryCache.
+func NewMemoryCache(config MemoryCacheConfig) *MemoryCache {
+	return &MemoryCache{
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+		maxBytes:       config.MaxBytes,
+		maxEntries:     config.MaxEntries,
+		collectMetrics: config.CollectMetrics,
+	}
+}
+
+// Get returns the entry for the key, or ErrCacheMiss.
+func (c *MemoryCache) Get(ctx context.Context, key string) (*CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entry, nil
+}
+
+// Set stores the entry for the key, evicting the least recently used
+// entries as needed. Entries larger than MaxBytes are not stored.
+func (c *MemoryCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	size := entry.Size() + int64(len(key))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	if size > c.maxBytes {
+		return nil
+	}
+
+	c.entries[key] = c.lru.PushFront(&memoryItem{entry: entry, key: key, size: size})
+	c.size += size
+	for c.size > c.maxBytes || (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) {
+		c.remove(c.lru.Back())
+		if c.collectMetrics {
+			cacheEvictions.WithLabelValues("memory").Inc()
+		}
+	}
+	return nil
+}
+
+// Delete removes the entry for the key.
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	return nil
+}
+
+// Len returns the number of entries.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove removes a list element. The lock must be held.
+func (c *MemoryCache) remove(elem *list.Element) {
+	item := c.lru.Remove(elem).(*memoryItem)
+	delete(c.entries, item.key)
+	c.size -= item.size
+}
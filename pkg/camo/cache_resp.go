@@ -0,0 +1,555 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRESPCacheTTL is the default time entries are kept in a
+	// RESPCache.
+	DefaultRESPCacheTTL = 24 * time.Hour
+	// DefaultRESPCacheChunkSize is the default size (in bytes) of the body
+	// chunks stored in a RESPCache.
+	DefaultRESPCacheChunkSize = 256 << 10
+	// DefaultRESPCacheKeyPrefix is the default prefix of RESPCache keys.
+	DefaultRESPCacheKeyPrefix = "go-camo:"
+)
+
+// largest bulk string reply read from a RESP server
+const respMaxBulkSize = 512 << 20
+
+// largest array reply read from a RESP server. Entries are limited to this
+// many body chunks, as they are read with a single MGET.
+const respMaxArrayLen = 1 << 16
+
+// RESPCacheConfig holds configuration data used when creating a RESPCache
+// with NewRESPCache.
+type RESPCacheConfig struct {
+	// TLSConfig, if set, is used to connect to the server with TLS.
+	TLSConfig *tls.Config
+	// Addr is the server address, as host:port.
+	Addr string
+	// Username and Password, if set, are sent with AUTH on connect.
+	Username string
+	Password string
+	// KeyPrefix is prepended to every key. Defaults to
+	// DefaultRESPCacheKeyPrefix.
+	KeyPrefix string
+	// DB, if non-zero, is the database selected on connect.
+	DB int
+	// TTL is how long entries are kept on the server, including while
+	// stale. Defaults to DefaultRESPCacheTTL.
+	TTL time.Duration
+	// ChunkSize is the size of the body chunks, in bytes. Defaults to
+	// DefaultRESPCacheChunkSize.
+	ChunkSize int
+	// Timeout for connecting and for each request to the server, when the
+	// context has no deadline. Defaults to 1 second.
+	Timeout time.Duration
+	// MaxIdleConns is the number of idle connections kept. Defaults to 8.
+	MaxIdleConns int
+}
+
+// ParseRESPCacheURL returns a RESPCacheConfig for a server url, in the form
+// redis://[[username]:password@]host[:port][/db]. The rediss scheme
+// connects with TLS.
+func ParseRESPCacheURL(rawURL string) (RESPCacheConfig, error) {
+	config := RESPCacheConfig{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return config, err
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		config.TLSConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+	default:
+		return config, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return config, errors.New("missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	config.Addr = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		config.DB, err = strconv.Atoi(db)
+		if err != nil || config.DB < 0 {
+			return config, fmt.Errorf("invalid database: %q", db)
+		}
+	}
+	return config, nil
+}
+
+// A RESPCache is a Cache that stores entries on a server speaking the Redis
+// protocol (RESP), such as Redis 6.2 or later, or Valkey, so it can be
+// shared by several go-camo instances.
+//
+// Each entry is stored as a metadata key (the headers and times), and the
+// body as a number of chunk keys. Entries expire on the server after the
+// configured TTL, and may also be evicted by the server.
+type RESPCache struct {
+	tlsConfig    *tls.Config
+	addr         string
+	username     string
+	password     string
+	prefix       string
+	idle         []*respConn
+	db           int
+	ttl          time.Duration
+	timeout      time.Duration
+	chunkSize    int
+	maxIdleConns int
+	mu           sync.Mutex
+}
+
+// respMeta is the metadata stored for a RESPCache entry
+type respMeta struct {
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+	Header  http.Header `json:"header"`
+	Key     string      `json:"key"`
+	ID      string      `json:"id"`
+	Size    int         `json:"size"`
+	Chunks  int         `json:"chunks"`
+}
+
+// NewRESPCache returns a new RESPCache. Connections are made as needed.
+func NewRESPCache(config RESPCacheConfig) (*RESPCache, error) {
+	if config.Addr == "" {
+		return nil, errors.New("cache server address required")
+	}
+	c := &RESPCache{
+		tlsConfig:    config.TLSConfig,
+		addr:         config.Addr,
+		username:     config.Username,
+		password:     config.Password,
+		prefix:       config.KeyPrefix,
+		db:           config.DB,
+		ttl:          config.TTL,
+		timeout:      config.Timeout,
+		chunkSize:    config.ChunkSize,
+		maxIdleConns: config.MaxIdleConns,
+	}
+	if c.prefix == "" {
+		c.prefix = DefaultRESPCacheKeyPrefix
+	}
+	if c.ttl <= 0 {
+		c.ttl = DefaultRESPCacheTTL
+	}
+	if c.timeout <= 0 {
+		c.timeout = time.Second
+	}
+	if c.chunkSize <= 0 {
+		c.chunkSize = DefaultRESPCacheChunkSize
+	}
+	if c.maxIdleConns <= 0 {
+		c.maxIdleConns = 8
+	}
+	return c, nil
+}
+
+// Ping checks that the server can be reached.
+func (c *RESPCache) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, []any{"PING"})
+	return err
+}
+
+// Get returns the entry for the key, or ErrCacheMiss. Entries with missing
+// body chunks are treated as a miss.
+func (c *RESPCache) Get(ctx context.Context, key string) (*CacheEntry, error) {
+	name := c.name(key)
+	replies, err := c.do(ctx, []any{"GET", name})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := replies[0].([]byte)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	meta := &respMeta{}
+	err = json.Unmarshal(data, meta)
+	if err == nil && (meta.Size < 0 || meta.Size > respMaxBulkSize || meta.Chunks < 0 || meta.Chunks > respMaxArrayLen) {
+		err = errors.New("invalid size")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("corrupt cache entry %s: %s", name, err)
+	}
+	if meta.Key != key {
+		return nil, ErrCacheMiss
+	}
+
+	body := make([]byte, 0, meta.Size)
+	if meta.Chunks > 0 {
+		mget := []any{"MGET"}
+		for i := range meta.Chunks {
+			mget = append(mget, c.chunkName(name, meta.ID, i))
+		}
+		replies, err = c.do(ctx, mget)
+		if err != nil {
+			return nil, err
+		}
+		chunks, _ := replies[0].([]any)
+		if len(chunks) != meta.Chunks {
+			return nil, errors.New("unexpected MGET reply")
+		}
+		for _, chunk := range chunks {
+			b, ok := chunk.([]byte)
+			if !ok {
+				// expired or evicted by the server
+				return nil, ErrCacheMiss
+			}
+			body = append(body, b...)
+		}
+	}
+	if len(body) != meta.Size {
+		return nil, ErrCacheMiss
+	}
+
+	return &CacheEntry{
+		Stored:  meta.Stored,
+		Expires: meta.Expires,
+		Header:  meta.Header,
+		Body:    body,
+	}, nil
+}
+
+// Set stores the entry for the key. The body chunks are written ahead of
+// the metadata, so a concurrent Get never sees part of an entry.
+func (c *RESPCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	name := c.name(key)
+	meta := &respMeta{
+		Stored:  entry.Stored,
+		Expires: entry.Expires,
+		Header:  entry.Header,
+		Key:     key,
+		ID:      rand.Text(),
+		Size:    len(entry.Body),
+		Chunks:  (len(entry.Body) + c.chunkSize - 1) / c.chunkSize,
+	}
+	if meta.Chunks > respMaxArrayLen {
+		return fmt.Errorf("too many body chunks: %d", meta.Chunks)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	ttl := strconv.FormatInt(c.ttl.Milliseconds(), 10)
+	cmds := make([][]any, 0, meta.Chunks+1)
+	for i := range meta.Chunks {
+		chunk := entry.Body[i*c.chunkSize : min((i+1)*c.chunkSize, len(entry.Body))]
+		cmds = append(cmds, []any{"SET", c.chunkName(name, meta.ID, i), chunk, "PX", ttl})
+	}
+	cmds = append(cmds, []any{"SET", name, data, "PX", ttl, "GET"})
+	replies, err := c.do(ctx, cmds...)
+	if err != nil {
+		return err
+	}
+	// remove the chunks of the replaced entry
+	return c.deleteChunks(ctx, name, replies[len(replies)-1])
+}
+
+// Delete removes the entry for the key.
+func (c *RESPCache) Delete(ctx context.Context, key string) error {
+	name := c.name(key)
+	replies, err := c.do(ctx, []any{"GETDEL", name})
+	if err != nil {
+		return err
+	}
+	return c.deleteChunks(ctx, name, replies[0])
+}
+
+// deleteChunks removes the body chunks of an entry, given its metadata
+// reply
+func (c *RESPCache) deleteChunks(ctx context.Context, name string, reply any) error {
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil
+	}
+	meta := &respMeta{}
+	if err := json.Unmarshal(data, meta); err != nil || meta.Chunks == 0 {
+		// unreadable chunks expire with the ttl
+		return nil
+	}
+	del := []any{"DEL"}
+	for i := range meta.Chunks {
+		del = append(del, c.chunkName(name, meta.ID, i))
+	}
+	_, err := c.do(ctx, del)
+	return err
+}
+
+// name returns the metadata key name for a key
+func (c *RESPCache) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return c.prefix + hex.EncodeToString(sum[:])
+}
+
+// chunkName returns the key name of a body chunk
+func (c *RESPCache) chunkName(name, id string, i int) string {
+	return name + ":" + id + ":" + strconv.Itoa(i)
+}
+
+// do sends the commands to the server as a pipeline, and returns the
+// replies. Returns the first error reply, if any.
+func (c *RESPCache) do(ctx context.Context, cmds ...[]any) ([]any, error) {
+	conn, pooled, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.do(ctx, c.timeout, cmds)
+	if pooled && err != nil && !isRESPError(err) {
+		// the idle connection may have been closed by the server. the
+		// commands are safe to repeat.
+		// #nosec G104
+		conn.Close()
+		conn, err = c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		replies, err = conn.do(ctx, c.timeout, cmds)
+	}
+	c.release(conn, err)
+	return replies, err
+}
+
+// conn returns an idle connection, or a new one. Reports whether the
+// connection was idle.
+func (c *RESPCache) conn(ctx context.Context) (*respConn, bool, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, true, nil
+	}
+	c.mu.Unlock()
+	conn, err := c.dial(ctx)
+	return conn, false, err
+}
+
+// release returns a connection to the idle pool, unless it failed
+func (c *RESPCache) release(conn *respConn, err error) {
+	if err == nil || isRESPError(err) {
+		c.mu.Lock()
+		if len(c.idle) < c.maxIdleConns {
+			c.idle = append(c.idle, conn)
+			conn = nil
+		}
+		c.mu.Unlock()
+	}
+	if conn != nil {
+		// #nosec G104
+		conn.Close()
+	}
+}
+
+// dial connects to the server, and authenticates and selects the database
+// if configured
+func (c *RESPCache) dial(ctx context.Context) (*respConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var nc net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		dialer := &tls.Dialer{Config: c.tlsConfig}
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	} else {
+		dialer := &net.Dialer{}
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	cmds := make([][]any, 0, 2)
+	if c.password != "" {
+		if c.username != "" {
+			cmds = append(cmds, []any{"AUTH", c.username, c.password})
+		} else {
+			cmds = append(cmds, []any{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		cmds = append(cmds, []any{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(cmds) > 0 {
+		if _, err := conn.do(ctx, c.timeout, cmds); err != nil {
+			// #nosec G104
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// respError is an error reply from a RESP server
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// isRESPError reports whether err is an error reply, rather than a
+// connection or protocol error
+func isRESPError(err error) bool {
+	var re respError
+	return errors.As(err, &re)
+}
+
+// respConn is a connection to a RESP server
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do writes the commands, and reads a reply for each
+func (conn *respConn) do(ctx context.Context, timeout time.Duration, cmds [][]any) ([]any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	for _, args := range cmds {
+		conn.writeCommand(args)
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var replyErr error
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		reply, err := conn.readReply()
+		if err != nil && !isRESPError(err) {
+			return nil, err
+		}
+		if err != nil && replyErr == nil {
+			replyErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// writeCommand writes a command, as an array of bulk strings. Write errors
+// are returned by Flush.
+func (conn *respConn) writeCommand(args []any) {
+	// bufio.Writer errors are sticky
+	// #nosec G104
+	fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			// #nosec G104
+			fmt.Fprintf(conn.w, "$%d\r\n", len(arg))
+			// #nosec G104
+			conn.w.Write(arg)
+		case string:
+			// #nosec G104
+			fmt.Fprintf(conn.w, "$%d\r\n", len(arg))
+			// #nosec G104
+			conn.w.WriteString(arg)
+		}
+		// #nosec G104
+		conn.w.WriteString("\r\n")
+	}
+}
+
+// readReply reads a reply. Bulk strings are returned as []byte (nil for a
+// null bulk string), and arrays as []any. Error replies in an array are
+// kept as respError elements, and the first is returned as the error.
+func (conn *respConn) readReply() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("invalid RESP reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > respMaxBulkSize {
+			return nil, fmt.Errorf("invalid RESP bulk length: %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > respMaxArrayLen {
+			return nil, fmt.Errorf("invalid RESP array length: %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// error replies are kept as elements (the first is returned), so
+		// the rest of the array is read, and the connection stays usable
+		var replyErr error
+		replies := make([]any, n)
+		for i := range replies {
+			replies[i], err = conn.readReply()
+			if err != nil && !isRESPError(err) {
+				return nil, err
+			}
+			if err != nil {
+				if replyErr == nil {
+					replyErr = err
+				}
+				replies[i] = err
+			}
+		}
+		return replies, replyErr
+	}
+	return nil, fmt.Errorf("invalid RESP reply type: %q", line[0])
+}
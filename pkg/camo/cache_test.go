@@ -0,0 +1,434 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := func(header map[string]string, lifetime time.Duration, cacheable bool) {
+		t.Helper()
+		h := make(http.Header)
+		for k, v := range header {
+			h.Set(k, v)
+		}
+		gotLifetime, gotCacheable := freshnessLifetime(h, now)
+		assert.Equal(t, gotLifetime, lifetime, fmt.Sprint(header))
+		assert.Equal(t, gotCacheable, cacheable, fmt.Sprint(header))
+	}
+
+	hour := now.Add(time.Hour).Format(http.TimeFormat)
+	lastWeek := now.Add(-7 * 24 * time.Hour).Format(http.TimeFormat)
+
+	f(map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, true)
+	f(map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}, 2*time.Minute, true)
+	f(map[string]string{"Cache-Control": `max-age="60"`}, time.Minute, true)
+	f(map[string]string{"Cache-Control": "max-age=60", "Expires": hour}, time.Minute, true)
+	f(map[string]string{"Cache-Control": "no-store, max-age=60"}, 0, false)
+	f(map[string]string{"Cache-Control": "private, max-age=60"}, 0, false)
+	f(map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}, 0, false)
+	f(map[string]string{"Cache-Control": "no-cache", "Etag": `"x"`}, 0, true)
+	f(map[string]string{"Cache-Control": "no-cache"}, 0, false)
+	f(map[string]string{"Cache-Control": "max-age=0"}, 0, false)
+	f(map[string]string{"Cache-Control": "max-age=0", "Etag": `"x"`}, 0, true)
+	f(map[string]string{"Expires": hour}, time.Hour, true)
+	f(map[string]string{"Expires": hour, "Date": now.Add(-time.Hour).Format(http.TimeFormat)}, 2*time.Hour, true)
+	f(map[string]string{"Expires": "0"}, 0, false)
+	f(map[string]string{"Last-Modified": lastWeek}, 7*24*time.Hour/10, true)
+	f(map[string]string{"Etag": `"x"`}, 0, true)
+	f(map[string]string{}, 0, false)
+}
+
+func TestNotModified(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{
+		"Etag":          {`W/"abc"`},
+		"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"},
+	}
+	f := func(name, value string, expected bool) {
+		t.Helper()
+		reqHeader := http.Header{name: {value}}
+		assert.Equal(t, notModified(reqHeader, h), expected, name+": "+value)
+	}
+
+	f("If-None-Match", `"abc"`, true)
+	f("If-None-Match", `"x", W/"abc"`, true)
+	f("If-None-Match", `*`, true)
+	f("If-None-Match", `"x"`, false)
+	f("If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT", true)
+	f("If-Modified-Since", "Tue, 02 Jan 2024 00:00:00 GMT", true)
+	f("If-Modified-Since", "Sun, 31 Dec 2023 00:00:00 GMT", false)
+	f("If-Modified-Since", "yesterday", false)
+	f("Accept", "image/*", false)
+}
+
+func TestMemoryCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	entry := func(size int) *CacheEntry {
+		return &CacheEntry{Body: make([]byte, size), Header: http.Header{}}
+	}
+
+	// keys are one byte each
+	c := NewMemoryCache(MemoryCacheConfig{MaxBytes: 30, MaxEntries: 3})
+	assert.Nil(t, c.Set(ctx, "a", entry(9)))
+	assert.Nil(t, c.Set(ctx, "b", entry(9)))
+	assert.Nil(t, c.Set(ctx, "c", entry(9)))
+	assert.Equal(t, c.Len(), 3)
+
+	// touch a, so b is the least recently used
+	_, err := c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Nil(t, c.Set(ctx, "d", entry(1)))
+	_, err = c.Get(ctx, "b")
+	assert.Equal(t, err, ErrCacheMiss)
+	assert.Equal(t, c.Len(), 3)
+
+	// evicts by size
+	assert.Nil(t, c.Set(ctx, "e", entry(19)))
+	_, err = c.Get(ctx, "c")
+	assert.Equal(t, err, ErrCacheMiss)
+	_, err = c.Get(ctx, "a")
+	assert.Equal(t, err, ErrCacheMiss)
+	got, err := c.Get(ctx, "e")
+	assert.Nil(t, err)
+	assert.Equal(t, len(got.Body), 19)
+	assert.Equal(t, c.Len(), 2)
+
+	// too large to store, and replaces the existing entry
+	assert.Nil(t, c.Set(ctx, "d", entry(30)))
+	_, err = c.Get(ctx, "d")
+	assert.Equal(t, err, ErrCacheMiss)
+
+	assert.Nil(t, c.Delete(ctx, "e"))
+	assert.Equal(t, c.Len(), 0)
+}
+
+func TestProxyCache(t *testing.T) {
+	t.Parallel()
+
+	var hits, conditional atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/fresh.png":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Etag", `"fresh"`)
+		case "/revalidate.png":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/nostore.png":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("image"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	config := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+		Cache:          NewMemoryCache(MemoryCacheConfig{MaxBytes: 1 << 20}),
+	}
+	camoServer, err := New(config, nil)
+	assert.Nil(t, err)
+
+	get := func(path string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := makeReq(config, ts.URL+path)
+		assert.Nil(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		return record.Result()
+	}
+
+	resp := get("/fresh.png", nil)
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "image", resp)
+	resp = get("/fresh.png", nil)
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "image", resp)
+	headerAssert(t, "image/png", "Content-Type", resp)
+	headerAssert(t, `"fresh"`, "Etag", resp)
+	headerAssert(t, "5", "Content-Length", resp)
+	assert.Equal(t, hits.Load(), int32(1))
+
+	// conditional requests are answered from the cache
+	resp = get("/fresh.png", http.Header{"If-None-Match": {`"fresh"`}})
+	statusCodeAssert(t, 304, resp)
+	resp = get("/fresh.png", http.Header{"If-None-Match": {`"stale"`}})
+	statusCodeAssert(t, 200, resp)
+	assert.Equal(t, hits.Load(), int32(1))
+
+	// range requests are passed through
+	resp = get("/fresh.png", http.Header{"Range": {"bytes=0-1"}})
+	statusCodeAssert(t, 200, resp)
+	assert.Equal(t, hits.Load(), int32(2))
+
+	// stale entries are revalidated
+	hits.Store(0)
+	resp = get("/revalidate.png", nil)
+	statusCodeAssert(t, 200, resp)
+	resp = get("/revalidate.png", nil)
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "image", resp)
+	assert.Equal(t, hits.Load(), int32(2))
+	assert.Equal(t, conditional.Load(), int32(1))
+
+	hits.Store(0)
+	resp = get("/nostore.png", nil)
+	statusCodeAssert(t, 200, resp)
+	resp = get("/nostore.png", nil)
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "image", resp)
+	assert.Equal(t, hits.Load(), int32(2))
+
+	// uncacheable content types are not cached
+	hits.Store(0)
+	resp = get("/page.html", nil)
+	statusCodeAssert(t, 200, resp)
+	assert.Equal(t, hits.Load(), int32(1))
+}
+
+func TestProxyCacheCoalesce(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte(strings.Repeat("x", 1024)))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	config := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+		Cache:          NewMemoryCache(MemoryCacheConfig{MaxBytes: 1 << 20}),
+	}
+	camoServer, err := New(config, nil)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			req, err := makeReq(config, ts.URL+"/image.png")
+			assert.Nil(t, err)
+			record := httptest.NewRecorder()
+			camoServer.ServeHTTP(record, req)
+			assert.Equal(t, record.Code, 200)
+			assert.Equal(t, record.Body.Len(), 1024)
+		})
+	}
+
+	// give the requests time to start, and wait on the first
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, hits.Load(), int32(1))
+}
+
+func TestTieredCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mem := NewMemoryCache(MemoryCacheConfig{MaxBytes: 1 << 20})
+	disk, err := NewDiskCache(DiskCacheConfig{Dir: t.TempDir(), MaxBytes: 1 << 20})
+	assert.Nil(t, err)
+	c := NewTieredCache(mem, disk)
+
+	entry := &CacheEntry{Header: http.Header{}, Body: []byte("image")}
+	assert.Nil(t, c.Set(ctx, "a", entry))
+	assert.Equal(t, mem.Len(), 1)
+	assert.Equal(t, disk.Len(), 1)
+
+	// found in the later tier, and added to the earlier one
+	assert.Nil(t, mem.Delete(ctx, "a"))
+	got, err := c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, got.Body, entry.Body)
+	assert.Equal(t, mem.Len(), 1)
+
+	assert.Nil(t, c.Delete(ctx, "a"))
+	_, err = c.Get(ctx, "a")
+	assert.Equal(t, err, ErrCacheMiss)
+}
+
+func TestStaleWindow(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	f := func(cacheControl string, directive string, limit, expected time.Duration) {
+		t.Helper()
+		e := &CacheEntry{
+			Stored:  now.Add(-2 * time.Minute),
+			Expires: now.Add(-time.Minute),
+			Header:  http.Header{"Cache-Control": {cacheControl}},
+		}
+		assert.Equal(t, e.staleWindow(directive, limit), expected, cacheControl)
+	}
+
+	f("max-age=60", "stale-if-error", time.Hour, time.Hour)
+	f("max-age=60", "stale-if-error", 0, 0)
+	f("max-age=60, stale-if-error=30", "stale-if-error", time.Hour, 30*time.Second)
+	f("max-age=60, stale-if-error=7200", "stale-if-error", time.Hour, time.Hour)
+	f("max-age=60, stale-if-error=0", "stale-if-error", time.Hour, 0)
+	f("max-age=60, stale-while-revalidate=30", "stale-if-error", time.Hour, time.Hour)
+	f("max-age=60, stale-while-revalidate=30", "stale-while-revalidate", time.Hour, 30*time.Second)
+	f("max-age=60, must-revalidate", "stale-if-error", time.Hour, 0)
+	f("max-age=60, proxy-revalidate", "stale-while-revalidate", time.Hour, 0)
+	f("no-cache", "stale-if-error", time.Hour, 0)
+
+	// entries with a zero lifetime are always revalidated
+	e := &CacheEntry{Stored: now, Expires: now, Header: http.Header{}}
+	assert.Equal(t, e.staleWindow("stale-if-error", time.Hour), time.Duration(0))
+}
+
+func TestProxyCacheStale(t *testing.T) {
+	t.Parallel()
+
+	var failing atomic.Bool
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Warning", `199 - "upstream warning"`)
+		_, err := w.Write([]byte("fresh"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+	// an upstream that is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cache := NewMemoryCache(MemoryCacheConfig{MaxBytes: 1 << 20})
+	config := Config{
+		HMACKey:                   []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout:            time.Duration(10) * time.Second,
+		MaxRedirects:              3,
+		ServerName:                "go-camo",
+		noIPFiltering:             true,
+		Cache:                     cache,
+		CacheStaleWhileRevalidate: time.Minute,
+		CacheStaleIfError:         time.Hour,
+	}
+	camoServer, err := New(config, nil)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	setStale := func(url string, expired time.Duration, cacheControl string) {
+		t.Helper()
+		now := time.Now()
+		assert.Nil(t, cache.Set(ctx, url, &CacheEntry{
+			Stored:  now.Add(-expired - time.Minute),
+			Expires: now.Add(-expired),
+			Header:  http.Header{"Content-Type": {"image/png"}, "Cache-Control": {cacheControl}},
+			Body:    []byte("stale"),
+		}))
+	}
+	get := func(url string) *http.Response {
+		t.Helper()
+		req, err := makeReq(config, url)
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		return record.Result()
+	}
+
+	// served stale while revalidated in the background
+	setStale(ts.URL+"/swr.png", 10*time.Second, "max-age=60")
+	resp := get(ts.URL + "/swr.png")
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "stale", resp)
+	headerAssert(t, `110 - "Response is Stale"`, "Warning", resp)
+	for range 100 {
+		entry, err := cache.Get(ctx, ts.URL+"/swr.png")
+		if err == nil && entry.Fresh(time.Now()) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// upstream Warning headers are not passed on, or cached
+	resp = get(ts.URL + "/swr.png")
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "fresh", resp)
+	headerAssert(t, "", "Warning", resp)
+	assert.Equal(t, hits.Load(), int32(1))
+	entry, err := cache.Get(ctx, ts.URL+"/swr.png")
+	assert.Nil(t, err)
+	assert.Equal(t, entry.Header.Get("Warning"), "")
+	resp = get(ts.URL + "/miss.png")
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "fresh", resp)
+	headerAssert(t, "", "Warning", resp)
+
+	// past the stale-while-revalidate window, but served on upstream errors
+	failing.Store(true)
+	setStale(ts.URL+"/sie.png", 10*time.Minute, "max-age=60")
+	resp = get(ts.URL + "/sie.png")
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "stale", resp)
+	headerAssert(t, `111 - "Revalidation Failed"`, "Warning", resp)
+
+	setStale(down.URL+"/sie.png", 10*time.Minute, "max-age=60")
+	resp = get(down.URL + "/sie.png")
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "stale", resp)
+
+	// past the stale-if-error window
+	setStale(ts.URL+"/expired.png", 2*time.Hour, "max-age=60")
+	resp = get(ts.URL + "/expired.png")
+	statusCodeAssert(t, 502, resp)
+
+	// shortened by the upstream directive
+	setStale(ts.URL+"/directive.png", 10*time.Minute, "max-age=60, stale-if-error=60")
+	resp = get(ts.URL + "/directive.png")
+	statusCodeAssert(t, 502, resp)
+
+	// not served stale if upstream forbids it
+	setStale(ts.URL+"/revalidate.png", 10*time.Second, "max-age=60, must-revalidate")
+	resp = get(ts.URL + "/revalidate.png")
+	statusCodeAssert(t, 502, resp)
+}
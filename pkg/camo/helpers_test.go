@@ -37,9 +37,11 @@ func processRequest(req *http.Request, status int, camoConfig Config, filters []
 	}
 
 	router := &router.DumbRouter{
-		AddHeaders:  map[string]string{"X-Go-Camo": "test"},
-		ServerName:  camoConfig.ServerName,
-		CamoHandler: camoServer,
+		AddHeaders:       map[string]string{"X-Go-Camo": "test"},
+		ServerName:       camoConfig.ServerName,
+		CamoHandler:      camoServer,
+		AllowQueryFormat: camoConfig.AllowQueryFormat,
+		AllowTokenFormat: camoConfig.AllowTokenFormat,
 	}
 
 	record := httptest.NewRecorder()
@@ -7,6 +7,10 @@
 package camo
 
 import (
+	"strconv"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -42,4 +46,117 @@ var (
 			Help:      "The number of responess that were too large to send.",
 		},
 	)
+	signatureVerified = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "signature_verified_total",
+			Help:      "The number of requests with a verified url signature, by verifying key.",
+		},
+		[]string{"key"},
+	)
+	validityRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "validity_rejected_total",
+			Help:      "The number of requests rejected for being outside of the signed url validity period.",
+		},
+		[]string{"reason"},
+	)
+	cacheHits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "cache_hits_total",
+			Help:      "The number of requests served from the response cache, without an upstream request.",
+		},
+	)
+	cacheMisses = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "cache_misses_total",
+			Help:      "The number of requests not in the response cache (or stale), that made an upstream request.",
+		},
+	)
+	cacheCoalesced = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "cache_coalesced_total",
+			Help:      "The number of cache misses that waited for a concurrent upstream request for the same url.",
+		},
+	)
+	cacheRevalidations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "cache_revalidations_total",
+			Help:      "The number of stale cache entries revalidated upstream, by result.",
+		},
+		[]string{"result"},
+	)
+	cacheStale = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "cache_stale_total",
+			Help:      "The number of stale cached responses served, by reason.",
+		},
+		[]string{"reason"},
+	)
+	cacheEvictions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "cache_evictions_total",
+			Help:      "The number of entries evicted from the response cache to make room, by cache.",
+		},
+		[]string{"cache"},
+	)
+	negativeCacheHits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "negative_cache_hits_total",
+			Help:      "The number of requests failed from the negative cache, without an upstream request, by class.",
+		},
+		[]string{"class"},
+	)
+	negativeCacheStores = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "negative_cache_stores_total",
+			Help:      "The number of upstream failures added to the negative cache, by class.",
+		},
+		[]string{"class"},
+	)
+	peerForwards = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "peer_forwards_total",
+			Help:      "The number of requests forwarded to the peer that owns the url, by result.",
+		},
+		[]string{"result"},
+	)
+	peerRequests = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "peer_requests_total",
+			Help:      "The number of requests forwarded from peers, for urls this instance owns.",
+		},
+	)
 )
+
+// keyLabel returns the metrics label for the key that verified a url.
+// Keys without an id are labeled by keyring position (eg. "#0").
+func keyLabel(info *encoding.URLInfo) string {
+	if info.KeyID != "" {
+		return info.KeyID
+	}
+	return "#" + strconv.Itoa(info.KeyIndex)
+}
@@ -67,7 +67,9 @@ func mustParseNetmasks(networks []string) []*net.IPNet {
 	return nets
 }
 
-func isRejectedIP(ip net.IP) bool {
+// IsRejectedIP reports whether the ip is one that go-camo refuses to connect
+// to (non global unicast, private, and other reserved addresses).
+func IsRejectedIP(ip net.IP) bool {
 	if !ip.IsGlobalUnicast() {
 		return true
 	}
@@ -90,6 +92,13 @@ func isRejectedIP(ip net.IP) bool {
 	return false
 }
 
+// IsLocalHostname reports whether the hostname is a local one (localhost,
+// localdomain) that go-camo rejects. The hostname must already be cleaned
+// with htrie.CleanHostname.
+func IsLocalHostname(cleanHostname string) bool {
+	return localsFilter.CheckCleanHostname(cleanHostname)
+}
+
 func containsOneOf(s string, substrs ...string) bool {
 	for i := range substrs {
 		if strings.Contains(s, substrs[i]) {
@@ -0,0 +1,251 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/dropwhile/mlog"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+// DefaultNegativeCacheEntries is the default maximum number of entries in
+// each of the NegativeCache url and host caches.
+const DefaultNegativeCacheEntries = 10000
+
+// NegativeCache failure classes
+const (
+	// NegativeNotFound is an upstream 4xx (or other unsupported) response
+	NegativeNotFound = "not_found"
+	// NegativeUpstreamError is an upstream 5xx response
+	NegativeUpstreamError = "upstream_error"
+	// NegativeContentType is an upstream response with a rejected content type
+	NegativeContentType = "content_type"
+	// NegativeRedirect is a rejected upstream redirect
+	NegativeRedirect = "redirect"
+	// NegativeRejected is a connection rejected by ip/network filtering
+	NegativeRejected = "rejected"
+	// NegativeConnect is an upstream connection error
+	NegativeConnect = "connect"
+	// NegativeTimeout is an upstream timeout
+	NegativeTimeout = "timeout"
+)
+
+// NegativeClasses are the NegativeCache failure classes.
+var NegativeClasses = []string{
+	NegativeNotFound,
+	NegativeUpstreamError,
+	NegativeContentType,
+	NegativeRedirect,
+	NegativeRejected,
+	NegativeConnect,
+	NegativeTimeout,
+}
+
+// NegativeCacheConfig holds configuration data used when creating a
+// NegativeCache with NewNegativeCache.
+type NegativeCacheConfig struct {
+	// ClassTTL overrides TTL by failure class (see NegativeClasses). A zero
+	// ttl disables caching for the class.
+	ClassTTL map[string]time.Duration
+	// TTL is how long failures are cached, for classes not in ClassTTL.
+	TTL time.Duration
+	// MaxEntries is the maximum number of entries in each of the url and
+	// host caches. Defaults to DefaultNegativeCacheEntries.
+	MaxEntries int
+}
+
+// A NegativeCache holds recent upstream failures, so repeat requests for a
+// failing url fail without an upstream request. Connection failures (and
+// ip filtering rejections) are kept by host, so requests for any url on a
+// failing host fail too. The least recently used entries are evicted first.
+type NegativeCache struct {
+	ttl   map[string]time.Duration
+	urls  *negativeLRU
+	hosts *negativeLRU
+}
+
+// negativeEntry is a cached failure, with the response sent to the client.
+type negativeEntry struct {
+	expires time.Time
+	class   string
+	message string
+	status  int
+	// classes are the content classes of a content type rejection
+	classes encoding.ContentClass
+}
+
+// NewNegativeCache returns a new NegativeCache.
+func NewNegativeCache(config NegativeCacheConfig) *NegativeCache {
+	maxEntries := config.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultNegativeCacheEntries
+	}
+
+	ttl := make(map[string]time.Duration, len(NegativeClasses))
+	for _, class := range NegativeClasses {
+		ttl[class] = config.TTL
+		if v, ok := config.ClassTTL[class]; ok {
+			ttl[class] = v
+		}
+	}
+
+	return &NegativeCache{
+		ttl:   ttl,
+		urls:  newNegativeLRU(maxEntries),
+		hosts: newNegativeLRU(maxEntries),
+	}
+}
+
+// Len returns the number of entries, in the url and host caches.
+func (c *NegativeCache) Len() int {
+	return c.urls.len() + c.hosts.len()
+}
+
+// lookup returns the cached failure for an origin url (or its host), or
+// nil if there is none that applies to a request with the options.
+func (c *NegativeCache) lookup(sURL string, host string, opts *requestOptions, now time.Time) *negativeEntry {
+	if entry := c.hosts.get(strings.ToLower(host), now); entry != nil {
+		return entry
+	}
+	entry := c.urls.get(sURL, now)
+	// a content type rejection only applies to requests accepting (a subset
+	// of) the same content classes
+	if entry != nil && entry.class == NegativeContentType && opts.classes&^entry.classes != 0 {
+		return nil
+	}
+	return entry
+}
+
+// add stores a failure for the key, if the class ttl is non-zero. Returns
+// whether the failure was stored.
+func (c *NegativeCache) add(key string, host bool, entry negativeEntry, now time.Time) bool {
+	ttl := c.ttl[entry.class]
+	if ttl <= 0 {
+		return false
+	}
+	entry.expires = now.Add(ttl)
+	if host {
+		c.hosts.add(strings.ToLower(key), &entry)
+	} else {
+		c.urls.add(key, &entry)
+	}
+	return true
+}
+
+// negativeError responds with an error, and adds it to the negative cache
+// (if any) for the key. Host keys are used for failures of the whole host.
+func (p *Proxy) negativeError(w http.ResponseWriter, key string, host bool, entry negativeEntry) {
+	if p.negative != nil && p.negative.add(key, host, entry, time.Now()) {
+		if p.config.CollectMetrics {
+			negativeCacheStores.WithLabelValues(entry.class).Inc()
+		}
+		if mlog.HasDebug() {
+			mlog.Debugx("negative cache store", mlog.A("key", key), mlog.A("class", entry.class))
+		}
+	}
+	http.Error(w, entry.message, entry.status)
+}
+
+// negativeErrorHost returns the host of the upstream url that failed, if
+// err is a connection failure or ip filtering rejection that applies to
+// the whole host. Returns an empty string otherwise.
+func negativeErrorHost(err error) string {
+	var uerr *url.Error
+	if !errors.As(err, &uerr) {
+		return ""
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrRejectIP), errors.Is(err, ErrInvalidHostPort), errors.Is(err, ErrInvalidNetType):
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+	case errors.As(err, &dnsErr):
+	default:
+		return ""
+	}
+
+	// the url is that of the request that failed, which may be a redirect
+	u, perr := url.Parse(uerr.URL)
+	if perr != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// negativeLRU is a size bounded map of negativeEntry, that evicts the least
+// recently used entries first.
+type negativeLRU struct {
+	entries    map[string]*list.Element
+	lru        *list.List
+	maxEntries int
+	mu         sync.Mutex
+}
+
+// negativeItem is a negativeLRU list item
+type negativeItem struct {
+	entry *negativeEntry
+	key   string
+}
+
+func newNegativeLRU(maxEntries int) *negativeLRU {
+	return &negativeLRU{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+// get returns the entry for the key, or nil if there is none or it has
+// expired.
+func (c *negativeLRU) get(key string, now time.Time) *negativeEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*negativeItem)
+	if !now.Before(item.entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return item.entry
+}
+
+// add stores the entry for the key, evicting the least recently used entry
+// if full.
+func (c *negativeLRU) add(key string, entry *negativeEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&negativeItem{entry: entry, key: key})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *negativeLRU) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove removes a list element. The lock must be held.
+func (c *negativeLRU) remove(elem *list.Element) {
+	item := c.lru.Remove(elem).(*negativeItem)
+	delete(c.entries, item.key)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+func TestNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	c := NewNegativeCache(NegativeCacheConfig{
+		TTL:        time.Minute,
+		ClassTTL:   map[string]time.Duration{NegativeUpstreamError: time.Second, NegativeRedirect: 0},
+		MaxEntries: 2,
+	})
+	now := time.Now()
+	image := &requestOptions{classes: encoding.ContentImage}
+
+	// per class ttls, with zero disabling the class
+	assert.True(t, c.add("http://a/1.png", false, negativeEntry{class: NegativeNotFound, status: 404}, now))
+	assert.True(t, c.add("http://a/2.png", false, negativeEntry{class: NegativeUpstreamError, status: 502}, now))
+	assert.False(t, c.add("http://a/3.png", false, negativeEntry{class: NegativeRedirect, status: 404}, now))
+	assert.Equal(t, c.lookup("http://a/1.png", "a", image, now).status, 404)
+	assert.Equal(t, c.lookup("http://a/2.png", "a", image, now).status, 502)
+	assert.Nil(t, c.lookup("http://a/3.png", "a", image, now))
+	assert.NotNil(t, c.lookup("http://a/1.png", "a", image, now.Add(30*time.Second)))
+	assert.Nil(t, c.lookup("http://a/2.png", "a", image, now.Add(30*time.Second)))
+	assert.Nil(t, c.lookup("http://a/1.png", "a", image, now.Add(time.Minute)))
+
+	// host entries apply to every url on the host
+	assert.True(t, c.add("B:8080", true, negativeEntry{class: NegativeConnect, status: 404}, now))
+	assert.Equal(t, c.lookup("http://b:8080/1.png", "b:8080", image, now).class, NegativeConnect)
+	assert.Nil(t, c.lookup("http://b/1.png", "b", image, now))
+
+	// content type rejections apply to requests accepting the same (or
+	// fewer) content classes
+	c.add("http://c/1.mp4", false, negativeEntry{class: NegativeContentType, status: 400, classes: encoding.ContentImage | encoding.ContentAudio}, now)
+	assert.NotNil(t, c.lookup("http://c/1.mp4", "c", image, now))
+	assert.Nil(t, c.lookup("http://c/1.mp4", "c", &requestOptions{classes: encoding.ContentImage | encoding.ContentVideo}, now))
+
+	// the least recently used entries are evicted
+	c.add("http://d/1.png", false, negativeEntry{class: NegativeNotFound, status: 404}, now)
+	c.add("http://d/2.png", false, negativeEntry{class: NegativeNotFound, status: 404}, now)
+	assert.NotNil(t, c.lookup("http://d/1.png", "d", image, now))
+	c.add("http://d/3.png", false, negativeEntry{class: NegativeNotFound, status: 404}, now)
+	assert.NotNil(t, c.lookup("http://d/1.png", "d", image, now))
+	assert.Nil(t, c.lookup("http://d/2.png", "d", image, now))
+	assert.Equal(t, c.Len(), 3)
+}
+
+func TestNegativeErrorHost(t *testing.T) {
+	t.Parallel()
+
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://Example.com:8080/a.png", Err: err}
+	}
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	assert.Equal(t, negativeErrorHost(wrap(dial)), "Example.com:8080")
+	assert.Equal(t, negativeErrorHost(wrap(&net.DNSError{Err: "no such host", IsNotFound: true})), "Example.com:8080")
+	assert.Equal(t, negativeErrorHost(wrap(fmt.Errorf("dial: %w", ErrRejectIP))), "Example.com:8080")
+	assert.Equal(t, negativeErrorHost(wrap(read)), "")
+	assert.Equal(t, negativeErrorHost(wrap(fmt.Errorf("Bad redirect: %w", ErrRedirect))), "")
+	assert.Equal(t, negativeErrorHost(dial), "")
+}
+
+func TestProxyNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/missing.png":
+			http.NotFound(w, r)
+		case "/error.png":
+			http.Error(w, "error", http.StatusServiceUnavailable)
+		case "/range.png":
+			http.Error(w, "range", http.StatusRequestedRangeNotSatisfiable)
+		case "/page.png":
+			w.Header().Set("Content-Type", "text/html")
+			_, err := w.Write([]byte("<html></html>"))
+			assert.Nil(t, err)
+		case "/video.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			_, err := w.Write([]byte("video"))
+			assert.Nil(t, err)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			_, err := w.Write([]byte("image"))
+			assert.Nil(t, err)
+		}
+	}))
+	defer ts.Close()
+
+	// a host that is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	negative := NewNegativeCache(NegativeCacheConfig{
+		TTL:      time.Minute,
+		ClassTTL: map[string]time.Duration{NegativeUpstreamError: 0},
+	})
+	config := Config{
+		HMACKey:                 []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout:          time.Duration(10) * time.Second,
+		MaxRedirects:            3,
+		ServerName:              "go-camo",
+		AllowSignedContentVideo: true,
+		NegativeCache:           negative,
+		noIPFiltering:           true,
+	}
+	camoServer, err := New(config, nil)
+	assert.Nil(t, err)
+
+	get := func(testURL string, opts encoding.SignOptions) *http.Response {
+		t.Helper()
+		encURL, err := encoding.B64EncodeURLWithOptions(config.HMACKey, testURL, opts)
+		assert.Nil(t, err)
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		return record.Result()
+	}
+	hitCount := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+
+	f := func(path string, opts encoding.SignOptions, status int, count int) {
+		t.Helper()
+		for range 3 {
+			resp := get(ts.URL+path, opts)
+			statusCodeAssert(t, status, resp)
+		}
+		assert.Equal(t, hitCount(path), count, path)
+	}
+
+	// failures are cached by url, unless the class is disabled, or the
+	// failure depends on the request headers
+	f("/missing.png", encoding.SignOptions{}, 404, 1)
+	f("/error.png", encoding.SignOptions{}, 502, 3)
+	f("/range.png", encoding.SignOptions{}, 404, 3)
+	f("/page.png", encoding.SignOptions{}, 400, 1)
+	f("/image.png", encoding.SignOptions{}, 200, 3)
+
+	// content type rejections are only cached for the same content classes
+	f("/video.mp4", encoding.SignOptions{}, 400, 1)
+	resp := get(ts.URL+"/video.mp4", encoding.SignOptions{ContentClasses: encoding.ContentImage | encoding.ContentVideo})
+	statusCodeAssert(t, 200, resp)
+	bodyAssert(t, "video", resp)
+	assert.Equal(t, hitCount("/video.mp4"), 2)
+
+	// connection failures are cached by host
+	before := negative.Len()
+	for n := range 3 {
+		resp := get(down.URL+"/"+strconv.Itoa(n)+".png", encoding.SignOptions{})
+		statusCodeAssert(t, 404, resp)
+	}
+	assert.Equal(t, negative.Len(), before+1)
+	u, err := url.Parse(down.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, negative.hosts.get(u.Host, time.Now()).class, NegativeConnect)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"strings"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/htrie"
+)
+
+// acceptTypes holds the allowed response content types for a set of
+// content classes.
+type acceptTypes struct {
+	filter *htrie.GlobPathChecker
+	header string
+}
+
+func newAcceptTypes(classes encoding.ContentClass) (*acceptTypes, error) {
+	types := make([]string, 0, 4)
+	if classes.Has(encoding.ContentImage) {
+		types = append(types, "image/*", "image/svg+xml")
+	}
+	if classes.Has(encoding.ContentVideo) {
+		types = append(types, "video/*")
+	}
+	if classes.Has(encoding.ContentAudio) {
+		types = append(types, "audio/*")
+	}
+
+	// re-use the htrie glob path checker for accept types validation
+	filter := htrie.NewGlobPathChecker()
+	for _, v := range types {
+		err := filter.AddRule("|i|" + v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &acceptTypes{filter: filter, header: strings.Join(types, ", ")}, nil
+}
+
+// requestOptions holds the options for a single request, after merging
+// any signed url options with the configured defaults and ceilings.
+type requestOptions struct {
+	accept  *acceptTypes
+	maxSize int64
+	classes encoding.ContentClass
+}
+
+// requestOptions returns the options for a verified url. Returns
+// ErrSignedOptions if the signed content classes are all outside of those
+// allowed.
+//
+// Signed content classes replace the default classes, but are limited to
+// those allowed by the config (AllowContent* or AllowSignedContent*).
+// A signed max size replaces the default MaxSize, but is limited to
+// MaxSignedSize (or MaxSize, if MaxSignedSize is not set).
+func (p *Proxy) requestOptions(info *encoding.URLInfo) (*requestOptions, error) {
+	classes := p.contentClasses
+	if info.ContentClasses != 0 {
+		classes = info.ContentClasses & p.maxContentClasses
+		if classes == 0 {
+			return nil, ErrSignedOptions
+		}
+	}
+
+	maxSize := p.config.MaxSize
+	if info.MaxSize > 0 {
+		ceiling := p.config.MaxSignedSize
+		if ceiling == 0 {
+			ceiling = p.config.MaxSize
+		}
+		maxSize = info.MaxSize
+		if ceiling > 0 && maxSize > ceiling {
+			maxSize = ceiling
+		}
+	}
+
+	return &requestOptions{accept: p.acceptTypes[classes], maxSize: maxSize, classes: classes}, nil
+}
@@ -0,0 +1,468 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+
+	"codeberg.org/dropwhile/mlog"
+)
+
+// DefaultPeerPath is the path of the internal endpoint (Proxy.ServePeer)
+// that peers forward requests to.
+const DefaultPeerPath = "/_camo/peer"
+
+// DefaultPeerReplicas is the default number of points each peer has on the
+// consistent hash ring.
+const DefaultPeerReplicas = 64
+
+const (
+	// peer request authentication headers
+	peerTimeHeader      = "X-Camo-Peer-Time"
+	peerSignatureHeader = "X-Camo-Peer-Signature"
+	// the names of the forwarded request headers covered by the signature
+	peerHeadersHeader = "X-Camo-Peer-Headers"
+	// set on every response from Proxy.ServePeer, with the peer url
+	peerHeader = "X-Camo-Peer"
+	// set on peer responses for upstream errors, with the error kind
+	peerErrorHeader = "X-Camo-Peer-Error"
+	// the peer error kind of requests refused for a bad signature
+	peerRefused = "refused"
+	// how far a peer request time may be from now
+	peerMaxSkew = time.Minute
+)
+
+// errPeerUnavailable is returned when a request could not be forwarded to
+// its owner, so it should be fetched locally instead.
+var errPeerUnavailable = errors.New("peer unavailable")
+
+// PeerPoolConfig holds configuration data used when creating a PeerPool
+// with NewPeerPool.
+type PeerPoolConfig struct {
+	// Self is the url of this instance, as the other peers know it
+	// (eg. http://10.0.0.1:8080).
+	Self string
+	// Peers are the urls of the other instances. Self is added if missing.
+	Peers []string
+	// Key is the secret shared by the peers, that authenticates forwarded
+	// requests.
+	Key []byte
+	// Replicas is the number of points each peer has on the consistent
+	// hash ring. Defaults to DefaultPeerReplicas.
+	Replicas int
+	// Timeout for connecting to a peer and receiving the response headers.
+	// Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// A PeerPool is a group of go-camo instances that share upstream fetches.
+// Each origin url is owned by one peer, chosen by consistent hashing, and
+// the other peers forward requests for it to the owner. Each origin url is
+// then fetched (and cached) once per pool, rather than once per instance.
+//
+// Every peer must be configured with the same Key, and the same peer urls.
+type PeerPool struct {
+	client   *http.Client
+	owners   map[uint64]string
+	self     string
+	ring     []uint64
+	peers    []string
+	key      []byte
+	replicas int
+	mu       sync.RWMutex
+}
+
+// NewPeerPool returns a new PeerPool.
+func NewPeerPool(config PeerPoolConfig) (*PeerPool, error) {
+	if len(config.Key) == 0 {
+		return nil, errors.New("peer key required")
+	}
+	self, err := normalizePeer(config.Self)
+	if err != nil {
+		return nil, fmt.Errorf("invalid self peer url: %s", err)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: min(timeout, 3*time.Second), KeepAlive: 30 * time.Second}
+	pp := &PeerPool{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				MaxIdleConnsPerHost:   16,
+				IdleConnTimeout:       30 * time.Second,
+				TLSHandshakeTimeout:   3 * time.Second,
+				ResponseHeaderTimeout: timeout,
+				DisableCompression:    true,
+			},
+			// redirects are returned to the forwarding peer as is
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		self:     self,
+		key:      config.Key,
+		replicas: config.Replicas,
+	}
+	if pp.replicas <= 0 {
+		pp.replicas = DefaultPeerReplicas
+	}
+	if err := pp.Set(config.Peers); err != nil {
+		return nil, err
+	}
+	return pp, nil
+}
+
+// normalizePeer returns a peer url without a trailing slash. Returns an error
+// if the url is not an http or https url.
+func normalizePeer(peer string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(peer))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid peer url: %q", peer)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// peerHash returns the ring position of a string
+func peerHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Set replaces the peers (eg. when the peer list changes). Self is always a
+// member. Only the origin urls owned by added or removed peers move.
+func (pp *PeerPool) Set(peers []string) error {
+	members := []string{pp.self}
+	for _, peer := range peers {
+		peer, err := normalizePeer(peer)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(members, peer) {
+			members = append(members, peer)
+		}
+	}
+	slices.Sort(members)
+
+	owners := make(map[uint64]string, len(members)*pp.replicas)
+	ring := make([]uint64, 0, len(members)*pp.replicas)
+	for _, peer := range members {
+		for i := range pp.replicas {
+			h := peerHash(strconv.Itoa(i) + " " + peer)
+			if _, ok := owners[h]; ok {
+				continue
+			}
+			owners[h] = peer
+			ring = append(ring, h)
+		}
+	}
+	slices.Sort(ring)
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.owners = owners
+	pp.ring = ring
+	pp.peers = members
+	return nil
+}
+
+// Peers returns the peer urls, including self.
+func (pp *PeerPool) Peers() []string {
+	pp.mu.RLock()
+	defer pp.mu.RUnlock()
+	return slices.Clone(pp.peers)
+}
+
+// Owner returns the url of the peer that owns an origin url.
+func (pp *PeerPool) Owner(key string) string {
+	h := peerHash(key)
+	pp.mu.RLock()
+	defer pp.mu.RUnlock()
+	i, _ := slices.BinarySearch(pp.ring, h)
+	if i == len(pp.ring) {
+		i = 0
+	}
+	return pp.owners[pp.ring[i]]
+}
+
+// sign returns the signature of a peer request. The signature covers the
+// forwarded request headers named in the peer headers header, so they can
+// not be changed.
+func (pp *PeerPool) sign(method, timestamp, query string, header http.Header) string {
+	mac := hmac.New(sha256.New, pp.key)
+	mac.Write([]byte(method + "\n" + timestamp + "\n" + query + "\n"))
+	mac.Write([]byte(header.Get(peerHeadersHeader) + "\n"))
+	for _, name := range peerSignedHeaders(header) {
+		mac.Write([]byte(name + ":" + strings.Join(header.Values(name), "\n") + "\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether a peer request is signed with the pool key, at a
+// time close to now
+func (pp *PeerPool) verify(req *http.Request, now time.Time) bool {
+	timestamp := req.Header.Get(peerTimeHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > peerMaxSkew || skew < -peerMaxSkew {
+		return false
+	}
+	signature, err := hex.DecodeString(req.Header.Get(peerSignatureHeader))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(pp.sign(req.Method, timestamp, req.URL.RawQuery, req.Header))
+	return hmac.Equal(signature, expected)
+}
+
+// peerSignedHeaders returns the names of the forwarded request headers
+// covered by the signature of a peer request
+func peerSignedHeaders(header http.Header) []string {
+	list := header.Get(peerHeadersHeader)
+	if list == "" {
+		return nil
+	}
+	names := strings.Split(list, ",")
+	for i, name := range names {
+		names[i] = http.CanonicalHeaderKey(name)
+	}
+	return names
+}
+
+// peerRequestKey is the context key marking a request forwarded by a peer,
+// so it is not forwarded again.
+type peerRequestKey struct{}
+
+// peerErrorKind returns the kind of an upstream error, sent to the
+// forwarding peer
+func peerErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrRedirect):
+		return "redirect"
+	case errors.Is(err, ErrRejectIP):
+		return "reject-ip"
+	case errors.Is(err, ErrInvalidHostPort):
+		return "invalid-host-port"
+	case errors.Is(err, ErrInvalidNetType):
+		return "invalid-net-type"
+	}
+	switch errString := err.Error(); {
+	case containsOneOf(errString, "timeout", "Client.Timeout"):
+		return "timeout"
+	case strings.Contains(errString, "use of closed"):
+		return "closed"
+	}
+	return "error"
+}
+
+// peerError returns an error for an upstream error kind from a peer, that
+// ServeHTTP handles as it would the original error
+func peerError(kind string) error {
+	switch kind {
+	case "redirect":
+		return fmt.Errorf("peer upstream error: %w", ErrRedirect)
+	case "reject-ip":
+		return fmt.Errorf("peer upstream error: %w", ErrRejectIP)
+	case "invalid-host-port":
+		return fmt.Errorf("peer upstream error: %w", ErrInvalidHostPort)
+	case "invalid-net-type":
+		return fmt.Errorf("peer upstream error: %w", ErrInvalidNetType)
+	case "timeout":
+		return errors.New("peer upstream error: timeout")
+	case "closed":
+		return errors.New("peer upstream error: use of closed connection")
+	}
+	return errors.New("peer upstream error")
+}
+
+// forward sends an upstream request to the peer that owns the url. Returns
+// an error wrapping errPeerUnavailable if the peer could not handle it.
+func (p *Proxy) forward(req *http.Request, owner string, opts *requestOptions) (*http.Response, error) {
+	query := url.Values{
+		"url":     {req.URL.String()},
+		"classes": {strconv.Itoa(int(opts.classes))},
+		"max":     {strconv.FormatInt(opts.maxSize, 10)},
+	}.Encode()
+	preq, err := http.NewRequestWithContext(req.Context(), req.Method, owner+DefaultPeerPath+"?"+query, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errPeerUnavailable, err)
+	}
+	preq.Header = req.Header.Clone()
+	names := make([]string, 0, len(preq.Header))
+	for name := range preq.Header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	preq.Header.Set(peerHeadersHeader, strings.Join(names, ","))
+	preq.Header.Set(peerTimeHeader, timestamp)
+	preq.Header.Set(peerSignatureHeader, p.peers.sign(preq.Method, timestamp, query, preq.Header))
+
+	resp, err := p.peers.client.Do(preq) // #nosec G704
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", errPeerUnavailable, err)
+	}
+	// responses without the peer header are not from Proxy.ServePeer (eg.
+	// from a load balancer), or are for a request it refused
+	kind := resp.Header.Get(peerErrorHeader)
+	if resp.Header.Get(peerHeader) == "" || kind == peerRefused {
+		// #nosec G104
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errPeerUnavailable, resp.Status)
+	}
+	if kind != "" {
+		// #nosec G104
+		resp.Body.Close()
+		return nil, peerError(kind)
+	}
+	resp.Header.Del(peerHeader)
+	// the owner only sends a Warning header for a stale response
+	if warning := resp.Header.Get("Warning"); warning != "" {
+		resp.Request = req.WithContext(context.WithValue(req.Context(), staleWarningKey{}, warning))
+	}
+	return resp, nil
+}
+
+// ServePeer handles requests forwarded by the other members of the
+// PeerPool (see Config.Peers), for origin urls this instance owns. The
+// upstream response (from the cache, if any) is sent back to the peer.
+// Requests must be signed with the pool key, and are refused with a 403
+// otherwise.
+func (p *Proxy) ServePeer(w http.ResponseWriter, req *http.Request) {
+	if p.peers == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set(peerHeader, p.peers.self)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.peers.verify(req, time.Now()) {
+		w.Header().Set(peerErrorHeader, peerRefused)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := req.URL.Query()
+	classes, err := strconv.ParseUint(query.Get("classes"), 10, 8)
+	if err != nil || classes == 0 || classes > uint64(encoding.ContentAll) {
+		http.Error(w, "Bad classes", http.StatusBadRequest)
+		return
+	}
+	maxSize, err := strconv.ParseInt(query.Get("max"), 10, 64)
+	if err != nil || maxSize < 0 {
+		http.Error(w, "Bad max", http.StatusBadRequest)
+		return
+	}
+	opts := &requestOptions{
+		accept:  p.acceptTypes[classes],
+		classes: encoding.ContentClass(classes),
+		maxSize: maxSize,
+	}
+
+	sURL := query.Get("url")
+	u, err := url.Parse(sURL)
+	if err != nil {
+		http.Error(w, "Bad url", http.StatusBadRequest)
+		return
+	}
+	// the forwarding peer has verified the signed url. the claims are not
+	// forwarded, so url info filters see only the url.
+	info := &encoding.URLInfo{URL: sURL}
+	if err := p.checkURL(u, info); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), urlInfoKey{}, info)
+	ctx = context.WithValue(ctx, peerRequestKey{}, true)
+	nreq, err := http.NewRequestWithContext(ctx, req.Method, sURL, nil) //#nosec G704
+	if err != nil {
+		http.Error(w, "Bad url", http.StatusBadRequest)
+		return
+	}
+	// the forwarding peer has already built the upstream request headers.
+	// only the signed headers are used, as any others may have been added
+	// on the way.
+	for _, k := range peerSignedHeaders(req.Header) {
+		switch k {
+		case "Connection", "Range":
+			continue
+		}
+		if vv := req.Header.Values(k); len(vv) > 0 {
+			nreq.Header[k] = vv
+		}
+	}
+
+	if p.config.CollectMetrics {
+		peerRequests.Inc()
+	}
+	resp, err := p.do(nreq, opts)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if mlog.HasDebug() {
+			mlog.Debugx("peer request upstream error", mlog.A("url", sURL), mlog.A("err", err))
+		}
+		w.Header().Set(peerErrorHeader, peerErrorKind(err))
+		http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+		return
+	}
+	// #nosec G104
+	defer resp.Body.Close()
+
+	h := w.Header()
+	p.copyHeaders(&h, &resp.Header, &ValidRespHeaders)
+	setWarning(h, resp)
+	w.WriteHeader(resp.StatusCode)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	buf := *bufPool.Get().(*[]byte)
+	defer bufPool.Put(&buf)
+	var body io.Reader = resp.Body
+	if opts.maxSize > 0 {
+		// the forwarding peer truncates at max size, so there is no need
+		// to send more
+		body = io.LimitReader(resp.Body, opts.maxSize+1)
+	}
+	if _, err := io.CopyBuffer(w, body, buf); err != nil && mlog.HasDebug() {
+		mlog.Debugx("error writing peer response", mlog.A("err", err))
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestPeerPoolOwner(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewPeerPool(PeerPoolConfig{Self: "http://a:8080"})
+	assert.NotNil(t, err)
+	_, err = NewPeerPool(PeerPoolConfig{Self: "a:8080", Key: []byte("k")})
+	assert.NotNil(t, err)
+	_, err = NewPeerPool(PeerPoolConfig{Self: "http://a:8080", Key: []byte("k"), Peers: []string{"ftp://b"}})
+	assert.NotNil(t, err)
+
+	peers := []string{"http://a:8080/", "http://b:8080", "http://c:8080"}
+	pp, err := NewPeerPool(PeerPoolConfig{Self: "http://a:8080", Key: []byte("k"), Peers: peers})
+	assert.Nil(t, err)
+	assert.Equal(t, pp.Peers(), []string{"http://a:8080", "http://b:8080", "http://c:8080"})
+
+	// every peer owns a share of the urls
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := range 3000 {
+		key := "http://example.com/" + strconv.Itoa(i) + ".png"
+		owners[key] = pp.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, peer := range pp.Peers() {
+		assert.True(t, counts[peer] > 500, fmt.Sprint(counts))
+	}
+
+	// the other peers agree on the owners
+	other, err := NewPeerPool(PeerPoolConfig{Self: "http://c:8080", Key: []byte("k"), Peers: peers})
+	assert.Nil(t, err)
+	for key, owner := range owners {
+		assert.Equal(t, other.Owner(key), owner)
+	}
+
+	// only the urls of a removed peer move
+	assert.Nil(t, pp.Set([]string{"http://c:8080"}))
+	for key, owner := range owners {
+		if owner != "http://b:8080" {
+			assert.Equal(t, pp.Owner(key), owner)
+		}
+	}
+
+	// self is always a member
+	assert.Nil(t, pp.Set(nil))
+	assert.Equal(t, pp.Peers(), []string{"http://a:8080"})
+	assert.Equal(t, pp.Owner("http://example.com/0.png"), "http://a:8080")
+}
+
+func TestPeerPoolVerify(t *testing.T) {
+	t.Parallel()
+
+	pp, err := NewPeerPool(PeerPoolConfig{Self: "http://a:8080", Key: []byte("k")})
+	assert.Nil(t, err)
+	now := time.Now()
+
+	f := func(method, query string, at time.Time, key string, expected bool) {
+		t.Helper()
+		signer, err := NewPeerPool(PeerPoolConfig{Self: "http://b:8080", Key: []byte(key)})
+		assert.Nil(t, err)
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		req := httptest.NewRequest(http.MethodGet, DefaultPeerPath+"?url=http://example.com/a.png", nil)
+		req.Header.Set(peerTimeHeader, timestamp)
+		req.Header.Set(peerSignatureHeader, signer.sign(method, timestamp, query, req.Header))
+		assert.Equal(t, pp.verify(req, now), expected)
+	}
+
+	f(http.MethodGet, "url=http://example.com/a.png", now, "k", true)
+	f(http.MethodGet, "url=http://example.com/a.png", now.Add(-30*time.Second), "k", true)
+	f(http.MethodGet, "url=http://example.com/a.png", now.Add(-2*time.Minute), "k", false)
+	f(http.MethodGet, "url=http://example.com/a.png", now.Add(2*time.Minute), "k", false)
+	f(http.MethodGet, "url=http://example.com/a.png", now, "other", false)
+	f(http.MethodGet, "url=http://example.com/b.png", now, "k", false)
+	f(http.MethodHead, "url=http://example.com/a.png", now, "k", false)
+
+	req := httptest.NewRequest(http.MethodGet, DefaultPeerPath, nil)
+	assert.False(t, pp.verify(req, now))
+
+	// the signed headers can not be changed, or left out
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, DefaultPeerPath+"?url=http://example.com/a.png", nil)
+		req.Header.Set("Accept", "image/*")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set(peerHeadersHeader, "Accept,X-Forwarded-For")
+		req.Header.Set(peerTimeHeader, timestamp)
+		req.Header.Set(peerSignatureHeader, pp.sign(req.Method, timestamp, req.URL.RawQuery, req.Header))
+		return req
+	}
+	req = signed()
+	assert.True(t, pp.verify(req, now))
+	req.Header.Set("Cookie", "unsigned")
+	assert.True(t, pp.verify(req, now))
+	req = signed()
+	req.Header.Set("X-Forwarded-For", "10.0.0.2")
+	assert.False(t, pp.verify(req, now))
+	req = signed()
+	req.Header.Add("Accept", "text/html")
+	assert.False(t, pp.verify(req, now))
+	req = signed()
+	req.Header.Del("Accept")
+	assert.False(t, pp.verify(req, now))
+	req = signed()
+	req.Header.Set(peerHeadersHeader, "Accept")
+	assert.False(t, pp.verify(req, now))
+}
+
+func TestPeerError(t *testing.T) {
+	t.Parallel()
+
+	for _, err := range []error{ErrRedirect, ErrRejectIP, ErrInvalidHostPort, ErrInvalidNetType} {
+		wrapped := fmt.Errorf("upstream: %w", err)
+		assert.True(t, errors.Is(peerError(peerErrorKind(wrapped)), err), err.Error())
+	}
+	assert.Equal(t, peerErrorKind(errors.New("dial tcp: i/o timeout")), "timeout")
+	assert.MatchesRegex(t, peerError("timeout").Error(), "timeout")
+	assert.Equal(t, peerErrorKind(errors.New("connection refused")), "error")
+}
+
+func TestProxyPeers(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("image " + r.URL.Path))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	// two peers, each with a cache
+	var proxies [2]*Proxy
+	var caches [2]*MemoryCache
+	var peerURLs []string
+	for i := range proxies {
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxies[i].ServePeer(w, r)
+		}))
+		defer peer.Close()
+		peerURLs = append(peerURLs, peer.URL)
+	}
+	config := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+	for i := range proxies {
+		pool, err := NewPeerPool(PeerPoolConfig{Self: peerURLs[i], Peers: peerURLs, Key: []byte("peer-key")})
+		assert.Nil(t, err)
+		caches[i] = NewMemoryCache(MemoryCacheConfig{MaxBytes: 1 << 20})
+		pconfig := config
+		pconfig.Peers = pool
+		pconfig.Cache = caches[i]
+		proxies[i], err = New(pconfig, nil)
+		assert.Nil(t, err)
+	}
+
+	get := func(i int, path string) *http.Response {
+		t.Helper()
+		req, err := makeReq(config, ts.URL+path)
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		proxies[i].ServeHTTP(record, req)
+		return record.Result()
+	}
+
+	// each url is fetched once, by its owner, whichever peer is asked
+	for n := range 10 {
+		path := "/" + strconv.Itoa(n) + ".png"
+		for i := range proxies {
+			resp := get(i, path)
+			statusCodeAssert(t, 200, resp)
+			bodyAssert(t, "image "+path, resp)
+			headerAssert(t, "image/png", "Content-Type", resp)
+			assert.Equal(t, resp.Header.Get(peerHeader), "")
+		}
+		mu.Lock()
+		assert.Equal(t, hits[path], 1, path)
+		mu.Unlock()
+	}
+	// and is only cached by its owner
+	assert.Equal(t, caches[0].Len()+caches[1].Len(), 10)
+	assert.True(t, caches[0].Len() > 0)
+	assert.True(t, caches[1].Len() > 0)
+
+	// upstream responses are passed on
+	for i := range proxies {
+		resp := get(i, "/missing.png")
+		statusCodeAssert(t, 404, resp)
+	}
+
+	// forwarded requests with a bad signature are refused
+	req := httptest.NewRequest(http.MethodGet, DefaultPeerPath+"?url="+ts.URL+"/0.png&classes=1&max=0", nil)
+	record := httptest.NewRecorder()
+	proxies[0].ServePeer(record, req)
+	assert.Equal(t, record.Code, http.StatusForbidden)
+	assert.Equal(t, record.Header().Get(peerErrorHeader), peerRefused)
+
+	// as are signed requests with a changed header
+	signer, err := NewPeerPool(PeerPoolConfig{Self: peerURLs[1], Key: []byte("peer-key")})
+	assert.Nil(t, err)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req = httptest.NewRequest(http.MethodGet, DefaultPeerPath+"?url="+ts.URL+"/0.png&classes=1&max=0", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set(peerHeadersHeader, "X-Forwarded-For")
+	req.Header.Set(peerTimeHeader, timestamp)
+	req.Header.Set(peerSignatureHeader, signer.sign(req.Method, timestamp, req.URL.RawQuery, req.Header))
+	record = httptest.NewRecorder()
+	proxies[0].ServePeer(record, req)
+	assert.Equal(t, record.Code, http.StatusOK)
+
+	req.Header.Set("X-Forwarded-For", "10.0.0.2")
+	record = httptest.NewRecorder()
+	proxies[0].ServePeer(record, req)
+	assert.Equal(t, record.Code, http.StatusForbidden)
+}
+
+func TestProxyPeersFallback(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("image"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	// a peer that is down, and one that is not go-camo
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+
+	pool, err := NewPeerPool(PeerPoolConfig{
+		Self:  "http://127.0.0.1:1",
+		Peers: []string{down.URL, other.URL},
+		Key:   []byte("peer-key"),
+	})
+	assert.Nil(t, err)
+	config := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+		Peers:          pool,
+	}
+	camoServer, err := New(config, nil)
+	assert.Nil(t, err)
+
+	for n := range 10 {
+		req, err := makeReq(config, ts.URL+"/"+strconv.Itoa(n)+".png")
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		resp := record.Result()
+		statusCodeAssert(t, 200, resp)
+		bodyAssert(t, "image", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, hits, 10)
+}
@@ -15,6 +15,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -34,8 +35,22 @@ type Config struct { // betteralign:ignore
 	ServerName string
 	// User Agent used in outbound request Headers
 	UserAgent string
-	// HMACKey is a byte slice to be used as the hmac key
+	// HMACKey is a byte slice to be used as the hmac key.
+	// Ignored if Keyring (or Codecs) is set. Otherwise it must not be empty,
+	// or New returns an error.
 	HMACKey []byte
+	// Keyring is a set of keys used to verify urls. If nil, a keyring is
+	// created from HMACKey.
+	Keyring *encoding.Keyring
+	// Codecs are the url formats accepted, tried in order. The first codec
+	// that recognises the url format is used to verify it. If empty, the
+	// go-camo path format is used (along with the camo query string format,
+	// if AllowQueryFormat is set), with Keyring.
+	Codecs []encoding.Codec
+	// MinAlgorithm is the weakest url signature algorithm accepted (see
+	// encoding.Algorithm.Meets). It must be an HMAC algorithm. The zero
+	// value accepts any supported algorithm.
+	MinAlgorithm encoding.Algorithm
 	// MaxSize is the maximum valid image size response (in bytes).
 	// Setting a non-zero MaxSize will also automatically set DisableKeepAlivesBE to true.
 	MaxSize int64
@@ -57,8 +72,46 @@ type Config struct { // betteralign:ignore
 	// additional content types to allow
 	AllowContentVideo bool
 	AllowContentAudio bool
+	// additional content types that signed url options may allow
+	AllowSignedContentVideo bool
+	AllowSignedContentAudio bool
+	// MaxSignedSize is the largest max size (in bytes) that signed url
+	// options may set. If zero, signed max sizes are limited to MaxSize.
+	MaxSignedSize int64
 	// allow URLs to contain user/pass credentials
 	AllowCredentialURLs bool
+	// allow original camo query string format urls (/<digest>?url=<url>).
+	// Ignored if Codecs is set.
+	AllowQueryFormat bool
+	// allow signed token urls (/<token>). Ignored if Codecs is set.
+	AllowTokenFormat bool
+	// URLInfoFilters are evaluated after the filters passed to New, with
+	// the verified url details (eg. token claims).
+	URLInfoFilters []URLInfoFilterFunc
+	// Cache, if set, stores upstream responses, so repeat requests for a
+	// url can be served without an upstream request.
+	Cache Cache
+	// CacheMaxEntrySize is the largest response body (in bytes) stored in
+	// the Cache. Defaults to DefaultCacheMaxEntrySize.
+	CacheMaxEntrySize int64
+	// CacheStaleWhileRevalidate, if non-zero, is how long after they
+	// expire cached responses may be served while they are revalidated in
+	// the background. Upstream stale-while-revalidate directives may
+	// shorten it.
+	CacheStaleWhileRevalidate time.Duration
+	// CacheStaleIfError, if non-zero, is how long after they expire cached
+	// responses may be served when the upstream request fails (a
+	// connection error or a 5xx response). Upstream stale-if-error
+	// directives may shorten it.
+	CacheStaleIfError time.Duration
+	// NegativeCache, if set, holds recent upstream failures, so repeat
+	// requests for a failing url (or host) fail without an upstream
+	// request.
+	NegativeCache *NegativeCache
+	// Peers, if set, is the group of instances this one shares upstream
+	// fetches with. Requests for origin urls owned by another peer are
+	// forwarded to it (see ServePeer), and fetched locally if it fails.
+	Peers *PeerPool
 	// Whether to call/increment metrics
 	CollectMetrics bool
 	// no ip filtering (test mode)
@@ -69,18 +122,34 @@ type Config struct { // betteralign:ignore
 // A true value approves the url. A false value rejects the url.
 type FilterFunc func(*url.URL) (bool, error)
 
+// The URLInfoFilterFunc type is a function that validates a *url.URL, along
+// with the verified details of the signed url it came from (eg. token
+// claims). A true value approves the url. A false value rejects the url.
+type URLInfoFilterFunc func(*url.URL, *encoding.URLInfo) (bool, error)
+
 // A Proxy is a Camo like HTTP proxy, that provides content type
 // restrictions as well as regex host allow list support.
 type Proxy struct {
 	client              *http.Client
 	config              *Config
+	cache               Cache
+	peers               *PeerPool
+	negative            *NegativeCache
+	codecs              []encoding.Codec
 	upstreamProxyConfig *upstreamProxyConfig
-	acceptTypesFilter   *htrie.GlobPathChecker
-	acceptTypesString   string
 	filters             []FilterFunc
+	acceptTypes         [encoding.ContentAll + 1]*acceptTypes
+	flights             flightGroup
 	filtersLen          int
+	cacheMaxEntrySize   int64
+	contentClasses      encoding.ContentClass
+	maxContentClasses   encoding.ContentClass
 }
 
+// urlInfoKey is the context key for the verified *encoding.URLInfo of a
+// proxied request.
+type urlInfoKey struct{}
+
 // ServerHTTP handles the client request, validates the request is validly
 // HMAC signed, filters based on the Allow list, and then proxies
 // valid requests to the desired endpoint. Responses are filtered for
@@ -95,27 +164,89 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// split path and get components
-	components := strings.Split(req.URL.Path, "/")
-	if len(components) < 3 {
+	info, err := p.decodeURL(req.URL)
+	if errors.Is(err, encoding.ErrUnknownFormat) {
 		http.Error(w, "Malformed request path", http.StatusNotFound)
 		return
 	}
 
-	sigHash, encodedURL := components[1], components[2]
-
 	if mlog.HasDebug() {
 		mlog.Debugm("client request", httpReqToMlogMap(req))
 	}
 
-	sURL, ok := encoding.DecodeURL(p.config.HMACKey, sigHash, encodedURL)
-	if !ok {
+	if err != nil {
+		if mlog.HasDebug() {
+			mlog.Debugf("Bad Decode of URL: %s", err)
+		}
+		http.Error(w, "Bad Signature", http.StatusForbidden)
+		return
+	}
+
+	if !info.Algorithm.Meets(p.config.MinAlgorithm) {
+		if mlog.HasDebug() {
+			mlog.Debugx(
+				"signature algorithm below minimum",
+				mlog.A("algorithm", info.Algorithm),
+				mlog.A("min_algorithm", p.config.MinAlgorithm),
+			)
+		}
 		http.Error(w, "Bad Signature", http.StatusForbidden)
 		return
 	}
 
+	if p.config.CollectMetrics {
+		signatureVerified.WithLabelValues(keyLabel(info)).Inc()
+	}
+
+	// check signed expiry/not-before times (if any)
+	if err := info.CheckTime(time.Now()); err != nil {
+		if mlog.HasDebug() {
+			mlog.Debugx(
+				"url outside of signed validity period",
+				mlog.A("err", err),
+				mlog.A("expires", info.Expires),
+				mlog.A("not_before", info.NotBefore),
+			)
+		}
+		if errors.Is(err, encoding.ErrExpired) {
+			if p.config.CollectMetrics {
+				validityRejected.WithLabelValues("expired").Inc()
+			}
+			http.Error(w, "Expired URL", http.StatusGone)
+		} else {
+			if p.config.CollectMetrics {
+				validityRejected.WithLabelValues("not_yet_valid").Inc()
+			}
+			http.Error(w, "URL not yet valid", http.StatusForbidden)
+		}
+		return
+	}
+
+	opts, err := p.requestOptions(info)
+	if err != nil {
+		if mlog.HasDebug() {
+			mlog.Debugx(
+				"signed url options rejected",
+				mlog.A("content_classes", info.ContentClasses),
+				mlog.A("max_size", info.MaxSize),
+			)
+		}
+		http.Error(w, "Bad Signature", http.StatusForbidden)
+		return
+	}
+
+	sURL := info.URL
+
 	if mlog.HasDebug() {
-		mlog.Debugx("signed client url", mlog.A("url", sURL))
+		if info.Claims != nil {
+			mlog.Debugx(
+				"signed client url",
+				mlog.A("url", sURL),
+				mlog.A("tenant", info.Claims.Tenant),
+			)
+		} else {
+			mlog.Debugx("signed client url", mlog.A("url", sURL))
+		}
 	}
 
 	u, err := url.Parse(sURL)
@@ -127,13 +258,30 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = p.checkURL(u)
+	err = p.checkURL(u, info)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	nreq, err := http.NewRequestWithContext(req.Context(), req.Method, sURL, nil) //#nosec G704
+	// fail early if the url (or host) failed recently
+	if p.negative != nil {
+		if entry := p.negative.lookup(sURL, u.Host, opts, time.Now()); entry != nil {
+			if p.config.CollectMetrics {
+				negativeCacheHits.WithLabelValues(entry.class).Inc()
+			}
+			if mlog.HasDebug() {
+				mlog.Debugx("negative cache hit", mlog.A("url", sURL), mlog.A("class", entry.class))
+			}
+			http.Error(w, entry.message, entry.status)
+			return
+		}
+	}
+
+	// keep the url info in the request context, so redirects can be checked
+	// against it too
+	ctx := context.WithValue(req.Context(), urlInfoKey{}, info)
+	nreq, err := http.NewRequestWithContext(ctx, req.Method, sURL, nil) //#nosec G704
 	if err != nil {
 		if mlog.HasDebug() {
 			mlog.Debugx("could not create NewRequest", mlog.A("err", err))
@@ -152,9 +300,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			hostIP, _, err := net.SplitHostPort(req.RemoteAddr)
 			if err == nil {
 				// add forwarded for header, as long as it isn't a private
-				// ip address (use isRejectedIP to get private filtering for free)
+				// ip address (use IsRejectedIP to get private filtering for free)
 				if ip := net.ParseIP(hostIP); ip != nil {
-					if !isRejectedIP(ip) {
+					if !IsRejectedIP(ip) {
 						nreq.Header.Add("X-Forwarded-For", hostIP)
 					}
 				}
@@ -165,7 +313,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// add/squash an accept header if the client didn't send one
-	nreq.Header.Set("Accept", p.acceptTypesString)
+	nreq.Header.Set("Accept", opts.accept.header)
 	nreq.Header.Add("User-Agent", p.config.UserAgent)
 
 	// must be ServerName to avoid request loops, checked at the top of ServeHttp
@@ -175,7 +323,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		mlog.Debugm("built outgoing request", httpReqToMlogMap(nreq))
 	}
 
-	resp, err := p.client.Do(nreq) // #nosec G704
+	trace := contextTrace(ctx)
+	resp, err := p.do(nreq, opts)
 
 	if resp != nil {
 		defer func() {
@@ -188,6 +337,12 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if err != nil {
+		trace.upstreamError(err)
+		// connection failures are cached for the whole host
+		nkey, nhost := sURL, false
+		if host := negativeErrorHost(err); host != "" {
+			nkey, nhost = host, true
+		}
 		switch {
 		case errors.Is(err, context.Canceled):
 			// handle client aborting request early in the request lifetime
@@ -200,28 +355,36 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			if mlog.HasDebug() {
 				mlog.Debugx("bad redirect from server", mlog.A("err", err))
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeRedirect, message: "Error Fetching Resource", status: http.StatusNotFound,
+			})
 			return
 		case errors.Is(err, ErrRejectIP):
 			// Got a deny list failure from Dial.Control
 			if mlog.HasDebug() {
 				mlog.Debugx("ip filter rejection from dial.control", mlog.A("err", err))
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeRejected, message: "Error Fetching Resource", status: http.StatusNotFound,
+			})
 			return
 		case errors.Is(err, ErrInvalidHostPort):
 			// Got a deny list failure from Dial.Control
 			if mlog.HasDebug() {
 				mlog.Debugx("invalid host/port rejection from dial.control", mlog.A("err", err))
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeRejected, message: "Error Fetching Resource", status: http.StatusNotFound,
+			})
 			return
 		case errors.Is(err, ErrInvalidNetType):
 			// Got a deny list failure from Dial.Control
 			if mlog.HasDebug() {
 				mlog.Debugx("net type rejection from dial.control", mlog.A("err", err))
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeRejected, message: "Error Fetching Resource", status: http.StatusNotFound,
+			})
 			return
 		}
 
@@ -234,12 +397,18 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		// the newer error semantics yet...
 		switch errString := err.Error(); {
 		case containsOneOf(errString, "timeout", "Client.Timeout"):
-			http.Error(w, "Error Fetching Resource", http.StatusGatewayTimeout)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeTimeout, message: "Error Fetching Resource", status: http.StatusGatewayTimeout,
+			})
 		case strings.Contains(errString, "use of closed"):
-			http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeConnect, message: "Error Fetching Resource", status: http.StatusBadGateway,
+			})
 		default:
 			// some other error. call it a not found (camo compliant)
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.negativeError(w, nkey, nhost, negativeEntry{
+				class: NegativeConnect, message: "Error Fetching Resource", status: http.StatusNotFound,
+			})
 		}
 		return
 	}
@@ -247,9 +416,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if mlog.HasDebug() {
 		mlog.Debugm("response from upstream", httpRespToMlogMap(resp))
 	}
+	trace.upstreamResponse(resp)
 
 	// check for too large a response
-	if p.config.MaxSize > 0 && resp.ContentLength > p.config.MaxSize {
+	if opts.maxSize > 0 && resp.ContentLength > opts.maxSize {
 		if p.config.CollectMetrics {
 			contentLengthExceeded.Inc()
 		}
@@ -274,7 +444,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			if mlog.HasDebug() {
 				mlog.Debug("Empty content-type returned")
 			}
-			http.Error(w, "Empty content-type returned", http.StatusBadRequest)
+			trace.contentType("", "")
+			p.negativeError(w, sURL, false, negativeEntry{
+				class: NegativeContentType, message: "Empty content-type returned", status: http.StatusBadRequest, classes: opts.classes,
+			})
 			return
 		}
 
@@ -285,11 +458,14 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		// this context.
 		// content-type: image/png, text/html; charset=...
 		mediatype, param, err := mime.ParseMediaType(contentType)
-		if err != nil || !p.acceptTypesFilter.CheckPath(mediatype) {
+		if err != nil || !opts.accept.filter.CheckPath(mediatype) {
 			if mlog.HasDebug() {
 				mlog.Debugx("Unsupported content-type returned", mlog.A("type", u))
 			}
-			http.Error(w, "Unsupported content-type returned", http.StatusBadRequest)
+			trace.contentType(contentType, "")
+			p.negativeError(w, sURL, false, negativeEntry{
+				class: NegativeContentType, message: "Unsupported content-type returned", status: http.StatusBadRequest, classes: opts.classes,
+			})
 			return
 		}
 
@@ -305,36 +481,56 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			if mlog.HasDebug() {
 				mlog.Debug("Unsupported content-type returned")
 			}
-			http.Error(w, "Unsupported content-type returned", http.StatusBadRequest)
+			trace.contentType(contentType, "")
+			p.negativeError(w, sURL, false, negativeEntry{
+				class: NegativeContentType, message: "Unsupported content-type returned", status: http.StatusBadRequest, classes: opts.classes,
+			})
 			return
 		}
+		trace.contentType(contentType, responseContentType)
 	case 300:
-		http.Error(w, "Multiple choices not supported", http.StatusNotFound)
+		p.negativeError(w, sURL, false, negativeEntry{
+			class: NegativeNotFound, message: "Multiple choices not supported", status: http.StatusNotFound,
+		})
 		return
 	case 301, 302, 303, 307:
 		// if we get a redirect here, we either disabled following,
 		// or followed until max depth and still got one (redirect loop)
-		http.Error(w, "Not Found", http.StatusNotFound)
+		p.negativeError(w, sURL, false, negativeEntry{
+			class: NegativeNotFound, message: "Not Found", status: http.StatusNotFound,
+		})
 		return
 	case 304:
 		h := w.Header()
 		p.copyHeaders(&h, &resp.Header, &ValidRespHeaders)
+		setWarning(h, resp)
 		w.WriteHeader(304)
 		return
 	case 404:
-		http.Error(w, "Not Found", http.StatusNotFound)
+		p.negativeError(w, sURL, false, negativeEntry{
+			class: NegativeNotFound, message: "Not Found", status: http.StatusNotFound,
+		})
 		return
 	case 500, 502, 503, 504:
 		// upstream errors should probably just 502. client can try later.
-		http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+		p.negativeError(w, sURL, false, negativeEntry{
+			class: NegativeUpstreamError, message: "Error Fetching Resource", status: http.StatusBadGateway,
+		})
 		return
-	default:
+	case 406, 412, 416:
+		// depend on the request headers, so not cached
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
+	default:
+		p.negativeError(w, sURL, false, negativeEntry{
+			class: NegativeNotFound, message: "Not Found", status: http.StatusNotFound,
+		})
+		return
 	}
 
 	h := w.Header()
 	p.copyHeaders(&h, &resp.Header, &ValidRespHeaders)
+	setWarning(h, resp)
 	// set content type based on parsed content type, not originally supplied
 	h.Set("content-type", responseContentType)
 	w.WriteHeader(resp.StatusCode)
@@ -346,8 +542,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// wrap body in limit reader, so even while chunk/streaming, we read
 	// less than desired max size
 	var bodyRC io.ReadCloser = resp.Body
-	if p.config.MaxSize > 0 {
-		bodyRC = NewLimitReadCloser(resp.Body, p.config.MaxSize)
+	if opts.maxSize > 0 {
+		bodyRC = NewLimitReadCloser(resp.Body, opts.maxSize)
 	}
 
 	// since this uses io.Copy/CopyBuffer from the respBody, it is streaming
@@ -387,7 +583,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if p.config.MaxSize > 0 && written >= p.config.MaxSize {
+	if opts.maxSize > 0 && written >= opts.maxSize {
 		if p.config.CollectMetrics {
 			responseTruncated.Inc()
 		}
@@ -402,7 +598,36 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (p *Proxy) checkURL(reqURL *url.URL) error {
+// decodeURL verifies the request url with the first codec that recognises
+// its format. Returns ErrUnknownFormat if no codec does.
+func (p *Proxy) decodeURL(reqURL *url.URL) (*encoding.URLInfo, error) {
+	for _, codec := range p.codecs {
+		info, err := codec.Decode(reqURL)
+		if errors.Is(err, encoding.ErrUnknownFormat) {
+			continue
+		}
+		return info, err
+	}
+	return nil, encoding.ErrUnknownFormat
+}
+
+// CheckURL returns an error if requests for the url would be rejected
+// before it is fetched: by url scheme, hostname, credentials, the filter
+// ruleset, or an ip address host the proxy refuses to connect to. The
+// addresses a hostname resolves to are checked when the url is fetched, and
+// are not checked here.
+func (p *Proxy) CheckURL(u *url.URL) error {
+	if err := p.checkURL(u, &encoding.URLInfo{URL: u.String()}); err != nil {
+		return err
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !p.config.noIPFiltering &&
+		IsRejectedIP(ip) && !p.upstreamProxyConfig.matchesIP(ip, u.Port()) {
+		return ErrRejectIP
+	}
+	return nil
+}
+
+func (p *Proxy) checkURL(reqURL *url.URL, info *encoding.URLInfo) error {
 	// ensure we have an http or https url
 	// (eg. no file:// or other)
 	scheme := reqURL.Scheme
@@ -427,7 +652,7 @@ func (p *Proxy) checkURL(reqURL *url.URL) error {
 	// reject localhost urls
 	// lower case for matching is done by IdnaLookupMap above, so no need to
 	// ToLower here also
-	if localsFilter.CheckCleanHostname(cleanHostname) {
+	if IsLocalHostname(cleanHostname) {
 		return errors.New("Bad url host")
 	}
 
@@ -442,6 +667,14 @@ func (p *Proxy) checkURL(reqURL *url.URL) error {
 			return errors.New("Rejected due to filter-ruleset")
 		}
 	}
+	for _, filter := range p.config.URLInfoFilters {
+		if filter == nil {
+			continue
+		}
+		if chk, err := filter(reqURL, info); err != nil || !chk {
+			return errors.New("Rejected due to filter-ruleset")
+		}
+	}
 
 	// if using a proxy config, block directly url requests to the proxy
 	if p.upstreamProxyConfig.hasProxy &&
@@ -478,6 +711,31 @@ func (p *Proxy) copyHeaders(dst, src *http.Header, filter *map[string]bool) {
 func New(pc Config, filters []FilterFunc) (*Proxy, error) {
 	doFiltering := !pc.noIPFiltering
 
+	if pc.MinAlgorithm != 0 && !pc.MinAlgorithm.IsHMAC() {
+		return nil, fmt.Errorf("invalid min algorithm: %s", pc.MinAlgorithm)
+	}
+
+	codecs := slices.Clone(pc.Codecs)
+	if len(codecs) == 0 {
+		keyring := pc.Keyring
+		if keyring == nil {
+			var err error
+			keyring, err = encoding.NewKeyring(encoding.Key{Secret: pc.HMACKey})
+			if err != nil {
+				return nil, fmt.Errorf("invalid hmac key: %w", err)
+			}
+		}
+		// token urls go first, as they may have the same number of path
+		// components as the path format (with a trailing filename)
+		if pc.AllowTokenFormat {
+			codecs = append(codecs, &encoding.TokenCodec{Keyring: keyring})
+		}
+		codecs = append(codecs, &encoding.PathCodec{Keyring: keyring})
+		if pc.AllowQueryFormat {
+			codecs = append(codecs, &encoding.QueryCodec{Keyring: keyring})
+		}
+	}
+
 	upstreamProxyConf := &upstreamProxyConfig{}
 	upstreamProxyConf.init()
 
@@ -506,13 +764,13 @@ func New(pc Config, filters []FilterFunc) (*Proxy, error) {
 
 				// filter out rejected networks
 				if ip := net.ParseIP(host); ip != nil {
-					if isRejectedIP(ip) && !upstreamProxyConf.matchesIP(ip, port) {
+					if IsRejectedIP(ip) && !upstreamProxyConf.matchesIP(ip, port) {
 						return ErrRejectIP
 					}
 				} else {
 					if ips, err := net.LookupIP(host); err == nil {
 						for _, ip := range ips {
-							if isRejectedIP(ip) && !upstreamProxyConf.matchesIP(ip, port) {
+							if IsRejectedIP(ip) && !upstreamProxyConf.matchesIP(ip, port) {
 								return ErrRejectIP
 							}
 						}
@@ -558,7 +816,7 @@ func New(pc Config, filters []FilterFunc) (*Proxy, error) {
 	// For most programs this is a transparent win; however, if configured for a max-size,
 	// we rely on early Close to abort a large download, so we need to set
 	// Transport.DisableKeepAlives to true so as to opt out of this behavior.
-	if pc.MaxSize > 0 && !tr.DisableKeepAlives {
+	if (pc.MaxSize > 0 || pc.MaxSignedSize > 0) && !tr.DisableKeepAlives {
 		mlog.Info("max-size set, so disabling backend http keep-alives")
 		tr.DisableKeepAlives = true
 	}
@@ -569,30 +827,44 @@ func New(pc Config, filters []FilterFunc) (*Proxy, error) {
 		Timeout: pc.RequestTimeout,
 	}
 
-	acceptTypes := []string{"image/*", "image/svg+xml"}
-	// add additional accept types, if appropriate
+	p := &Proxy{
+		client:              client,
+		config:              &pc,
+		codecs:              codecs,
+		upstreamProxyConfig: upstreamProxyConf,
+		cache:               pc.Cache,
+		peers:               pc.Peers,
+		negative:            pc.NegativeCache,
+		cacheMaxEntrySize:   pc.CacheMaxEntrySize,
+		contentClasses:      encoding.ContentImage,
+	}
+	if p.cacheMaxEntrySize <= 0 {
+		p.cacheMaxEntrySize = DefaultCacheMaxEntrySize
+	}
+
+	// add additional content classes, if appropriate
 	if pc.AllowContentVideo {
-		acceptTypes = append(acceptTypes, "video/*")
+		p.contentClasses |= encoding.ContentVideo
 	}
 	if pc.AllowContentAudio {
-		acceptTypes = append(acceptTypes, "audio/*")
+		p.contentClasses |= encoding.ContentAudio
+	}
+	p.maxContentClasses = p.contentClasses
+	if pc.AllowSignedContentVideo {
+		p.maxContentClasses |= encoding.ContentVideo
+	}
+	if pc.AllowSignedContentAudio {
+		p.maxContentClasses |= encoding.ContentAudio
 	}
 
-	// re-use the htrie glob path checker for accept types validation
-	acceptTypesFilter := htrie.NewGlobPathChecker()
-	for _, v := range acceptTypes {
-		err := acceptTypesFilter.AddRule("|i|" + v)
+	// build accept types for each set of content classes, so signed url
+	// options don't need per request setup
+	for classes := encoding.ContentClass(1); classes <= encoding.ContentAll; classes++ {
+		accept, err := newAcceptTypes(classes)
 		if err != nil {
 			return nil, err
 		}
-	}
-
-	p := &Proxy{
-		client:              client,
-		config:              &pc,
-		acceptTypesString:   strings.Join(acceptTypes, ", "),
-		acceptTypesFilter:   acceptTypesFilter,
-		upstreamProxyConfig: upstreamProxyConf,
+		p.acceptTypes[classes] = accept
 	}
 
 	if len(filters) > 0 {
@@ -615,7 +887,8 @@ func New(pc Config, filters []FilterFunc) (*Proxy, error) {
 			}
 			return fmt.Errorf("Too many redirects: %w", ErrRedirect)
 		}
-		err := p.checkURL(req.URL)
+		info, _ := req.Context().Value(urlInfoKey{}).(*encoding.URLInfo)
+		err := p.checkURL(req.URL, info)
 		if err != nil {
 			if mlog.HasDebug() {
 				mlog.Debugx("Got bad redirect", mlog.A("url", req))
@@ -623,6 +896,7 @@ func New(pc Config, filters []FilterFunc) (*Proxy, error) {
 			return fmt.Errorf("Bad redirect: %w", ErrRedirect)
 		}
 
+		contextTrace(req.Context()).outboundRequest(req)
 		return nil
 	}
 
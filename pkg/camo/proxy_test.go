@@ -5,16 +5,21 @@
 package camo
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"codeberg.org/dropwhile/mlog"
 	"github.com/cactus/go-camo/v2/pkg/assert"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
 )
 
 var camoConfig = Config{
@@ -172,6 +177,626 @@ func TestXForwardedFor(t *testing.T) {
 	bodyAssert(t, "", resp)
 }
 
+func TestMinAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	camoConfigWithMinAlg := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		MinAlgorithm:   encoding.SHA256,
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	// sha1 signed url is below the minimum
+	req, err := makeReq(camoConfigWithMinAlg, ts.URL)
+	assert.Nil(t, err)
+	resp, err := processRequest(req, 403, camoConfigWithMinAlg, nil)
+	assert.Nil(t, err)
+	bodyAssert(t, "Bad Signature\n", resp)
+
+	for _, alg := range []encoding.Algorithm{encoding.SHA256, encoding.SHA512_256} {
+		encURL, err := encoding.B64EncodeURLWithOptions(
+			camoConfigWithMinAlg.HMACKey, ts.URL, encoding.SignOptions{Algorithm: alg},
+		)
+		assert.Nil(t, err)
+		req, err = http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		resp, err = processRequest(req, 200, camoConfigWithMinAlg, nil)
+		assert.Nil(t, err)
+		bodyAssert(t, "ok", resp)
+	}
+
+	// the minimum must be an hmac algorithm
+	camoConfigWithMinAlg.MinAlgorithm = encoding.Ed25519
+	_, err = New(camoConfigWithMinAlg, nil)
+	assert.NotNil(t, err)
+}
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+
+	camoConfigWithTrace := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		UserAgent:      "go-camo-test",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, err := w.Write([]byte("ok"))
+			assert.Nil(t, err)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, err := w.Write([]byte("<html>"))
+			assert.Nil(t, err)
+		}
+	}))
+	defer ts.Close()
+
+	var outbound []string
+	var upstreamStatus int
+	var upstreamType, clientType string
+	var upstreamErr error
+	trace := &Trace{
+		OutboundRequest: func(req *http.Request) {
+			assert.Equal(t, "go-camo-test", req.Header.Get("User-Agent"))
+			outbound = append(outbound, req.URL.Path)
+		},
+		UpstreamResponse: func(resp *http.Response) {
+			upstreamStatus = resp.StatusCode
+		},
+		UpstreamError: func(err error) {
+			upstreamErr = err
+		},
+		ContentType: func(upstream string, client string) {
+			upstreamType, clientType = upstream, client
+		},
+	}
+
+	req, err := makeReq(camoConfigWithTrace, ts.URL+"/redirect")
+	assert.Nil(t, err)
+	req = req.WithContext(WithTrace(req.Context(), trace))
+	resp, err := processRequest(req, 200, camoConfigWithTrace, nil)
+	assert.Nil(t, err)
+	bodyAssert(t, "ok", resp)
+	assert.Equal(t, []string{"/redirect", "/image.png"}, outbound)
+	assert.Equal(t, 200, upstreamStatus)
+	assert.Equal(t, "image/png", upstreamType)
+	assert.Equal(t, "image/png", clientType)
+
+	outbound = nil
+	req, err = makeReq(camoConfigWithTrace, ts.URL+"/page.html")
+	assert.Nil(t, err)
+	req = req.WithContext(WithTrace(req.Context(), trace))
+	_, err = processRequest(req, 400, camoConfigWithTrace, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/page.html"}, outbound)
+	assert.Equal(t, "text/html", upstreamType)
+	assert.Equal(t, "", clientType)
+	assert.Nil(t, upstreamErr)
+
+	// redirect loop
+	camoConfigWithTrace.MaxRedirects = 0
+	req, err = makeReq(camoConfigWithTrace, ts.URL+"/redirect")
+	assert.Nil(t, err)
+	req = req.WithContext(WithTrace(req.Context(), trace))
+	_, err = processRequest(req, 404, camoConfigWithTrace, nil)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(upstreamErr, ErrRedirect))
+	camoConfigWithTrace.MaxRedirects = 3
+
+	// no trace
+	req, err = makeReq(camoConfigWithTrace, ts.URL+"/image.png")
+	assert.Nil(t, err)
+	_, err = processRequest(req, 200, camoConfigWithTrace, nil)
+	assert.Nil(t, err)
+}
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	oldKey := encoding.Key{ID: "old", Secret: []byte("0x24FEEDFACEDEADBEEFCAFE")}
+	newKey := encoding.Key{ID: "new", Secret: []byte("0xDEADBEEF")}
+	oldRing, err := encoding.NewKeyring(oldKey)
+	assert.Nil(t, err)
+	newRing, err := encoding.NewKeyring(newKey, oldKey)
+	assert.Nil(t, err)
+
+	camoConfigWithKeyring := Config{
+		Keyring:        newRing,
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(encURL string, status int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		_, err = processRequest(req, status, camoConfigWithKeyring, nil)
+		assert.Nil(t, err)
+	}
+
+	// signed with the current signing key
+	encURL, err := newRing.B64EncodeURL(ts.URL, encoding.SignOptions{})
+	assert.Nil(t, err)
+	f(encURL, 200)
+	// signed with the retiring key, with and without a key id
+	encURL, err = oldRing.HexEncodeURL(ts.URL, encoding.SignOptions{})
+	assert.Nil(t, err)
+	f(encURL, 200)
+	f(encoding.B64EncodeURL(oldKey.Secret, ts.URL), 200)
+	// signed with an unknown key
+	f(encoding.B64EncodeURL([]byte("unknown"), ts.URL), 403)
+
+	// an hmac key (or keyring) is required
+	_, err = New(Config{ServerName: "go-camo"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestEd25519(t *testing.T) {
+	t.Parallel()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+
+	// proxy only has the public key
+	kr, err := encoding.NewKeyring(encoding.Key{ID: "signer", PublicKey: pub})
+	assert.Nil(t, err)
+
+	c := Config{
+		Keyring:        kr,
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(encURL string, status int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		_, err = processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+	}
+
+	opts := encoding.SignOptions{KeyID: "signer"}
+	f(encoding.Ed25519B64EncodeURL(priv, ts.URL, opts), 200)
+	f(encoding.Ed25519HexEncodeURL(priv, ts.URL, encoding.SignOptions{}), 200)
+	// signed with a different private key
+	f(encoding.Ed25519B64EncodeURL(otherPriv, ts.URL, opts), 403)
+	// hmac urls can't be verified with a public key
+	f(encoding.B64EncodeURL(pub, ts.URL), 403)
+}
+
+func TestSignedURLOptions(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/video.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			_, err := w.Write([]byte("ok"))
+			assert.Nil(t, err)
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, err := w.Write(make([]byte, 2048))
+			assert.Nil(t, err)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			_, err := w.Write([]byte("ok"))
+			assert.Nil(t, err)
+		}
+	}))
+	defer ts.Close()
+
+	f := func(c Config, path string, opts encoding.SignOptions, status int) {
+		t.Helper()
+		encURL, err := encoding.B64EncodeURLWithOptions(c.HMACKey, ts.URL+path, opts)
+		assert.Nil(t, err)
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		_, err = processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+	}
+
+	c := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		MaxSize:        1024,
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+	video := encoding.SignOptions{ContentClasses: encoding.ContentImage | encoding.ContentVideo}
+	imageOnly := encoding.SignOptions{ContentClasses: encoding.ContentImage}
+	videoOnly := encoding.SignOptions{ContentClasses: encoding.ContentVideo}
+
+	// no video allowed by default, or by signed options
+	f(c, "/video.mp4", encoding.SignOptions{}, 400)
+	f(c, "/video.mp4", video, 400)
+	f(c, "/video.mp4", videoOnly, 403)
+	f(c, "/image.png", video, 200)
+
+	// signed options may allow video, if the ceiling allows it
+	cSigned := c
+	cSigned.AllowSignedContentVideo = true
+	f(cSigned, "/video.mp4", encoding.SignOptions{}, 400)
+	f(cSigned, "/video.mp4", video, 200)
+	f(cSigned, "/video.mp4", videoOnly, 200)
+	f(cSigned, "/image.png", videoOnly, 400)
+
+	// signed options may narrow the defaults
+	cVideo := c
+	cVideo.AllowContentVideo = true
+	f(cVideo, "/video.mp4", encoding.SignOptions{}, 200)
+	f(cVideo, "/video.mp4", imageOnly, 400)
+
+	// signed max size is limited to MaxSize, unless MaxSignedSize is set
+	f(c, "/big.png", encoding.SignOptions{}, 404)
+	f(c, "/big.png", encoding.SignOptions{MaxSize: 4096}, 404)
+	cBig := c
+	cBig.MaxSignedSize = 4096
+	f(cBig, "/big.png", encoding.SignOptions{}, 404)
+	f(cBig, "/big.png", encoding.SignOptions{MaxSize: 4096}, 200)
+	f(cBig, "/big.png", encoding.SignOptions{MaxSize: 8192}, 200)
+	f(cBig, "/image.png", encoding.SignOptions{MaxSize: 1}, 404)
+}
+
+// tenantCodec is a test codec for a tenant prefixed path format:
+// /<tenant>/<digest>/<encoded-url>
+type tenantCodec struct {
+	keyring *encoding.Keyring
+	tenant  string
+}
+
+func (c *tenantCodec) Name() string {
+	return "tenant"
+}
+
+func (c *tenantCodec) Decode(u *url.URL) (*encoding.URLInfo, error) {
+	components := strings.Split(u.Path, "/")
+	if len(components) != 4 || components[1] != c.tenant {
+		return nil, encoding.ErrUnknownFormat
+	}
+	return c.keyring.DecodeURL(components[2], components[3])
+}
+
+func (c *tenantCodec) Encode(oURL string, opts encoding.SignOptions) (string, error) {
+	encURL, err := c.keyring.B64EncodeURL(oURL, opts)
+	return "/" + c.tenant + encURL, err
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	tenantRing, err := encoding.NewKeyring(encoding.Key{Secret: []byte("tenant-secret")})
+	assert.Nil(t, err)
+	pathRing, err := encoding.NewKeyring(encoding.Key{Secret: []byte("0x24FEEDFACEDEADBEEFCAFE")})
+	assert.Nil(t, err)
+	tenant := &tenantCodec{keyring: tenantRing, tenant: "acme"}
+
+	c := Config{
+		Codecs:         []encoding.Codec{tenant, &encoding.PathCodec{Keyring: pathRing}},
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(encURL string, status int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		_, err = processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+	}
+
+	encURL, err := tenant.Encode(ts.URL+"/image.png", encoding.SignOptions{})
+	assert.Nil(t, err)
+	f(encURL, 200)
+	// tenant urls signed with the wrong key
+	f("/acme"+encoding.B64EncodeURL(pathRing.Keys()[0].Secret, ts.URL+"/image.png"), 403)
+	// later codecs are tried when earlier ones don't recognise the format
+	f(encoding.B64EncodeURL(pathRing.Keys()[0].Secret, ts.URL+"/image.png"), 200)
+	f(encoding.B64EncodeURL(tenantRing.Keys()[0].Secret, ts.URL+"/image.png"), 403)
+	// no codec recognises the format
+	camoServer, err := New(c, nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	camoServer.ServeHTTP(record, httptest.NewRequest("GET", "http://example.com/acme", nil))
+	statusCodeAssert(t, 404, record.Result())
+}
+
+func TestEncryptedURL(t *testing.T) {
+	t.Parallel()
+
+	c := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(encURL string, status int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		resp, err := processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+		if status == 200 {
+			bodyAssert(t, "ok", resp)
+		}
+	}
+
+	encURL, err := encoding.B64EncryptURL(c.HMACKey, ts.URL+"/image.png", encoding.SignOptions{})
+	assert.Nil(t, err)
+	f(encURL, 200)
+
+	encURL, err = encoding.HexEncryptURL(c.HMACKey, ts.URL+"/image.png", encoding.SignOptions{})
+	assert.Nil(t, err)
+	f(encURL, 200)
+
+	encURL, err = encoding.B64EncryptURL([]byte("unknown"), ts.URL+"/image.png", encoding.SignOptions{})
+	assert.Nil(t, err)
+	f(encURL, 403)
+}
+
+func TestTokenURL(t *testing.T) {
+	t.Parallel()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	kr, err := encoding.NewKeyring(
+		encoding.Key{ID: "k1", Secret: []byte("0x24FEEDFACEDEADBEEFCAFE")},
+		encoding.Key{ID: "signer", PublicKey: pub},
+	)
+	assert.Nil(t, err)
+
+	c := Config{
+		Keyring:          kr,
+		AllowTokenFormat: true,
+		URLInfoFilters: []URLInfoFilterFunc{
+			func(u *url.URL, info *encoding.URLInfo) (bool, error) {
+				return info.Claims == nil || info.Claims.Tenant != "blocked", nil
+			},
+		},
+		AllowSignedContentVideo: true,
+		RequestTimeout:          time.Duration(10) * time.Second,
+		MaxRedirects:            3,
+		ServerName:              "go-camo",
+		noIPFiltering:           true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".mp4") {
+			w.Header().Set("Content-Type", "video/mp4")
+		} else {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(encURL string, status int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		resp, err := processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+		if status == 200 {
+			bodyAssert(t, "ok", resp)
+		}
+	}
+
+	encURL, err := kr.EncodeToken(encoding.TokenClaims{URL: ts.URL + "/image.png", Tenant: "acme"})
+	assert.Nil(t, err)
+	f(encURL, 200)
+	f(encURL+"/image.png", 200)
+
+	encURL, err = encoding.EdDSAEncodeToken(priv, "signer", encoding.TokenClaims{URL: ts.URL + "/image.png"})
+	assert.Nil(t, err)
+	f(encURL, 200)
+
+	// content claims
+	encURL, err = kr.EncodeToken(encoding.TokenClaims{URL: ts.URL + "/video.mp4", Content: "video"})
+	assert.Nil(t, err)
+	f(encURL, 200)
+	encURL, err = kr.EncodeToken(encoding.TokenClaims{URL: ts.URL + "/video.mp4"})
+	assert.Nil(t, err)
+	f(encURL, 400)
+
+	// expired
+	encURL, err = kr.EncodeToken(encoding.TokenClaims{
+		URL:     ts.URL + "/image.png",
+		Expires: time.Now().Add(-time.Minute).Unix(),
+	})
+	assert.Nil(t, err)
+	f(encURL, 410)
+
+	// rejected by a url info filter
+	encURL, err = kr.EncodeToken(encoding.TokenClaims{URL: ts.URL + "/image.png", Tenant: "blocked"})
+	assert.Nil(t, err)
+	f(encURL, 404)
+
+	// signed with an unknown key
+	encURL, err = encoding.HS256EncodeToken([]byte("unknown"), "", encoding.TokenClaims{URL: ts.URL + "/image.png"})
+	assert.Nil(t, err)
+	f(encURL, 403)
+
+	// not routed unless enabled
+	c.AllowTokenFormat = false
+	encURL, err = kr.EncodeToken(encoding.TokenClaims{URL: ts.URL + "/image.png"})
+	assert.Nil(t, err)
+	f(encURL, 404)
+}
+
+func TestURLValidity(t *testing.T) {
+	t.Parallel()
+
+	c := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(opts encoding.SignOptions, status int, body string) {
+		t.Helper()
+		encURL, err := encoding.B64EncodeURLWithOptions(c.HMACKey, ts.URL, opts)
+		assert.Nil(t, err)
+		req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+		assert.Nil(t, err)
+		resp, err := processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+		bodyAssert(t, body, resp)
+	}
+
+	now := time.Now()
+	f(encoding.SignOptions{Expires: now.Add(time.Hour)}, 200, "ok")
+	f(encoding.SignOptions{NotBefore: now.Add(-time.Hour), Expires: now.Add(time.Hour)}, 200, "ok")
+	f(encoding.SignOptions{Expires: now.Add(-time.Hour)}, 410, "Expired URL\n")
+	f(encoding.SignOptions{NotBefore: now.Add(time.Hour)}, 403, "URL not yet valid\n")
+}
+
+func TestQueryFormat(t *testing.T) {
+	t.Parallel()
+
+	c := Config{
+		HMACKey:          []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout:   time.Duration(10) * time.Second,
+		MaxRedirects:     3,
+		ServerName:       "go-camo",
+		AllowQueryFormat: true,
+		noIPFiltering:    true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	encURL := encoding.HexEncodeQueryURL(c.HMACKey, ts.URL+"/some.png?a=b&c=d")
+	req, err := http.NewRequest("GET", "http://example.com"+encURL, nil)
+	assert.Nil(t, err)
+	resp, err := processRequest(req, 200, c, nil)
+	assert.Nil(t, err)
+	bodyAssert(t, "ok", resp)
+
+	// tampered url
+	req, err = http.NewRequest("GET", "http://example.com"+encURL+"%26e%3Df", nil)
+	assert.Nil(t, err)
+	_, err = processRequest(req, 403, c, nil)
+	assert.Nil(t, err)
+
+	// path format still works
+	req, err = makeReq(c, ts.URL)
+	assert.Nil(t, err)
+	_, err = processRequest(req, 200, c, nil)
+	assert.Nil(t, err)
+
+	// disabled by default
+	c.AllowQueryFormat = false
+	req, err = http.NewRequest("GET", "http://example.com"+encURL, nil)
+	assert.Nil(t, err)
+	_, err = processRequest(req, 404, c, nil)
+	assert.Nil(t, err)
+}
+
+func TestTrailingFilename(t *testing.T) {
+	t.Parallel()
+
+	c := Config{
+		HMACKey:        []byte("0x24FEEDFACEDEADBEEFCAFE"),
+		RequestTimeout: time.Duration(10) * time.Second,
+		MaxRedirects:   3,
+		ServerName:     "go-camo",
+		noIPFiltering:  true,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	f := func(suffix string, status int) {
+		t.Helper()
+		encURL := encoding.B64EncodeURL(c.HMACKey, ts.URL+"/photo.png")
+		req, err := http.NewRequest("GET", "http://example.com"+encURL+suffix, nil)
+		assert.Nil(t, err)
+		_, err = processRequest(req, status, c, nil)
+		assert.Nil(t, err)
+	}
+
+	f("", 200)
+	f("/photo.png", 200)
+	// trailing segment is not signed
+	f("/anything.jpg", 200)
+	f("/", 404)
+	f("/a/b.png", 404)
+}
+
 func TestVideoContentTypeAllowed(t *testing.T) {
 	t.Parallel()
 
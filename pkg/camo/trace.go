@@ -0,0 +1,68 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"net/http"
+)
+
+// A Trace is a set of hooks called as a request is proxied, for debugging
+// what the proxy does with a request. Any hook may be nil.
+type Trace struct {
+	// OutboundRequest is called with each request to upstream, after the
+	// headers are set and before it is sent. Followed redirects call it
+	// again with the redirected request.
+	OutboundRequest func(req *http.Request)
+	// UpstreamResponse is called with the upstream response (after any
+	// redirects are followed), before the body is read.
+	UpstreamResponse func(resp *http.Response)
+	// UpstreamError is called if the upstream request fails (eg. a
+	// connection error, a rejected ip, or a bad redirect).
+	UpstreamError func(err error)
+	// ContentType is called with the upstream response content type, and the
+	// content type sent to the client. The client content type is empty if
+	// the upstream content type was rejected.
+	ContentType func(upstream string, client string)
+}
+
+// traceKey is the context key for the *Trace of a proxied request.
+type traceKey struct{}
+
+// WithTrace returns a new context, based on ctx, that calls the trace hooks
+// when a request with the context is proxied.
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// contextTrace returns the trace of the context, or nil if there is none.
+func contextTrace(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+func (t *Trace) outboundRequest(req *http.Request) {
+	if t != nil && t.OutboundRequest != nil {
+		t.OutboundRequest(req)
+	}
+}
+
+func (t *Trace) upstreamResponse(resp *http.Response) {
+	if t != nil && t.UpstreamResponse != nil {
+		t.UpstreamResponse(resp)
+	}
+}
+
+func (t *Trace) upstreamError(err error) {
+	if t != nil && t.UpstreamError != nil {
+		t.UpstreamError(err)
+	}
+}
+
+func (t *Trace) contentType(upstream string, client string) {
+	if t != nil && t.ContentType != nil {
+		t.ContentType(upstream, client)
+	}
+}
@@ -16,6 +16,7 @@ var (
 	ErrRejectIP        = errors.New("ip rejection")
 	ErrInvalidHostPort = errors.New("invalid host/port")
 	ErrInvalidNetType  = errors.New("invalid network type")
+	ErrSignedOptions   = errors.New("signed url options not permitted")
 )
 
 // ValidReqHeaders are http request headers that are acceptable to pass from
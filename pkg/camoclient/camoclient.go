@@ -0,0 +1,232 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package camoclient provides building and verifying of signed go-camo urls,
+// for services that generate them.
+//
+// A Client is configured with the go-camo server url, the signing key(s),
+// and the url encoding, along with the policy for which urls are proxied:
+//
+//	client, err := camoclient.New(camoclient.Config{
+//		BaseURL:          "https://img.example.org",
+//		HMACKey:          []byte("test"),
+//		Encoding:         "base64",
+//		PassthroughHTTPS: true,
+//	})
+//	...
+//	camoURL, err := client.URL("http://golang.org/doc/gopher/frontpage.png")
+//
+// The package does not depend on the server side pkg/camo.
+package camoclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+	"github.com/cactus/go-camo/v2/pkg/rewrite"
+)
+
+// Config holds configuration data used when creating a Client with New.
+type Config struct {
+	// BaseURL is the go-camo server url that signed url paths are appended
+	// to (eg. https://img.example.org).
+	BaseURL string
+	// Encoding is the name of the url format used for generated urls:
+	// "hex" (the default), "base64", "query", "token", or any other codec
+	// registered with encoding.RegisterCodec.
+	Encoding string
+	// HMACKey is the key urls are signed (and verified) with.
+	// Ignored if Keyring is set.
+	HMACKey []byte
+	// Keyring is the set of keys used. Urls are signed with the first key,
+	// and verified with any key.
+	Keyring *encoding.Keyring
+	// Options are the signing options (eg. algorithm, max size, content
+	// classes) used for generated urls. The key id is set from the keyring.
+	Options encoding.SignOptions
+	// ExcludeHosts are hosts whose urls are left as they are. A leading
+	// "*." matches any subdomain (eg. *.example.org).
+	ExcludeHosts []string
+	// TTL, if non-zero, is the lifetime of generated urls. Each url expires
+	// TTL after it is generated.
+	TTL time.Duration
+	// AppendFilename appends the origin url filename to generated urls, as
+	// an unsigned trailing path segment. Only the path ("hex" and "base64")
+	// and "token" formats have a trailing path segment, so it is ignored for
+	// other formats.
+	AppendFilename bool
+	// PassthroughHTTPS leaves https urls as they are, rather than proxying
+	// them.
+	PassthroughHTTPS bool
+}
+
+// A Client builds and verifies signed go-camo urls.
+type Client struct {
+	codec          encoding.Codec
+	verifiers      []encoding.Codec
+	rewriter       *rewrite.Rewriter
+	baseURL        string
+	opts           encoding.SignOptions
+	ttl            time.Duration
+	appendFilename bool
+}
+
+// New returns a new Client.
+func New(config Config) (*Client, error) {
+	keyring := config.Keyring
+	if keyring == nil {
+		if len(config.HMACKey) == 0 {
+			return nil, errors.New("HMAC key or keyring required")
+		}
+		var err error
+		keyring, err = encoding.NewKeyring(encoding.Key{Secret: config.HMACKey})
+		if err != nil {
+			return nil, fmt.Errorf("invalid hmac key: %w", err)
+		}
+	}
+	if config.TTL < 0 {
+		return nil, errors.New("ttl must be positive")
+	}
+
+	name := config.Encoding
+	if name == "" {
+		name = "hex"
+	}
+	codec, err := encoding.NewCodec(name, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		codec: codec,
+		// token urls go first, as they may have the same number of path
+		// components as the path format (with a trailing filename)
+		verifiers: []encoding.Codec{
+			&encoding.TokenCodec{Keyring: keyring},
+			&encoding.PathCodec{Keyring: keyring},
+			&encoding.QueryCodec{Keyring: keyring},
+		},
+		baseURL: strings.TrimRight(config.BaseURL, "/"),
+		opts:    config.Options,
+		ttl:     config.TTL,
+	}
+	switch codec.(type) {
+	case *encoding.PathCodec, *encoding.TokenCodec:
+		c.appendFilename = config.AppendFilename
+	}
+
+	c.rewriter, err = rewrite.New(rewrite.Config{
+		Encoder: func(oURL string) (string, error) {
+			return c.encode(oURL, c.options())
+		},
+		Prefix:           c.baseURL,
+		ExcludeHosts:     config.ExcludeHosts,
+		PassthroughHTTPS: config.PassthroughHTTPS,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// options returns the signing options for a url generated now
+func (c *Client) options() encoding.SignOptions {
+	opts := c.opts
+	if c.ttl > 0 {
+		opts.Expires = time.Now().Add(c.ttl)
+	}
+	return opts
+}
+
+// encode returns the signed url path partial for the url
+func (c *Client) encode(oURL string, opts encoding.SignOptions) (string, error) {
+	if oURL == "" {
+		return "", errors.New("empty url")
+	}
+	encURL, err := c.codec.Encode(oURL, opts)
+	if err != nil {
+		return "", err
+	}
+	if c.appendFilename {
+		encURL += encoding.FilenameSegment(oURL)
+	}
+	return encURL, nil
+}
+
+// URL returns the signed go-camo url for the url, or the url as it is if
+// the policy leaves it unproxied (https passthrough and excluded hosts), or
+// if it can't be proxied (eg. relative urls, and data: urls).
+func (c *Client) URL(oURL string) (string, error) {
+	return c.rewriter.URL(oURL)
+}
+
+// SignURL returns the signed go-camo url for the url, signed with opts
+// (rather than the configured options), regardless of the policy.
+func (c *Client) SignURL(oURL string, opts encoding.SignOptions) (string, error) {
+	encURL, err := c.encode(oURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return c.baseURL + encURL, nil
+}
+
+// URLs returns the go-camo urls for each of the urls, as for URL.
+func (c *Client) URLs(oURLs []string) ([]string, error) {
+	out := make([]string, 0, len(oURLs))
+	for _, oURL := range oURLs {
+		camoURL, err := c.URL(oURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not sign %q: %w", oURL, err)
+		}
+		out = append(out, camoURL)
+	}
+	return out, nil
+}
+
+// HTML reads an HTML document (or fragment) from in, and writes it to out
+// with image and media urls rewritten, as for URL. See rewrite.Rewriter.
+func (c *Client) HTML(out io.Writer, in io.Reader) error {
+	return c.rewriter.HTML(out, in)
+}
+
+// Markdown reads a CommonMark document from in, and writes it to out with
+// image urls rewritten, as for URL. See rewrite.Rewriter.
+func (c *Client) Markdown(out io.Writer, in io.Reader) error {
+	return c.rewriter.Markdown(out, in)
+}
+
+// Verify verifies a signed go-camo url (or url path), in any of the
+// go-camo url formats, and returns the origin url details. Returns an error
+// if the url is not validly signed with one of the keys, or is outside of
+// its signed validity period.
+func (c *Client) Verify(camoURL string) (*encoding.URLInfo, error) {
+	// the base url may have a path of its own
+	if c.baseURL != "" {
+		camoURL = strings.TrimPrefix(camoURL, c.baseURL)
+	}
+	u, err := url.Parse(camoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+
+	for _, codec := range c.verifiers {
+		info, err := codec.Decode(u)
+		if errors.Is(err, encoding.ErrUnknownFormat) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := info.CheckTime(time.Now()); err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+	return nil, encoding.ErrUnknownFormat
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camoclient
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+const (
+	testURL    = "http://golang.org/doc/gopher/frontpage.png"
+	testHexURL = "/0f6def1cb147b0e84f39cbddc5ea10c80253a6f3/687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67"
+	testB64URL = "/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{})
+	assert.NotNil(t, err)
+
+	_, err = New(Config{HMACKey: []byte("test"), Encoding: "bogus"})
+	assert.NotNil(t, err)
+
+	_, err = New(Config{HMACKey: []byte("test"), TTL: -time.Second})
+	assert.NotNil(t, err)
+}
+
+func TestURL(t *testing.T) {
+	t.Parallel()
+
+	client, err := New(Config{BaseURL: "https://img.example.org/", HMACKey: []byte("test")})
+	assert.Nil(t, err)
+
+	camoURL, err := client.URL(testURL)
+	assert.Nil(t, err)
+	assert.Equal(t, camoURL, "https://img.example.org"+testHexURL)
+
+	client, err = New(Config{
+		BaseURL:          "https://img.example.org",
+		HMACKey:          []byte("test"),
+		Encoding:         "base64",
+		ExcludeHosts:     []string{"*.example.net"},
+		PassthroughHTTPS: true,
+	})
+	assert.Nil(t, err)
+
+	f := func(oURL string, expected string) {
+		t.Helper()
+		camoURL, err := client.URL(oURL)
+		assert.Nil(t, err)
+		assert.Equal(t, camoURL, expected, oURL)
+	}
+
+	f(testURL, "https://img.example.org"+testB64URL)
+	// already proxied
+	f("https://img.example.org"+testB64URL, "https://img.example.org"+testB64URL)
+	// https passthrough
+	f("https://golang.org/doc/gopher/frontpage.png", "https://golang.org/doc/gopher/frontpage.png")
+	// excluded
+	f("http://img.example.net/a.png", "http://img.example.net/a.png")
+	// can't be proxied
+	f("/images/a.png", "/images/a.png")
+	f("data:image/png;base64,iVBORw0KGgo=", "data:image/png;base64,iVBORw0KGgo=")
+
+	camoURLs, err := client.URLs([]string{testURL, "/images/a.png"})
+	assert.Nil(t, err)
+	assert.Equal(t, camoURLs, []string{"https://img.example.org" + testB64URL, "/images/a.png"})
+
+	// sign regardless of the policy
+	camoURL, err = client.SignURL("https://golang.org/a.png", encoding.SignOptions{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(camoURL, "https://img.example.org/"), "expected a signed url")
+
+	_, err = client.SignURL("", encoding.SignOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestURLOptions(t *testing.T) {
+	t.Parallel()
+
+	keyring, err := encoding.NewKeyring(
+		encoding.Key{ID: "k2", Secret: []byte("new")},
+		encoding.Key{ID: "k1", Secret: []byte("test")},
+	)
+	assert.Nil(t, err)
+
+	for _, name := range []string{"hex", "base64", "query", "token"} {
+		client, err := New(Config{
+			BaseURL:        "https://img.example.org/camo",
+			Keyring:        keyring,
+			Encoding:       name,
+			Options:        encoding.SignOptions{Algorithm: encoding.SHA256, ContentClasses: encoding.ContentVideo},
+			TTL:            time.Hour,
+			AppendFilename: true,
+		})
+		assert.Nil(t, err)
+
+		camoURL, err := client.URL(testURL)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(camoURL, "https://img.example.org/camo/"), name)
+		// the query format has no trailing path segment
+		assert.Equal(t, strings.HasSuffix(camoURL, "/frontpage.png"), name != "query", name)
+
+		info, err := client.Verify(camoURL)
+		assert.Nil(t, err, name)
+		assert.Equal(t, info.URL, testURL, name)
+		assert.Equal(t, info.KeyID, "k2", name)
+		assert.Equal(t, info.ContentClasses, encoding.ContentVideo, name)
+		assert.False(t, info.Expires.IsZero(), name)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	client, err := New(Config{BaseURL: "https://img.example.org", HMACKey: []byte("test")})
+	assert.Nil(t, err)
+
+	for _, camoURL := range []string{testHexURL, testB64URL, "https://img.example.org" + testHexURL} {
+		info, err := client.Verify(camoURL)
+		assert.Nil(t, err, camoURL)
+		assert.Equal(t, info.URL, testURL, camoURL)
+	}
+
+	_, err = client.Verify("/favicon.ico")
+	assert.True(t, errors.Is(err, encoding.ErrUnknownFormat), "expected unknown format")
+
+	// a different key
+	other, err := New(Config{HMACKey: []byte("other")})
+	assert.Nil(t, err)
+	_, err = other.Verify(testHexURL)
+	assert.NotNil(t, err)
+
+	// expired
+	camoURL, err := client.SignURL(testURL, encoding.SignOptions{Expires: time.Now().Add(-time.Minute)})
+	assert.Nil(t, err)
+	_, err = client.Verify(camoURL)
+	assert.True(t, errors.Is(err, encoding.ErrExpired), "expected expired")
+}
+
+func TestRewrite(t *testing.T) {
+	t.Parallel()
+
+	client, err := New(Config{BaseURL: "https://img.example.org", HMACKey: []byte("test"), Encoding: "base64"})
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	err = client.HTML(&out, strings.NewReader(`<p><img src="`+testURL+`"></p>`))
+	assert.Nil(t, err)
+	assert.Equal(t, out.String(), `<p><img src="https://img.example.org`+testB64URL+`"></p>`)
+
+	out.Reset()
+	err = client.Markdown(&out, strings.NewReader("![gopher]("+testURL+")\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, out.String(), "![gopher](https://img.example.org"+testB64URL+")\n")
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// aeadKeyInfo is the hkdf info string used to derive url encryption keys,
+// so the encryption key differs from the hmac key it is derived from.
+const aeadKeyInfo = "go-camo url encryption"
+
+// aeadKey derives the XChaCha20-Poly1305 key from an hmac key.
+func aeadKey(secret []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, nil, aeadKeyInfo, chacha20poly1305.KeySize)
+}
+
+// sealURL encrypts the url with a key derived from the hmac key, using the
+// digest prefix as additional data. Returns the prefix, the nonce and
+// ciphertext, and the authentication tag.
+func sealURL(hmacKey []byte, oURL string, opts SignOptions) (string, []byte, []byte, error) {
+	opts.Algorithm = XChaCha20Poly1305
+	prefix := opts.digestPrefix()
+
+	key, err := aeadKey(hmacKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(oURL)+aead.Overhead())
+	_, _ = rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, []byte(oURL), []byte(prefix))
+	split := len(sealed) - aead.Overhead()
+	return prefix, sealed[:split], sealed[split:], nil
+}
+
+// openURL tries to decrypt the url data with each candidate key in the
+// keyring, returning the index of the key that opened it, and the url.
+func openURL(kr *Keyring, dig *digest, tag []byte, data []byte) (int, []byte, error) {
+	idxs, err := kr.candidates(dig)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	if len(data) < chacha20poly1305.NonceSizeX {
+		return -1, nil, fmt.Errorf("short ciphertext")
+	}
+	nonce, ciphertext := data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:]
+	sealed := append(ciphertext[:len(ciphertext):len(ciphertext)], tag...)
+
+	for _, i := range idxs {
+		key, err := aeadKey(kr.keys[i].Secret)
+		if err != nil {
+			continue
+		}
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			continue
+		}
+		urlBytes, err := aead.Open(nil, nonce, sealed, []byte(dig.prefix))
+		if err == nil {
+			return i, urlBytes, nil
+		}
+	}
+	return -1, nil, fmt.Errorf("decryption failed")
+}
+
+// HexEncryptURL takes an HMAC key, a url, and signing options, and returns
+// url path partial consisitent of authentication tag and hex encoded
+// encrypted url. The url is encrypted with XChaCha20-Poly1305, using a key
+// derived from the HMAC key, so it can't be read from the signed url.
+// The Algorithm in opts is ignored.
+func HexEncryptURL(hmacKey []byte, oURL string, opts SignOptions) (string, error) {
+	prefix, data, tag, err := sealURL(hmacKey, oURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return "/" + prefix + hex.EncodeToString(tag) + "/" + hex.EncodeToString(data), nil
+}
+
+// B64EncryptURL takes an HMAC key, a url, and signing options, and returns
+// url path partial consisitent of authentication tag and base64 encoded
+// encrypted url. See HexEncryptURL.
+func B64EncryptURL(hmacKey []byte, oURL string, opts SignOptions) (string, error) {
+	prefix, data, tag, err := sealURL(hmacKey, oURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return "/" + prefix + b64encode(tag) + "/" + b64encode(data), nil
+}
+
+// HexEncryptURL encrypts the url with the keyring signing key, and returns
+// url path partial consisitent of authentication tag and hex encoded
+// encrypted url.
+func (kr *Keyring) HexEncryptURL(oURL string, opts SignOptions) (string, error) {
+	key, opts, err := kr.signOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	return HexEncryptURL(key.Secret, oURL, opts)
+}
+
+// B64EncryptURL encrypts the url with the keyring signing key, and returns
+// url path partial consisitent of authentication tag and base64 encoded
+// encrypted url.
+func (kr *Keyring) B64EncryptURL(oURL string, opts SignOptions) (string, error) {
+	key, opts, err := kr.signOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	return B64EncryptURL(key.Secret, oURL, opts)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+
+	for _, encrypter := range []func([]byte, string, SignOptions) (string, error){HexEncryptURL, B64EncryptURL} {
+		encodedURL, err := encrypter(hmacKey, sURL, SignOptions{Algorithm: SHA256})
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(encodedURL, "/xchacha20-poly1305."), "missing algorithm in digest")
+		assert.False(t, strings.Contains(encodedURL, "golang"), "url not encrypted")
+
+		comp := strings.Split(encodedURL, "/")
+		assert.Equal(t, len(comp), 3)
+
+		info, err := DecodeURLWithInfo(hmacKey, comp[1], comp[2])
+		assert.Nil(t, err)
+		assert.Equal(t, info.URL, sURL)
+		assert.Equal(t, info.Algorithm, XChaCha20Poly1305)
+
+		// legacy decode function works too
+		decURL, ok := DecodeURL(hmacKey, comp[1], comp[2])
+		assert.True(t, ok, "decode failed")
+		assert.Equal(t, decURL, sURL)
+
+		// wrong key
+		_, err = DecodeURLWithInfo([]byte("test2"), comp[1], comp[2])
+		assert.NotNil(t, err)
+	}
+
+	// nonces are random, so urls differ each time
+	url1, err := B64EncryptURL(hmacKey, sURL, SignOptions{})
+	assert.Nil(t, err)
+	url2, err := B64EncryptURL(hmacKey, sURL, SignOptions{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, url1, url2)
+}
+
+func TestEncryptTampering(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	encodedURL, err := B64EncryptURL(hmacKey, sURL, SignOptions{Expires: expires})
+	assert.Nil(t, err)
+	comp := strings.Split(encodedURL, "/")
+
+	info, err := DecodeURLWithInfo(hmacKey, comp[1], comp[2])
+	assert.Nil(t, err)
+	assert.Equal(t, info.Expires, expires)
+
+	// digest fields are authenticated
+	later := strings.Replace(comp[1], "e=", "e=1", 1)
+	_, err = DecodeURLWithInfo(hmacKey, later, comp[2])
+	assert.NotNil(t, err)
+
+	// ciphertext is authenticated
+	data, err := b64decode(comp[2])
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0x01
+	_, err = DecodeURLWithInfo(hmacKey, comp[1], b64encode(data))
+	assert.NotNil(t, err)
+
+	// short data
+	_, err = DecodeURLWithInfo(hmacKey, comp[1], b64encode(data[:10]))
+	assert.NotNil(t, err)
+
+	// encrypted digests can't be used with the query string format
+	kr, err := NewKeyring(Key{Secret: hmacKey})
+	assert.Nil(t, err)
+	hexURL, err := kr.HexEncryptURL(sURL, SignOptions{})
+	assert.Nil(t, err)
+	_, err = kr.DecodeQueryURL(strings.Split(hexURL, "/")[1], sURL)
+	assert.NotNil(t, err)
+}
+
+func TestEncryptKeyring(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	oldKey := Key{ID: "old", Secret: []byte("test")}
+	newKey := Key{ID: "new", Secret: []byte("test2")}
+	oldRing, err := NewKeyring(oldKey)
+	assert.Nil(t, err)
+	newRing, err := NewKeyring(newKey, oldKey)
+	assert.Nil(t, err)
+
+	encodedURL, err := oldRing.B64EncryptURL(sURL, SignOptions{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(encodedURL, "/xchacha20-poly1305.k=old."), "missing key id in digest")
+
+	comp := strings.Split(encodedURL, "/")
+	info, err := newRing.DecodeURL(comp[1], comp[2])
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+	assert.Equal(t, info.KeyIndex, 1)
+
+	// without a key id, each key is tried
+	encodedURL, err = B64EncryptURL(oldKey.Secret, sURL, SignOptions{})
+	assert.Nil(t, err)
+	comp = strings.Split(encodedURL, "/")
+	info, err = newRing.DecodeURL(comp[1], comp[2])
+	assert.Nil(t, err)
+	assert.Equal(t, info.KeyID, "old")
+}
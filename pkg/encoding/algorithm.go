@@ -0,0 +1,141 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1" // #nosec G505 -- used for hmac only
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Algorithm is a url signature algorithm.
+//
+// Use Meets, rather than the order of the values, to check an algorithm
+// against a minimum algorithm.
+type Algorithm uint8
+
+const (
+	// SHA1 is HMAC-SHA1. This is the original go-camo (and camo) signature
+	// algorithm, and is assumed for any digest without an algorithm prefix.
+	SHA1 Algorithm = iota + 1
+	// SHA256 is HMAC-SHA256.
+	SHA256
+	// SHA512_256 is HMAC-SHA-512/256.
+	SHA512_256
+	// XChaCha20Poly1305 is XChaCha20-Poly1305 authenticated encryption of
+	// the url, with a key derived from the HMAC key. The digest holds the
+	// authentication tag, in place of a mac.
+	XChaCha20Poly1305
+	// Ed25519 is an Ed25519 (asymmetric) signature. Urls are signed with a
+	// private key, and verified with the matching public key.
+	Ed25519
+)
+
+var algorithmNames = map[Algorithm]string{
+	SHA1:              "sha1",
+	SHA256:            "sha256",
+	SHA512_256:        "sha512-256",
+	XChaCha20Poly1305: "xchacha20-poly1305",
+	Ed25519:           "ed25519",
+}
+
+// String returns the name of the algorithm, as used in a digest prefix.
+func (a Algorithm) String() string {
+	if name, ok := algorithmNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Algorithm(%d)", a)
+}
+
+// algorithmStrength ranks the algorithms, for checking an algorithm against
+// a minimum algorithm. The HMAC algorithms rank by hash function. Encrypted
+// and Ed25519 urls have no HMAC, and rank with the strongest HMAC, so they
+// meet any minimum.
+var algorithmStrength = map[Algorithm]int{
+	SHA1:              1,
+	SHA256:            2,
+	SHA512_256:        3,
+	XChaCha20Poly1305: 3,
+	Ed25519:           3,
+}
+
+// Meets reports whether the algorithm is at least as strong as the minimum
+// algorithm. A zero minimum is met by any algorithm.
+func (a Algorithm) Meets(minimum Algorithm) bool {
+	return algorithmStrength[a] >= algorithmStrength[minimum]
+}
+
+// IsHMAC reports whether the algorithm is an HMAC algorithm, which signs
+// urls with the (secret) HMAC key.
+func (a Algorithm) IsHMAC() bool {
+	switch a {
+	case SHA1, SHA256, SHA512_256:
+		return true
+	}
+	return false
+}
+
+// ParseMinAlgorithm returns the Algorithm with the given name, for use as a
+// minimum algorithm (see Meets). Only the HMAC algorithms can be minimums,
+// as the other algorithms are not comparable with each other.
+func ParseMinAlgorithm(name string) (Algorithm, error) {
+	alg, err := ParseAlgorithm(name)
+	if err != nil {
+		return 0, err
+	}
+	if !alg.IsHMAC() {
+		return 0, fmt.Errorf("not an hmac algorithm: %q", name)
+	}
+	return alg, nil
+}
+
+// ParseAlgorithm returns the Algorithm with the given name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for alg, algName := range algorithmNames {
+		if name == algName {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm: %q", name)
+}
+
+// isSymmetric reports whether the algorithm uses the (secret) HMAC key.
+func (a Algorithm) isSymmetric() bool {
+	return a != Ed25519
+}
+
+// hash returns the hash constructor used for the algorithm's hmac.
+func (a Algorithm) hash() func() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New
+	case SHA512_256:
+		return sha512.New512_256
+	default:
+		return sha1.New
+	}
+}
+
+// size returns the size, in bytes, of a mac (or signature) generated with
+// the algorithm.
+func (a Algorithm) size() int {
+	switch a {
+	case Ed25519:
+		return ed25519.SignatureSize
+	case XChaCha20Poly1305:
+		return chacha20poly1305.Overhead
+	case SHA256:
+		return sha256.Size
+	case SHA512_256:
+		return sha512.Size256
+	default:
+		return sha1.Size
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownFormat is returned by a Codec when a url is not in its format,
+// so the next codec (if any) should be tried.
+var ErrUnknownFormat = errors.New("unknown url format")
+
+// A Codec encodes and decodes signed urls in a particular format.
+type Codec interface {
+	// Name returns the name of the codec.
+	Name() string
+	// Decode verifies the signed url, and returns a URLInfo for the origin
+	// url. Only the path and query of the url are used. Returns an error
+	// wrapping ErrUnknownFormat if the url is not in the codec's format, or
+	// any other error if it is, but can't be verified.
+	Decode(u *url.URL) (*URLInfo, error)
+	// Encode signs the origin url, and returns the url path partial (and
+	// query, if any) in the codec's format.
+	Encode(oURL string, opts SignOptions) (string, error)
+}
+
+// A CodecFactory returns a Codec using the supplied keyring.
+type CodecFactory func(kr *Keyring) (Codec, error)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]CodecFactory{}
+)
+
+// RegisterCodec makes a codec available by name, for use with NewCodec.
+// Registering a name twice, or a nil factory, panics.
+func RegisterCodec(name string, factory CodecFactory) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if factory == nil {
+		panic("encoding: RegisterCodec factory is nil")
+	}
+	if _, ok := codecs[name]; ok {
+		panic("encoding: RegisterCodec called twice for codec " + name)
+	}
+	codecs[name] = factory
+}
+
+// NewCodec returns a new Codec of the named (registered) type, using the
+// supplied keyring.
+func NewCodec(name string, kr *Keyring) (Codec, error) {
+	codecsMu.RLock()
+	factory, ok := codecs[name]
+	codecsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %q", name)
+	}
+	return factory(kr)
+}
+
+// Codecs returns the sorted names of the registered codecs.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func init() {
+	RegisterCodec("hex", func(kr *Keyring) (Codec, error) {
+		return &PathCodec{Keyring: kr}, nil
+	})
+	RegisterCodec("base64", func(kr *Keyring) (Codec, error) {
+		return &PathCodec{Keyring: kr, Base64: true}, nil
+	})
+	RegisterCodec("query", func(kr *Keyring) (Codec, error) {
+		return &QueryCodec{Keyring: kr}, nil
+	})
+	RegisterCodec("token", func(kr *Keyring) (Codec, error) {
+		return &TokenCodec{Keyring: kr}, nil
+	})
+}
+
+// PathCodec is the go-camo path url format:
+//
+//	/<digest>/<encoded-url>[/<filename>]
+//
+// Urls are decoded from either hex or base64, but are encoded as hex
+// unless Base64 is set.
+type PathCodec struct {
+	Keyring *Keyring
+	Base64  bool
+}
+
+// Name returns the name of the codec.
+func (c *PathCodec) Name() string {
+	if c.Base64 {
+		return "base64"
+	}
+	return "hex"
+}
+
+// Decode verifies a path format url.
+func (c *PathCodec) Decode(u *url.URL) (*URLInfo, error) {
+	// /<digest>/<encoded-url>, with an optional unsigned trailing
+	// /<filename> segment
+	components := strings.Split(u.Path, "/")
+	if len(components) < 3 || len(components) > 4 {
+		return nil, ErrUnknownFormat
+	}
+	return c.Keyring.DecodeURL(components[1], components[2])
+}
+
+// Encode signs a url in the path format.
+func (c *PathCodec) Encode(oURL string, opts SignOptions) (string, error) {
+	if c.Base64 {
+		return c.Keyring.B64EncodeURL(oURL, opts)
+	}
+	return c.Keyring.HexEncodeURL(oURL, opts)
+}
+
+// QueryCodec is the original camo query string url format:
+//
+//	/<hex-digest>?url=<escaped-url>
+type QueryCodec struct {
+	Keyring *Keyring
+}
+
+// Name returns the name of the codec.
+func (c *QueryCodec) Name() string {
+	return "query"
+}
+
+// Decode verifies a query string format url.
+func (c *QueryCodec) Decode(u *url.URL) (*URLInfo, error) {
+	components := strings.Split(u.Path, "/")
+	query := u.Query()
+	if len(components) != 2 || !query.Has("url") {
+		return nil, ErrUnknownFormat
+	}
+	return c.Keyring.DecodeQueryURL(components[1], query.Get("url"))
+}
+
+// Encode signs a url in the query string format.
+func (c *QueryCodec) Encode(oURL string, opts SignOptions) (string, error) {
+	return c.Keyring.HexEncodeQueryURL(oURL, opts)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+// tenantCodec is a tenant prefixed path format, with a keyring per tenant:
+// /<tenant>/<digest>/<encoded-url>
+type tenantCodec struct {
+	tenants map[string]*Keyring
+	tenant  string
+}
+
+func (c *tenantCodec) Name() string {
+	return "tenant"
+}
+
+func (c *tenantCodec) Decode(u *url.URL) (*URLInfo, error) {
+	components := strings.Split(u.Path, "/")
+	if len(components) != 4 {
+		return nil, ErrUnknownFormat
+	}
+	kr, ok := c.tenants[components[1]]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return kr.DecodeURL(components[2], components[3])
+}
+
+func (c *tenantCodec) Encode(oURL string, opts SignOptions) (string, error) {
+	encURL, err := c.tenants[c.tenant].B64EncodeURL(oURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return "/" + c.tenant + encURL, nil
+}
+
+func TestCodecRegistry(t *testing.T) {
+	t.Parallel()
+
+	kr, err := NewKeyring(Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+
+	for _, name := range []string{"hex", "base64", "query", "token"} {
+		codec, err := NewCodec(name, kr)
+		assert.Nil(t, err)
+		assert.Equal(t, codec.Name(), name)
+	}
+
+	_, err = NewCodec("unknown", kr)
+	assert.NotNil(t, err)
+
+	assert.True(t, len(Codecs()) >= 4, "missing builtin codecs")
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	kr, err := NewKeyring(Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+
+	f := func(codec Codec, encURL string, want string) {
+		t.Helper()
+		u, err := url.Parse("http://example.com" + encURL)
+		assert.Nil(t, err)
+		info, err := codec.Decode(u)
+		assert.Nil(t, err)
+		assert.Equal(t, info.URL, want)
+	}
+
+	hexCodec := &PathCodec{Keyring: kr}
+	b64Codec := &PathCodec{Keyring: kr, Base64: true}
+	queryCodec := &QueryCodec{Keyring: kr}
+
+	encURL, err := hexCodec.Encode(sURL, SignOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, encURL, "/0f6def1cb147b0e84f39cbddc5ea10c80253a6f3/687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67")
+	f(hexCodec, encURL, sURL)
+	// path codecs decode either base
+	f(b64Codec, encURL, sURL)
+	f(hexCodec, encURL+"/frontpage.png", sURL)
+
+	encURL, err = b64Codec.Encode(sURL, SignOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, encURL, "/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n")
+	f(hexCodec, encURL, sURL)
+
+	encURL, err = queryCodec.Encode(sURL, SignOptions{})
+	assert.Nil(t, err)
+	f(queryCodec, encURL, sURL)
+
+	// formats a codec doesn't handle are unknown, rather than bad
+	for _, tc := range []struct {
+		codec  Codec
+		encURL string
+	}{
+		{hexCodec, "/0f6def1cb147b0e84f39cbddc5ea10c80253a6f3?url=" + url.QueryEscape(sURL)},
+		{hexCodec, "/a/b/c/d"},
+		{queryCodec, "/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n"},
+		{queryCodec, "/0f6def1cb147b0e84f39cbddc5ea10c80253a6f3"},
+	} {
+		u, err := url.Parse("http://example.com" + tc.encURL)
+		assert.Nil(t, err)
+		_, err = tc.codec.Decode(u)
+		assert.Error(t, err, ErrUnknownFormat)
+	}
+
+	// bad signatures in a known format are not
+	u, err := url.Parse("http://example.com/0f6def1cb147b0e84f39cbddc5ea10c80253a6f4/687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67")
+	assert.Nil(t, err)
+	_, err = hexCodec.Decode(u)
+	assert.NotNil(t, err)
+	assert.False(t, err == ErrUnknownFormat, "bad signature reported as unknown format")
+}
+
+func TestCustomCodec(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	acme, err := NewKeyring(Key{Secret: []byte("acme-secret")})
+	assert.Nil(t, err)
+	globex, err := NewKeyring(Key{Secret: []byte("globex-secret")})
+	assert.Nil(t, err)
+
+	codec := &tenantCodec{
+		tenants: map[string]*Keyring{"acme": acme, "globex": globex},
+		tenant:  "acme",
+	}
+
+	encURL, err := codec.Encode(sURL, SignOptions{Algorithm: SHA256})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(encURL, "/acme/sha256."), "missing tenant prefix")
+
+	u, err := url.Parse("http://example.com" + encURL)
+	assert.Nil(t, err)
+	info, err := codec.Decode(u)
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+
+	// signed for one tenant, but presented as another
+	u.Path = strings.Replace(u.Path, "/acme/", "/globex/", 1)
+	_, err = codec.Decode(u)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ParseEd25519PublicKey parses an unpadded url-safe base64 encoded Ed25519
+// public key.
+func ParseEd25519PublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := b64decode(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("bad public key encoding: %s", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad public key size: %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// ParseEd25519Key parses an Ed25519 public key with an optional key id, in
+// the format '[<key-id>:]<base64-public-key>', and returns a verification
+// Key.
+func ParseEd25519Key(s string) (Key, error) {
+	id, pub, ok := strings.Cut(s, ":")
+	if !ok {
+		id, pub = "", s
+	}
+	pubKey, err := ParseEd25519PublicKey(pub)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, PublicKey: pubKey}, nil
+}
+
+// ParseEd25519PrivateKey parses an unpadded url-safe base64 encoded Ed25519
+// private key seed, and returns the private key.
+func ParseEd25519PrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := b64decode(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("bad private key encoding: %s", err)
+	}
+	if len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("bad private key size: %d", len(b))
+	}
+	return ed25519.NewKeyFromSeed(b), nil
+}
+
+// EncodeEd25519PublicKey returns the unpadded url-safe base64 encoding of
+// an Ed25519 public key, as accepted by ParseEd25519PublicKey.
+func EncodeEd25519PublicKey(pub ed25519.PublicKey) string {
+	return b64encode(pub)
+}
+
+// EncodeEd25519PrivateKey returns the unpadded url-safe base64 encoding of
+// an Ed25519 private key seed, as accepted by ParseEd25519PrivateKey.
+func EncodeEd25519PrivateKey(priv ed25519.PrivateKey) string {
+	return b64encode(priv.Seed())
+}
+
+func ed25519Sign(priv ed25519.PrivateKey, oURL string, opts SignOptions) (string, []byte) {
+	opts.Algorithm = Ed25519
+	prefix := opts.digestPrefix()
+	sig := ed25519.Sign(priv, append([]byte(prefix), oURL...))
+	return prefix, sig
+}
+
+// Ed25519HexEncodeURL takes an Ed25519 private key, a url, and signing
+// options, and returns url path partial consisitent of signature and hex
+// encoded url. The Algorithm in opts is ignored.
+func Ed25519HexEncodeURL(priv ed25519.PrivateKey, oURL string, opts SignOptions) string {
+	prefix, sig := ed25519Sign(priv, oURL, opts)
+	return "/" + prefix + hex.EncodeToString(sig) + "/" + hex.EncodeToString([]byte(oURL))
+}
+
+// Ed25519B64EncodeURL takes an Ed25519 private key, a url, and signing
+// options, and returns url path partial consisitent of signature and base64
+// encoded url. The Algorithm in opts is ignored.
+func Ed25519B64EncodeURL(priv ed25519.PrivateKey, oURL string, opts SignOptions) string {
+	prefix, sig := ed25519Sign(priv, oURL, opts)
+	return "/" + prefix + b64encode(sig) + "/" + b64encode([]byte(oURL))
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestEd25519Keys(t *testing.T) {
+	t.Parallel()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+
+	priv2, err := ParseEd25519PrivateKey(EncodeEd25519PrivateKey(priv))
+	assert.Nil(t, err)
+	assert.True(t, priv.Equal(priv2), "private key round trip mismatch")
+
+	pub2, err := ParseEd25519PublicKey(EncodeEd25519PublicKey(pub))
+	assert.Nil(t, err)
+	assert.True(t, pub.Equal(pub2), "public key round trip mismatch")
+
+	_, err = ParseEd25519PublicKey("dGVzdA")
+	assert.NotNil(t, err)
+	_, err = ParseEd25519PrivateKey("not base64!")
+	assert.NotNil(t, err)
+
+	keys, err := ReadKeys(strings.NewReader(
+		"hmac:secret\nsigner:ed25519:" + EncodeEd25519PublicKey(pub) + "\n",
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys), 2)
+	assert.Equal(t, string(keys[0].Secret), "secret")
+	assert.True(t, pub.Equal(keys[1].PublicKey), "public key mismatch")
+
+	_, err = ReadKeys(strings.NewReader("signer:ed25519:dGVzdA\n"))
+	assert.NotNil(t, err)
+
+	key, err := ParseEd25519Key("signer:" + EncodeEd25519PublicKey(pub))
+	assert.Nil(t, err)
+	assert.Equal(t, key.ID, "signer")
+	assert.True(t, pub.Equal(key.PublicKey), "public key mismatch")
+	key, err = ParseEd25519Key(EncodeEd25519PublicKey(pub))
+	assert.Nil(t, err)
+	assert.Equal(t, key.ID, "")
+
+	_, err = NewKeyring(Key{Secret: []byte("a"), PublicKey: pub})
+	assert.NotNil(t, err)
+	_, err = NewKeyring(Key{PublicKey: pub[:8]})
+	assert.NotNil(t, err)
+}
+
+func TestEd25519EncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	seed := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+	priv, err := ParseEd25519PrivateKey(seed)
+	assert.Nil(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	kr, err := NewKeyring(
+		Key{ID: "hmac", Secret: []byte("test")},
+		Key{ID: "signer", PublicKey: pub},
+	)
+	assert.Nil(t, err)
+
+	// signatures are deterministic
+	encodedURL := Ed25519B64EncodeURL(priv, sURL, SignOptions{})
+	assert.Equal(
+		t, encodedURL,
+		"/ed25519.mt9VrF8f8luKe85DJ01YBsv9huPUIUdgYKTLNDDt_YIuMTTFRDVVX0wcZgjVVFlV_hV4zoVIbGsPNX2UNYLxCA/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+
+	for _, encoder := range []func(ed25519.PrivateKey, string, SignOptions) string{Ed25519HexEncodeURL, Ed25519B64EncodeURL} {
+		for _, opts := range []SignOptions{{}, {KeyID: "signer"}, {Algorithm: SHA256}} {
+			encodedURL := encoder(priv, sURL, opts)
+			assert.True(t, strings.HasPrefix(encodedURL, "/ed25519."), "missing algorithm in digest")
+
+			comp := strings.Split(encodedURL, "/")
+			info, err := kr.DecodeURL(comp[1], comp[2])
+			assert.Nil(t, err)
+			assert.Equal(t, info.URL, sURL)
+			assert.Equal(t, info.Algorithm, Ed25519)
+			assert.Equal(t, info.KeyIndex, 1)
+
+			// hmac key id can't be used to verify an ed25519 signature
+			_, err = kr.DecodeURL(strings.Replace(comp[1], "ed25519.", "ed25519.k=hmac.", 1), comp[2])
+			assert.NotNil(t, err)
+		}
+	}
+
+	// tampered url
+	comp := strings.Split(encodedURL, "/")
+	_, err = kr.DecodeURL(comp[1], b64encode([]byte(sURL+"x")))
+	assert.NotNil(t, err)
+
+	// public only keyring can verify, but not sign
+	pubRing, err := NewKeyring(Key{PublicKey: pub})
+	assert.Nil(t, err)
+	_, err = pubRing.DecodeURL(comp[1], comp[2])
+	assert.Nil(t, err)
+	_, ok := pubRing.SigningKey()
+	assert.False(t, ok, "public only keyring has a signing key")
+	_, err = pubRing.B64EncodeURL(sURL, SignOptions{})
+	assert.NotNil(t, err)
+
+	// hmac urls don't verify against public keys
+	_, err = pubRing.DecodeURL(strings.Split(B64EncodeURL([]byte("test"), sURL), "/")[1], comp[2])
+	assert.NotNil(t, err)
+}
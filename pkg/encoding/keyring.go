@@ -0,0 +1,276 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A Key is either an HMAC key, or an Ed25519 public key, with an optional
+// key id.
+//
+// When a key has an id, urls signed with it carry the id in the digest, so
+// verification can go directly to the right key.
+type Key struct {
+	ID string
+	// Secret is the HMAC key.
+	Secret []byte
+	// PublicKey is an Ed25519 public key, used to verify (but not sign)
+	// ed25519 signed urls.
+	PublicKey ed25519.PublicKey
+}
+
+// A Keyring is an ordered set of keys used to sign and verify urls.
+// The first HMAC key is the signing key. All keys are used for verification.
+type Keyring struct {
+	byID    map[string]int
+	keys    []Key
+	signing int
+}
+
+func validKeyID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewKeyring returns a Keyring containing the supplied keys.
+// Returns an error if no keys are supplied, a key is empty (or has both a
+// secret and a public key), or a key id is invalid or duplicated. Key ids
+// may contain only ascii letters, digits, '-' and '_'.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys supplied")
+	}
+
+	kr := &Keyring{
+		keys:    make([]Key, 0, len(keys)),
+		byID:    make(map[string]int),
+		signing: -1,
+	}
+	for i, k := range keys {
+		switch {
+		case len(k.Secret) > 0 && len(k.PublicKey) > 0:
+			return nil, fmt.Errorf("key %d: both secret and public key supplied", i)
+		case len(k.PublicKey) > 0:
+			if len(k.PublicKey) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %d: invalid public key size", i)
+			}
+		case len(k.Secret) == 0:
+			return nil, fmt.Errorf("key %d: empty secret", i)
+		case kr.signing < 0:
+			kr.signing = i
+		}
+		if k.ID != "" {
+			if !validKeyID(k.ID) {
+				return nil, fmt.Errorf("key %d: invalid key id %q", i, k.ID)
+			}
+			if _, ok := kr.byID[k.ID]; ok {
+				return nil, fmt.Errorf("key %d: duplicate key id %q", i, k.ID)
+			}
+			kr.byID[k.ID] = i
+		}
+		kr.keys = append(kr.keys, k)
+	}
+	return kr, nil
+}
+
+// ReadKeys reads keys from r, one per line, in the format
+//
+//	<key-id>:<secret>
+//	<key-id>:ed25519:<base64-public-key>
+//
+// Lines with an 'ed25519:' value are Ed25519 public keys, and so HMAC
+// secrets may not start with 'ed25519:'.
+// Empty lines, and lines starting with '#', are ignored.
+func ReadKeys(r io.Reader) ([]Key, error) {
+	keys := make([]Key, 0)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected <key-id>:<secret>", lineNo)
+		}
+
+		if pub, ok := strings.CutPrefix(secret, "ed25519:"); ok {
+			pubKey, err := ParseEd25519PublicKey(pub)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			keys = append(keys, Key{ID: id, PublicKey: pubKey})
+			continue
+		}
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ReadKeysFile reads keys from the named file. See ReadKeys for the format.
+func ReadKeysFile(fname string) ([]Key, error) {
+	// #nosec
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not open keyring file: %s", err)
+	}
+	// #nosec
+	defer file.Close()
+
+	keys, err := ReadKeys(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring file: %s", err)
+	}
+	return keys, nil
+}
+
+// Keys returns a copy of the keys in the keyring, in order.
+func (kr *Keyring) Keys() []Key {
+	keys := make([]Key, len(kr.keys))
+	copy(keys, kr.keys)
+	return keys
+}
+
+// SigningKey returns the key used for signing urls, and whether the keyring
+// has one. A keyring of only public keys has no signing key.
+func (kr *Keyring) SigningKey() (Key, bool) {
+	if kr.signing < 0 {
+		return Key{}, false
+	}
+	return kr.keys[kr.signing], true
+}
+
+// candidates returns the indexes of keys to try for the given digest.
+// Only keys of the right type for the digest algorithm are included.
+func (kr *Keyring) candidates(dig *digest) ([]int, error) {
+	usable := func(k *Key) bool {
+		if dig.algorithm.isSymmetric() {
+			return len(k.Secret) > 0
+		}
+		return len(k.PublicKey) > 0
+	}
+
+	if dig.keyID != "" {
+		i, ok := kr.byID[dig.keyID]
+		if !ok || !usable(&kr.keys[i]) {
+			return nil, fmt.Errorf("unknown key id %q", dig.keyID)
+		}
+		return []int{i}, nil
+	}
+
+	idxs := make([]int, 0, len(kr.keys))
+	for i := range kr.keys {
+		if usable(&kr.keys[i]) {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs, nil
+}
+
+func (kr *Keyring) signOptions(opts SignOptions) (Key, SignOptions, error) {
+	key, ok := kr.SigningKey()
+	if !ok {
+		return key, opts, errors.New("keyring has no signing key")
+	}
+	opts.KeyID = key.ID
+	return key, opts, nil
+}
+
+// HexEncodeURL signs the url with the keyring signing key, and returns url
+// path partial consisitent of signature and hex encoded url.
+func (kr *Keyring) HexEncodeURL(oURL string, opts SignOptions) (string, error) {
+	key, opts, err := kr.signOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	return HexEncodeURLWithOptions(key.Secret, oURL, opts)
+}
+
+// B64EncodeURL signs the url with the keyring signing key, and returns url
+// path partial consisitent of signature and base64 encoded url.
+func (kr *Keyring) B64EncodeURL(oURL string, opts SignOptions) (string, error) {
+	key, opts, err := kr.signOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	return B64EncodeURLWithOptions(key.Secret, oURL, opts)
+}
+
+// HexEncodeQueryURL signs the url with the keyring signing key, and returns
+// url path partial in the original camo query string format.
+func (kr *Keyring) HexEncodeQueryURL(oURL string, opts SignOptions) (string, error) {
+	key, opts, err := kr.signOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	return HexEncodeQueryURLWithOptions(key.Secret, oURL, opts)
+}
+
+// DecodeQueryURL verifies a url in the original camo query string format
+// (/<hex-digest>?url=<escaped-url>), where oURL is the unescaped value of
+// the url query parameter. The digest must be hex encoded. Returns a
+// URLInfo (if valid) or an error.
+func (kr *Keyring) DecodeQueryURL(hexdig string, oURL string) (*URLInfo, error) {
+	dig, err := parseDigest(hexdig)
+	if err != nil {
+		return nil, fmt.Errorf("bad mac decode: %s", err)
+	}
+
+	if !dig.isHex() {
+		return nil, fmt.Errorf("bad mac decode")
+	}
+
+	macBytes, err := hex.DecodeString(dig.mac)
+	if err != nil {
+		return nil, fmt.Errorf("bad mac decode")
+	}
+
+	urlBytes := []byte(oURL)
+	idx, err := validateURL(kr, dig, macBytes, urlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	return kr.urlInfo(dig, idx, urlBytes), nil
+}
+
+// DecodeURL ensures the url is properly verified via HMAC by a key in the
+// keyring, and then unencodes the url, returning a URLInfo (if valid) or an
+// error. If the digest carries a key id, only that key is tried. Otherwise
+// each key is tried in order.
+func (kr *Keyring) DecodeURL(encdig string, encURL string) (*URLInfo, error) {
+	dig, err := parseDigest(encdig)
+	if err != nil {
+		return nil, fmt.Errorf("bad mac decode: %s", err)
+	}
+
+	if dig.isHex() {
+		return hexDecodeURL(kr, dig, encURL)
+	}
+	return b64DecodeURL(kr, dig, encURL)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestNewKeyring(t *testing.T) {
+	t.Parallel()
+
+	f := func(keys []Key, ok bool) {
+		t.Helper()
+		kr, err := NewKeyring(keys...)
+		if ok {
+			assert.Nil(t, err)
+			assert.NotNil(t, kr)
+		} else {
+			assert.NotNil(t, err)
+			assert.Nil(t, kr)
+		}
+	}
+
+	f([]Key{{Secret: []byte("test")}}, true)
+	f([]Key{{ID: "new", Secret: []byte("a")}, {ID: "old", Secret: []byte("b")}}, true)
+	f([]Key{{ID: "new", Secret: []byte("a")}, {Secret: []byte("b")}}, true)
+	f([]Key{}, false)
+	f([]Key{{ID: "new", Secret: []byte("")}}, false)
+	f([]Key{{ID: "a.b", Secret: []byte("a")}}, false)
+	f([]Key{{ID: "k=v", Secret: []byte("a")}}, false)
+	f([]Key{{ID: "dup", Secret: []byte("a")}, {ID: "dup", Secret: []byte("b")}}, false)
+}
+
+func TestReadKeys(t *testing.T) {
+	t.Parallel()
+
+	keys, err := ReadKeys(strings.NewReader(
+		"# keyring\n\nnew:secret-one\n  old:secret:two  \n",
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys), 2)
+	assert.Equal(t, keys[0].ID, "new")
+	assert.Equal(t, string(keys[0].Secret), "secret-one")
+	assert.Equal(t, keys[1].ID, "old")
+	assert.Equal(t, string(keys[1].Secret), "secret:two")
+
+	_, err = ReadKeys(strings.NewReader("new:secret-one\nnocolon\n"))
+	assert.NotNil(t, err)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	oldKey := Key{ID: "old", Secret: []byte("test")}
+	newKey := Key{ID: "new", Secret: []byte("test2")}
+
+	oldRing, err := NewKeyring(oldKey)
+	assert.Nil(t, err)
+	newRing, err := NewKeyring(newKey, oldKey)
+	assert.Nil(t, err)
+
+	// urls signed with the old ring verify with the new ring
+	for _, encoder := range []func(string, SignOptions) (string, error){oldRing.HexEncodeURL, oldRing.B64EncodeURL} {
+		encodedURL, err := encoder(sURL, SignOptions{Algorithm: SHA256})
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(encodedURL, "/sha256.k=old."), "missing key id in digest")
+
+		comp := strings.Split(encodedURL, "/")
+		info, err := newRing.DecodeURL(comp[1], comp[2])
+		assert.Nil(t, err)
+		assert.Equal(t, info.URL, sURL)
+		assert.Equal(t, info.KeyID, "old")
+		assert.Equal(t, info.KeyIndex, 1)
+	}
+
+	// legacy sha1 urls (no key id) are tried against each key in order
+	info, err := newRing.DecodeURL(
+		"0f6def1cb147b0e84f39cbddc5ea10c80253a6f3",
+		"687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67",
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+	assert.Equal(t, info.KeyID, "old")
+
+	// sha1 with a key id uses the versioned format
+	encodedURL, err := newRing.B64EncodeURL(sURL, SignOptions{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(encodedURL, "/sha1.k=new."), "missing key id in digest")
+	comp := strings.Split(encodedURL, "/")
+	info, err = newRing.DecodeURL(comp[1], comp[2])
+	assert.Nil(t, err)
+	assert.Equal(t, info.KeyID, "new")
+	assert.Equal(t, info.KeyIndex, 0)
+
+	// new key urls don't verify against the old ring
+	_, err = oldRing.DecodeURL(comp[1], comp[2])
+	assert.NotNil(t, err)
+
+	// key id in the digest is covered by the mac
+	_, err = newRing.DecodeURL(strings.Replace(comp[1], "k=new", "k=old", 1), comp[2])
+	assert.NotNil(t, err)
+}
+
+func TestQueryFormat(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	kr, err := NewKeyring(Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+
+	// original camo query string format uses the same hex sha1 digest
+	encodedURL := HexEncodeQueryURL([]byte("test"), sURL)
+	assert.Equal(
+		t, encodedURL,
+		"/0f6def1cb147b0e84f39cbddc5ea10c80253a6f3?url=http%3A%2F%2Fgolang.org%2Fdoc%2Fgopher%2Ffrontpage.png",
+	)
+
+	info, err := kr.DecodeQueryURL("0f6def1cb147b0e84f39cbddc5ea10c80253a6f3", sURL)
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+
+	// versioned digests work too
+	encodedURL, err = kr.HexEncodeQueryURL(sURL, SignOptions{Algorithm: SHA256})
+	assert.Nil(t, err)
+	dig, _, _ := strings.Cut(strings.TrimPrefix(encodedURL, "/"), "?")
+	info, err = kr.DecodeQueryURL(dig, sURL)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Algorithm, SHA256)
+
+	// bad signature, wrong url, and base64 digests are rejected
+	_, err = kr.DecodeQueryURL("0f6def1cb147b0e84f39cbddc5ea10c80253a6f4", sURL)
+	assert.NotNil(t, err)
+	_, err = kr.DecodeQueryURL("0f6def1cb147b0e84f39cbddc5ea10c80253a6f3", sURL+"?x")
+	assert.NotNil(t, err)
+	_, err = kr.DecodeQueryURL("D23vHLFHsOhPOcvdxeoQyAJTpvM", sURL)
+	assert.NotNil(t, err)
+}
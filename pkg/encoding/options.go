@@ -0,0 +1,80 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ContentClass is a set of content classes (eg. image, video) that a url
+// may be proxied as.
+type ContentClass uint8
+
+const (
+	// ContentImage is 'image/*' content.
+	ContentImage ContentClass = 1 << iota
+	// ContentVideo is 'video/*' content.
+	ContentVideo
+	// ContentAudio is 'audio/*' content.
+	ContentAudio
+
+	// ContentAll is all content classes.
+	ContentAll = ContentImage | ContentVideo | ContentAudio
+)
+
+var contentClassNames = []struct {
+	name  string
+	class ContentClass
+}{
+	{"image", ContentImage},
+	{"video", ContentVideo},
+	{"audio", ContentAudio},
+}
+
+// Has reports whether c includes all of the classes in other.
+func (c ContentClass) Has(other ContentClass) bool {
+	return c&other == other
+}
+
+// String returns the comma separated class names, as used in a digest
+// field (eg. "image,video").
+func (c ContentClass) String() string {
+	names := make([]string, 0, len(contentClassNames))
+	for _, cc := range contentClassNames {
+		if c.Has(cc.class) {
+			names = append(names, cc.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseContentClass parses a comma separated list of content class names.
+func ParseContentClass(s string) (ContentClass, error) {
+	var c ContentClass
+	for name := range strings.SplitSeq(s, ",") {
+		found := false
+		for _, cc := range contentClassNames {
+			if name == cc.name {
+				c |= cc.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown content class: %q", name)
+		}
+	}
+	return c, nil
+}
+
+func parseMaxSize(value string) (int64, error) {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid max size: %q", value)
+	}
+	return size, nil
+}
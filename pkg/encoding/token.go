@@ -0,0 +1,278 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Token signature algorithms, as used in the token header.
+const (
+	TokenHS256 = "HS256"
+	TokenEdDSA = "EdDSA"
+)
+
+// TokenClaims are the claims carried by a signed token url.
+//
+// Token urls are compact JWTs (header.payload.signature), signed with
+// HS256 (using an HMAC key) or EdDSA (using an Ed25519 key), in place of
+// the /<digest>/<encoded-url> pair:
+//
+//	/<token>[/<filename>]
+type TokenClaims struct {
+	// URL is the origin url.
+	URL string `json:"url"`
+	// Tenant is an optional tenant name.
+	Tenant string `json:"tenant,omitempty"`
+	// Content is an optional comma separated list of content classes the
+	// url may be proxied as (see ContentClass).
+	Content string `json:"content,omitempty"`
+	// MaxSize is an optional max response size, in bytes.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// Expires is an optional expiry time, in unix seconds.
+	Expires int64 `json:"exp,omitempty"`
+	// NotBefore is an optional not-before time, in unix seconds.
+	NotBefore int64 `json:"nbf,omitempty"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// token is a parsed, but not yet verified, token.
+type token struct {
+	header  tokenHeader
+	signed  string
+	payload []byte
+	sig     []byte
+}
+
+// parseToken parses a compact token. Returns ErrUnknownFormat if the value
+// doesn't look like a token at all.
+func parseToken(value string) (*token, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnknownFormat
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrUnknownFormat
+	}
+	t := &token{signed: parts[0] + "." + parts[1]}
+	if err := json.Unmarshal(headerBytes, &t.header); err != nil || t.header.Alg == "" {
+		return nil, ErrUnknownFormat
+	}
+
+	if t.header.Typ != "" && t.header.Typ != "JWT" {
+		return nil, fmt.Errorf("unsupported token type: %q", t.header.Typ)
+	}
+	if t.header.Kid != "" && !validKeyID(t.header.Kid) {
+		return nil, fmt.Errorf("invalid key id: %q", t.header.Kid)
+	}
+	if t.payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, fmt.Errorf("bad token payload decode")
+	}
+	if t.sig, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("bad token signature decode")
+	}
+	return t, nil
+}
+
+// algorithm returns the url signature Algorithm for the token algorithm.
+func (t *token) algorithm() (Algorithm, error) {
+	switch t.header.Alg {
+	case TokenHS256:
+		return SHA256, nil
+	case TokenEdDSA:
+		return Ed25519, nil
+	default:
+		return 0, fmt.Errorf("unsupported token algorithm: %q", t.header.Alg)
+	}
+}
+
+// verify checks the token signature against each candidate key in the
+// keyring, returning the index of the key that verified it.
+func (t *token) verify(kr *Keyring) (int, Algorithm, error) {
+	alg, err := t.algorithm()
+	if err != nil {
+		return -1, 0, err
+	}
+
+	idxs, err := kr.candidates(&digest{algorithm: alg, keyID: t.header.Kid})
+	if err != nil {
+		return -1, 0, err
+	}
+
+	for _, i := range idxs {
+		switch alg {
+		case Ed25519:
+			if ed25519.Verify(kr.keys[i].PublicKey, []byte(t.signed), t.sig) {
+				return i, alg, nil
+			}
+		default:
+			macSum := computeMAC(alg, kr.keys[i].Secret, "", []byte(t.signed))
+			if subtle.ConstantTimeCompare(macSum, t.sig) == 1 {
+				return i, alg, nil
+			}
+		}
+	}
+	return -1, 0, errors.New("invalid token signature")
+}
+
+// urlInfo returns a URLInfo for the verified token claims.
+func (t *token) urlInfo(kr *Keyring, idx int, alg Algorithm) (*URLInfo, error) {
+	claims := &TokenClaims{}
+	if err := json.Unmarshal(t.payload, claims); err != nil {
+		return nil, fmt.Errorf("bad token claims: %s", err)
+	}
+	if claims.URL == "" {
+		return nil, errors.New("missing url claim")
+	}
+	if claims.MaxSize < 0 || claims.Expires < 0 || claims.NotBefore < 0 {
+		return nil, errors.New("invalid token claims")
+	}
+
+	info := &URLInfo{
+		URL:       claims.URL,
+		KeyID:     kr.keys[idx].ID,
+		KeyIndex:  idx,
+		Algorithm: alg,
+		MaxSize:   claims.MaxSize,
+		Claims:    claims,
+	}
+	if claims.Content != "" {
+		classes, err := ParseContentClass(claims.Content)
+		if err != nil {
+			return nil, err
+		}
+		info.ContentClasses = classes
+	}
+	if claims.Expires > 0 {
+		info.Expires = time.Unix(claims.Expires, 0)
+	}
+	if claims.NotBefore > 0 {
+		info.NotBefore = time.Unix(claims.NotBefore, 0)
+	}
+	return info, nil
+}
+
+func encodeToken(header tokenHeader, claims TokenClaims, sign func([]byte) []byte) (string, error) {
+	if claims.URL == "" {
+		return "", errors.New("missing url claim")
+	}
+	header.Typ = "JWT"
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerBytes) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	return "/" + signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed))), nil
+}
+
+// HS256EncodeToken takes an HMAC key, an optional key id, and the claims,
+// and returns url path partial consisitent of an HS256 signed token.
+func HS256EncodeToken(hmacKey []byte, keyID string, claims TokenClaims) (string, error) {
+	header := tokenHeader{Alg: TokenHS256, Kid: keyID}
+	return encodeToken(header, claims, func(signed []byte) []byte {
+		return computeMAC(SHA256, hmacKey, "", signed)
+	})
+}
+
+// EdDSAEncodeToken takes an Ed25519 private key, an optional key id, and
+// the claims, and returns url path partial consisitent of an EdDSA signed
+// token.
+func EdDSAEncodeToken(priv ed25519.PrivateKey, keyID string, claims TokenClaims) (string, error) {
+	header := tokenHeader{Alg: TokenEdDSA, Kid: keyID}
+	return encodeToken(header, claims, func(signed []byte) []byte {
+		return ed25519.Sign(priv, signed)
+	})
+}
+
+// EncodeToken signs the claims with the keyring signing key (HS256), and
+// returns url path partial consisitent of the token.
+func (kr *Keyring) EncodeToken(claims TokenClaims) (string, error) {
+	key, ok := kr.SigningKey()
+	if !ok {
+		return "", errors.New("keyring has no signing key")
+	}
+	return HS256EncodeToken(key.Secret, key.ID, claims)
+}
+
+// DecodeToken verifies a token url path component with a key in the
+// keyring, returning a URLInfo (with Claims set) if valid, or an error.
+// Returns an error wrapping ErrUnknownFormat if the value is not a token.
+func (kr *Keyring) DecodeToken(value string) (*URLInfo, error) {
+	t, err := parseToken(value)
+	if err != nil {
+		return nil, err
+	}
+	idx, alg, err := t.verify(kr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	return t.urlInfo(kr, idx, alg)
+}
+
+// DecodeToken verifies an HS256 token url path component with the HMAC
+// key, returning a URLInfo (with Claims set) if valid, or an error.
+func DecodeToken(hmackey []byte, value string) (*URLInfo, error) {
+	return singleKeyring(hmackey).DecodeToken(value)
+}
+
+// TokenCodec is the token url format:
+//
+//	/<token>[/<filename>]
+//
+// See TokenClaims.
+type TokenCodec struct {
+	Keyring *Keyring
+}
+
+// Name returns the name of the codec.
+func (c *TokenCodec) Name() string {
+	return "token"
+}
+
+// Decode verifies a token format url.
+func (c *TokenCodec) Decode(u *url.URL) (*URLInfo, error) {
+	components := strings.Split(u.Path, "/")
+	if len(components) < 2 || len(components) > 3 {
+		return nil, ErrUnknownFormat
+	}
+	return c.Keyring.DecodeToken(components[1])
+}
+
+// Encode signs a url as an HS256 token. Only the validity times, max size,
+// and content classes of opts are used.
+func (c *TokenCodec) Encode(oURL string, opts SignOptions) (string, error) {
+	claims := TokenClaims{URL: oURL, MaxSize: opts.MaxSize}
+	if opts.ContentClasses != 0 {
+		claims.Content = opts.ContentClasses.String()
+	}
+	if !opts.Expires.IsZero() {
+		claims.Expires = opts.Expires.Unix()
+	}
+	if !opts.NotBefore.IsZero() {
+		claims.NotBefore = opts.NotBefore.Unix()
+	}
+	return c.Keyring.EncodeToken(claims)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestTokenHS256(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+
+	encURL, err := HS256EncodeToken(hmacKey, "", TokenClaims{URL: sURL})
+	assert.Nil(t, err)
+	// standard HS256 JWT, verifiable by other JWT libraries
+	assert.Equal(
+		t, encURL,
+		"/eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9."+
+			"eyJ1cmwiOiJodHRwOi8vZ29sYW5nLm9yZy9kb2MvZ29waGVyL2Zyb250cGFnZS5wbmcifQ."+
+			"jxwPK-a8MjVCxHyWP2c6J8BTykLA1K0Ett-vxFLOr50",
+	)
+
+	info, err := DecodeToken(hmacKey, strings.TrimPrefix(encURL, "/"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+	assert.Equal(t, info.Algorithm, SHA256)
+	assert.NotNil(t, info.Claims)
+
+	// wrong key
+	_, err = DecodeToken([]byte("test2"), strings.TrimPrefix(encURL, "/"))
+	assert.NotNil(t, err)
+
+	// missing url claim
+	_, err = HS256EncodeToken(hmacKey, "", TokenClaims{Tenant: "acme"})
+	assert.NotNil(t, err)
+}
+
+func TestTokenClaims(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	kr, err := NewKeyring(Key{ID: "k1", Secret: []byte("test")})
+	assert.Nil(t, err)
+
+	expires := time.Unix(1700003600, 0)
+	notBefore := time.Unix(1700000000, 0)
+	encURL, err := kr.EncodeToken(TokenClaims{
+		URL:       sURL,
+		Tenant:    "acme",
+		Content:   "image,video",
+		MaxSize:   1024,
+		Expires:   expires.Unix(),
+		NotBefore: notBefore.Unix(),
+	})
+	assert.Nil(t, err)
+
+	info, err := kr.DecodeToken(strings.TrimPrefix(encURL, "/"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+	assert.Equal(t, info.KeyID, "k1")
+	assert.Equal(t, info.Claims.Tenant, "acme")
+	assert.Equal(t, info.ContentClasses, ContentImage|ContentVideo)
+	assert.Equal(t, info.MaxSize, int64(1024))
+	assert.True(t, info.Expires.Equal(expires), "expires does not match")
+	assert.True(t, info.NotBefore.Equal(notBefore), "not-before does not match")
+	assert.Error(t, info.CheckTime(expires), ErrExpired)
+
+	// bad content class claim
+	encURL, err = kr.EncodeToken(TokenClaims{URL: sURL, Content: "text"})
+	assert.Nil(t, err)
+	_, err = kr.DecodeToken(strings.TrimPrefix(encURL, "/"))
+	assert.NotNil(t, err)
+}
+
+func TestTokenEdDSA(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+
+	kr, err := NewKeyring(Key{ID: "hmac", Secret: []byte("test")}, Key{ID: "signer", PublicKey: pub})
+	assert.Nil(t, err)
+
+	encURL, err := EdDSAEncodeToken(priv, "signer", TokenClaims{URL: sURL, Tenant: "acme"})
+	assert.Nil(t, err)
+	info, err := kr.DecodeToken(strings.TrimPrefix(encURL, "/"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, sURL)
+	assert.Equal(t, info.Algorithm, Ed25519)
+	assert.Equal(t, info.KeyIndex, 1)
+
+	// without a key id too
+	encURL, err = EdDSAEncodeToken(priv, "", TokenClaims{URL: sURL})
+	assert.Nil(t, err)
+	_, err = kr.DecodeToken(strings.TrimPrefix(encURL, "/"))
+	assert.Nil(t, err)
+
+	// hmac key id can't verify an EdDSA token
+	encURL, err = EdDSAEncodeToken(priv, "hmac", TokenClaims{URL: sURL})
+	assert.Nil(t, err)
+	_, err = kr.DecodeToken(strings.TrimPrefix(encURL, "/"))
+	assert.NotNil(t, err)
+}
+
+func TestBadTokens(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	encURL, err := HS256EncodeToken(hmacKey, "", TokenClaims{URL: sURL})
+	assert.Nil(t, err)
+	parts := strings.Split(strings.TrimPrefix(encURL, "/"), ".")
+
+	f := func(value string) {
+		t.Helper()
+		info, err := DecodeToken(hmacKey, value)
+		assert.NotNil(t, err)
+		assert.Nil(t, info)
+	}
+
+	// unsigned (alg none) tokens
+	f(b64([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".")
+	// algorithm swapped
+	f(b64([]byte(`{"alg":"HS512","typ":"JWT"}`)) + "." + parts[1] + "." + parts[2])
+	f(b64([]byte(`{"alg":"EdDSA","typ":"JWT"}`)) + "." + parts[1] + "." + parts[2])
+	// claims tampered
+	f(parts[0] + "." + b64([]byte(`{"url":"http://example.com/"}`)) + "." + parts[2])
+	// bad type
+	f(b64([]byte(`{"alg":"HS256","typ":"JWE"}`)) + "." + parts[1] + "." + parts[2])
+
+	// not tokens at all
+	for _, value := range []string{
+		"sha256.k=abc.AtgWX163x4K94D22SCAcXjtE7BpspYEQRuPmwX07kb0",
+		"D23vHLFHsOhPOcvdxeoQyAJTpvM",
+		"a.b.c",
+	} {
+		_, err := DecodeToken(hmacKey, value)
+		assert.Error(t, err, ErrUnknownFormat)
+	}
+}
+
+func TestTokenCodec(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	kr, err := NewKeyring(Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+	codec := &TokenCodec{Keyring: kr}
+
+	encURL, err := codec.Encode(sURL, SignOptions{ContentClasses: ContentVideo, MaxSize: 10})
+	assert.Nil(t, err)
+
+	for _, path := range []string{encURL, encURL + "/frontpage.png"} {
+		u, err := url.Parse("http://example.com" + path)
+		assert.Nil(t, err)
+		info, err := codec.Decode(u)
+		assert.Nil(t, err)
+		assert.Equal(t, info.URL, sURL)
+		assert.Equal(t, info.ContentClasses, ContentVideo)
+		assert.Equal(t, info.MaxSize, int64(10))
+	}
+
+	// path format urls are not tokens
+	u, err := url.Parse("http://example.com/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n")
+	assert.Nil(t, err)
+	_, err = codec.Decode(u)
+	assert.Error(t, err, ErrUnknownFormat)
+}
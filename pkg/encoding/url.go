@@ -5,13 +5,18 @@
 package encoding
 
 import (
+	"crypto/ed25519"
 	"crypto/hmac"
-	"crypto/sha1" // #nosec G505 -- used for hmac only
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"codeberg.org/dropwhile/mlog"
 )
@@ -22,17 +27,264 @@ type DecoderFunc func([]byte, string, string) (string, error)
 // EncoderFunc is a function type that defines a url encoder.
 type EncoderFunc func([]byte, string) string
 
-func validateURL(hmackey *[]byte, macbytes *[]byte, urlbytes *[]byte) error {
-	mac := hmac.New(sha1.New, *hmackey)
-	mac.Write(*urlbytes) // #nosec G104 -- doesn't apply to hmac
-	macSum := mac.Sum(nil)
+var (
+	// ErrExpired is returned when checking a url whose expiry time has passed.
+	ErrExpired = errors.New("url expired")
+	// ErrNotYetValid is returned when checking a url whose not-before time
+	// has not yet been reached.
+	ErrNotYetValid = errors.New("url not yet valid")
+)
+
+// SignOptions holds optional settings used when signing a url.
+type SignOptions struct {
+	// Algorithm is the signature algorithm to use. The zero value uses SHA1.
+	// Ed25519 and XChaCha20Poly1305 are set by (and only valid with) the
+	// Ed25519 encoders and the encrypt functions respectively.
+	Algorithm Algorithm
+	// KeyID is the id of the signing key, if any. When set, the key id is
+	// included in the digest.
+	KeyID string
+	// Expires, if non-zero, is the time after which the url is no longer
+	// valid.
+	Expires time.Time
+	// NotBefore, if non-zero, is the time before which the url is not yet
+	// valid.
+	NotBefore time.Time
+	// MaxSize, if non-zero, is the maximum response size (in bytes) for the
+	// url. The proxy limits this to its own configured ceiling.
+	MaxSize int64
+	// ContentClasses, if non-zero, are the content classes the url may be
+	// proxied as. The proxy limits these to its own configured ceiling.
+	ContentClasses ContentClass
+}
+
+// URLInfo holds a verified url, along with details about how it was signed.
+type URLInfo struct {
+	Expires        time.Time
+	NotBefore      time.Time
+	URL            string
+	KeyID          string
+	KeyIndex       int
+	MaxSize        int64
+	Algorithm      Algorithm
+	ContentClasses ContentClass
+	// Claims are the token claims, for token urls. Nil otherwise.
+	Claims *TokenClaims
+}
+
+// CheckTime checks the signed validity period of the url (if any) against
+// now, returning ErrExpired or ErrNotYetValid if the url is not valid.
+func (info *URLInfo) CheckTime(now time.Time) error {
+	if !info.Expires.IsZero() && !now.Before(info.Expires) {
+		return ErrExpired
+	}
+	if !info.NotBefore.IsZero() && now.Before(info.NotBefore) {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+// A digest is a parsed signature (digest) path component.
+//
+// A digest is either a bare mac (legacy format, always SHA1), or a
+// versioned mac with a '.' separated prefix of the algorithm name followed
+// by optional name=value fields:
+//
+//	<mac>
+//	<algorithm>.<mac>
+//	<algorithm>.k=<key-id>.<mac>
+//	<algorithm>.e=<unix-time>.n=<unix-time>.<mac>
+//	<algorithm>.c=image,video.s=<bytes>.<mac>
+//
+// Fields are:
+//
+//	k: the id of the signing key
+//	e: expiry time, in unix seconds
+//	n: not-before time, in unix seconds
+//	c: comma separated content classes the url may be proxied as
+//	s: max response size, in bytes
+//
+// For versioned digests, the prefix (including the trailing separator) is
+// also covered by the mac.
+type digest struct {
+	expires        time.Time
+	notBefore      time.Time
+	prefix         string
+	mac            string
+	keyID          string
+	maxSize        int64
+	algorithm      Algorithm
+	contentClasses ContentClass
+}
+
+func parseUnixTime(value string) (time.Time, error) {
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs <= 0 {
+		return time.Time{}, fmt.Errorf("invalid time: %q", value)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// isHex reports whether the mac is hex encoded, based on its length.
+func (d *digest) isHex() bool {
+	return len(d.mac) == hex.EncodedLen(d.algorithm.size())
+}
+
+func parseDigest(encdig string) (*digest, error) {
+	i := strings.LastIndexByte(encdig, '.')
+	if i < 0 {
+		return &digest{algorithm: SHA1, mac: encdig}, nil
+	}
+
+	fields := strings.Split(encdig[:i], ".")
+	alg, err := ParseAlgorithm(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	dig := &digest{algorithm: alg, prefix: encdig[:i+1], mac: encdig[i+1:]}
+	seen := make(map[string]bool, len(fields)-1)
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || seen[name] {
+			return nil, fmt.Errorf("malformed digest field: %q", field)
+		}
+		seen[name] = true
+
+		switch name {
+		case "k":
+			if !validKeyID(value) {
+				return nil, fmt.Errorf("invalid key id: %q", value)
+			}
+			dig.keyID = value
+		case "e":
+			if dig.expires, err = parseUnixTime(value); err != nil {
+				return nil, err
+			}
+		case "n":
+			if dig.notBefore, err = parseUnixTime(value); err != nil {
+				return nil, err
+			}
+		case "c":
+			if dig.contentClasses, err = ParseContentClass(value); err != nil {
+				return nil, err
+			}
+		case "s":
+			if dig.maxSize, err = parseMaxSize(value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown digest field: %q", field)
+		}
+	}
+	return dig, nil
+}
 
-	if subtle.ConstantTimeCompare(macSum, *macbytes) != 1 {
-		return fmt.Errorf("invalid mac")
+func (opts *SignOptions) digestPrefix() string {
+	alg := opts.Algorithm
+	if alg == 0 {
+		alg = SHA1
+	}
+
+	if alg == SHA1 && opts.KeyID == "" && opts.Expires.IsZero() && opts.NotBefore.IsZero() &&
+		opts.MaxSize == 0 && opts.ContentClasses == 0 {
+		return ""
+	}
+
+	prefix := alg.String() + "."
+	if opts.KeyID != "" {
+		prefix += "k=" + opts.KeyID + "."
+	}
+	if !opts.Expires.IsZero() {
+		prefix += "e=" + strconv.FormatInt(opts.Expires.Unix(), 10) + "."
+	}
+	if !opts.NotBefore.IsZero() {
+		prefix += "n=" + strconv.FormatInt(opts.NotBefore.Unix(), 10) + "."
+	}
+	if opts.ContentClasses != 0 {
+		prefix += "c=" + opts.ContentClasses.String() + "."
+	}
+	if opts.MaxSize > 0 {
+		prefix += "s=" + strconv.FormatInt(opts.MaxSize, 10) + "."
+	}
+	return prefix
+}
+
+// checkHMAC returns an error if the options algorithm can not be used to
+// sign urls with an HMAC key.
+func (opts *SignOptions) checkHMAC() error {
+	if opts.Algorithm != 0 && !opts.Algorithm.IsHMAC() {
+		return fmt.Errorf("can not sign urls with %s", opts.Algorithm)
 	}
 	return nil
 }
 
+func computeMAC(alg Algorithm, hmackey []byte, prefix string, urlbytes []byte) []byte {
+	mac := hmac.New(alg.hash(), hmackey)
+	mac.Write([]byte(prefix)) // #nosec G104 -- doesn't apply to hmac
+	mac.Write(urlbytes)       // #nosec G104 -- doesn't apply to hmac
+	return mac.Sum(nil)
+}
+
+// validateURL checks the mac against each candidate key in the keyring,
+// returning the index of the key that verified the url.
+func validateURL(kr *Keyring, dig *digest, macbytes []byte, urlbytes []byte) (int, error) {
+	idxs, err := kr.candidates(dig)
+	if err != nil {
+		return -1, err
+	}
+
+	switch dig.algorithm {
+	case XChaCha20Poly1305:
+		return -1, fmt.Errorf("encrypted url digest")
+	case Ed25519:
+		msg := append([]byte(dig.prefix), urlbytes...)
+		for _, i := range idxs {
+			if ed25519.Verify(kr.keys[i].PublicKey, msg, macbytes) {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("invalid signature")
+	}
+
+	for _, i := range idxs {
+		macSum := computeMAC(dig.algorithm, kr.keys[i].Secret, dig.prefix, urlbytes)
+		if subtle.ConstantTimeCompare(macSum, macbytes) == 1 {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("invalid mac")
+}
+
+// verifyURL verifies (or for encrypted urls, decrypts) the url data,
+// returning the index of the key that verified it, and the url.
+func verifyURL(kr *Keyring, dig *digest, macbytes []byte, data []byte) (int, []byte, error) {
+	if dig.algorithm == XChaCha20Poly1305 {
+		return openURL(kr, dig, macbytes, data)
+	}
+	idx, err := validateURL(kr, dig, macbytes, data)
+	return idx, data, err
+}
+
+func (kr *Keyring) urlInfo(dig *digest, idx int, urlbytes []byte) *URLInfo {
+	return &URLInfo{
+		URL:            string(urlbytes),
+		KeyID:          kr.keys[idx].ID,
+		KeyIndex:       idx,
+		Algorithm:      dig.algorithm,
+		Expires:        dig.expires,
+		NotBefore:      dig.notBefore,
+		MaxSize:        dig.maxSize,
+		ContentClasses: dig.contentClasses,
+	}
+}
+
+// singleKeyring returns a keyring with just the one (unnamed) hmac key.
+// Used by the single key encode/decode functions.
+func singleKeyring(hmackey []byte) *Keyring {
+	return &Keyring{keys: []Key{{Secret: hmackey}}}
+}
+
 func b64encode(data []byte) string {
 	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
 }
@@ -46,88 +298,178 @@ func b64decode(str string) ([]byte, error) {
 	return decBytes, ok
 }
 
+func hexDecodeURL(kr *Keyring, dig *digest, hexURL string) (*URLInfo, error) {
+	urlBytes, err := hex.DecodeString(hexURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad url decode")
+	}
+
+	macBytes, err := hex.DecodeString(dig.mac)
+	if err != nil {
+		return nil, fmt.Errorf("bad mac decode")
+	}
+
+	idx, urlBytes, err := verifyURL(kr, dig, macBytes, urlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	return kr.urlInfo(dig, idx, urlBytes), nil
+}
+
+func b64DecodeURL(kr *Keyring, dig *digest, encURL string) (*URLInfo, error) {
+	urlBytes, err := b64decode(encURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad url decode")
+	}
+
+	macBytes, err := b64decode(dig.mac)
+	if err != nil {
+		return nil, fmt.Errorf("bad mac decode")
+	}
+
+	idx, urlBytes, err := verifyURL(kr, dig, macBytes, urlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	return kr.urlInfo(dig, idx, urlBytes), nil
+}
+
 // HexDecodeURL ensures the url is properly verified via HMAC, and then
 // unencodes the url, returning the url (if valid) and whether the
 // HMAC was verified.
 func HexDecodeURL(hmackey []byte, hexdig string, hexURL string) (string, error) {
-	urlBytes, err := hex.DecodeString(hexURL)
+	dig, err := parseDigest(hexdig)
 	if err != nil {
-		return "", fmt.Errorf("bad url decode")
+		return "", fmt.Errorf("bad mac decode: %s", err)
 	}
 
-	macBytes, err := hex.DecodeString(hexdig)
+	info, err := hexDecodeURL(singleKeyring(hmackey), dig, hexURL)
 	if err != nil {
-		return "", fmt.Errorf("bad mac decode")
-	}
-
-	if err = validateURL(&hmackey, &macBytes, &urlBytes); err != nil {
-		return "", fmt.Errorf("invalid signature: %s", err)
+		return "", err
 	}
-	return string(urlBytes), nil
+	return info.URL, nil
 }
 
 // HexEncodeURL takes an HMAC key and a url, and returns url
 // path partial consisitent of signature and encoded url.
 func HexEncodeURL(hmacKey []byte, oURL string) string {
+	// sha1 signing does not fail
+	hexURL, _ := HexEncodeURLWithOptions(hmacKey, oURL, SignOptions{})
+	return hexURL
+}
+
+// HexEncodeURLWithOptions takes an HMAC key, a url, and signing options,
+// and returns url path partial consisitent of signature and encoded url.
+// Returns an error if the options algorithm is not an HMAC algorithm.
+func HexEncodeURLWithOptions(hmacKey []byte, oURL string, opts SignOptions) (string, error) {
+	if err := opts.checkHMAC(); err != nil {
+		return "", err
+	}
 	oBytes := []byte(oURL)
-	mac := hmac.New(sha1.New, hmacKey)
-	mac.Write(oBytes) // #nosec G104 -- doesn't apply to hmac
-	macSum := hex.EncodeToString(mac.Sum(nil))
+	prefix := opts.digestPrefix()
+	macSum := hex.EncodeToString(computeMAC(opts.Algorithm, hmacKey, prefix, oBytes))
 	encodedURL := hex.EncodeToString(oBytes)
-	hexURL := "/" + macSum + "/" + encodedURL
-	return hexURL
+	hexURL := "/" + prefix + macSum + "/" + encodedURL
+	return hexURL, nil
 }
 
 // B64DecodeURL ensures the url is properly verified via HMAC, and then
 // unencodes the url, returning the url (if valid) and whether the
 // HMAC was verified.
 func B64DecodeURL(hmackey []byte, encdig string, encURL string) (string, error) {
-	urlBytes, err := b64decode(encURL)
+	dig, err := parseDigest(encdig)
 	if err != nil {
-		return "", fmt.Errorf("bad url decode")
+		return "", fmt.Errorf("bad mac decode: %s", err)
 	}
 
-	macBytes, err := b64decode(encdig)
+	info, err := b64DecodeURL(singleKeyring(hmackey), dig, encURL)
 	if err != nil {
-		return "", fmt.Errorf("bad mac decode")
-	}
-
-	if err := validateURL(&hmackey, &macBytes, &urlBytes); err != nil {
-		return "", fmt.Errorf("invalid signature: %s", err)
+		return "", err
 	}
-	return string(urlBytes), nil
+	return info.URL, nil
 }
 
 // B64EncodeURL takes an HMAC key and a url, and returns url
 // path partial consisitent of signature and encoded url.
 func B64EncodeURL(hmacKey []byte, oURL string) string {
+	// sha1 signing does not fail
+	encURL, _ := B64EncodeURLWithOptions(hmacKey, oURL, SignOptions{})
+	return encURL
+}
+
+// B64EncodeURLWithOptions takes an HMAC key, a url, and signing options,
+// and returns url path partial consisitent of signature and encoded url.
+// Returns an error if the options algorithm is not an HMAC algorithm.
+func B64EncodeURLWithOptions(hmacKey []byte, oURL string, opts SignOptions) (string, error) {
+	if err := opts.checkHMAC(); err != nil {
+		return "", err
+	}
 	oBytes := []byte(oURL)
-	mac := hmac.New(sha1.New, hmacKey)
-	mac.Write(oBytes) // #nosec G104 -- doesn't apply to hmac
-	macSum := b64encode(mac.Sum(nil))
+	prefix := opts.digestPrefix()
+	macSum := b64encode(computeMAC(opts.Algorithm, hmacKey, prefix, oBytes))
 	encodedURL := b64encode(oBytes)
-	encURL := "/" + macSum + "/" + encodedURL
+	encURL := "/" + prefix + macSum + "/" + encodedURL
+	return encURL, nil
+}
+
+// HexEncodeQueryURL takes an HMAC key and a url, and returns url path
+// partial in the original camo query string format, consisitent of hex
+// signature and a url query parameter.
+func HexEncodeQueryURL(hmacKey []byte, oURL string) string {
+	// sha1 signing does not fail
+	encURL, _ := HexEncodeQueryURLWithOptions(hmacKey, oURL, SignOptions{})
 	return encURL
 }
 
+// HexEncodeQueryURLWithOptions takes an HMAC key, a url, and signing
+// options, and returns url path partial in the original camo query string
+// format, consisitent of hex signature and a url query parameter. Returns
+// an error if the options algorithm is not an HMAC algorithm.
+func HexEncodeQueryURLWithOptions(hmacKey []byte, oURL string, opts SignOptions) (string, error) {
+	if err := opts.checkHMAC(); err != nil {
+		return "", err
+	}
+	prefix := opts.digestPrefix()
+	macSum := hex.EncodeToString(computeMAC(opts.Algorithm, hmacKey, prefix, []byte(oURL)))
+	return "/" + prefix + macSum + "?url=" + url.QueryEscape(oURL), nil
+}
+
+// FilenameSegment returns the last path segment of oURL, escaped and with
+// a leading '/', suitable for appending to an encoded url path as an
+// (unsigned) trailing filename segment. Returns an empty string if the url
+// has no filename.
+func FilenameSegment(oURL string) string {
+	u, err := url.Parse(oURL)
+	if err != nil {
+		return ""
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return "/" + url.PathEscape(name)
+}
+
+// DecodeURLWithInfo ensures the url is properly verified via HMAC, and then
+// unencodes the url, returning a URLInfo (if valid) or an error.
+// Tries either hex or base64 decoding, depending on the length of the
+// encoded hmac for the digest algorithm.
+func DecodeURLWithInfo(hmackey []byte, encdig string, encURL string) (*URLInfo, error) {
+	return singleKeyring(hmackey).DecodeURL(encdig, encURL)
+}
+
 // DecodeURL ensures the url is properly verified via HMAC, and then
 // unencodes the url, returning the url (if valid) and whether the
 // HMAC was verified. Tries either HexDecode or B64Decode, depending on the
 // length of the encoded hmac.
 func DecodeURL(hmackey []byte, encdig string, encURL string) (string, bool) {
-	var decoder DecoderFunc
-	if len(encdig) == 40 {
-		decoder = HexDecodeURL
-	} else {
-		decoder = B64DecodeURL
-	}
-
-	urlBytes, err := decoder(hmackey, encdig, encURL)
+	info, err := DecodeURLWithInfo(hmackey, encdig, encURL)
 	if err != nil {
 		if mlog.HasDebug() {
 			mlog.Debugf("Bad Decode of URL: %s", err)
 		}
 		return "", false
 	}
-	return urlBytes, true
+	return info.URL, true
 }
@@ -6,7 +6,9 @@ package encoding
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cactus/go-camo/v2/pkg/assert"
 )
@@ -120,6 +122,263 @@ func TestBadDecodes(t *testing.T) {
 	)
 }
 
+func TestEncodeDecodeWithAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	f := func(encoder func([]byte, string, SignOptions) (string, error), alg Algorithm, hmac, edig, eURL, sURL string) {
+		t.Helper()
+		hmacKey := []byte(hmac)
+		encodedURL, err := encoder(hmacKey, sURL, SignOptions{Algorithm: alg})
+		assert.Nil(t, err)
+		assert.Equal(t, encodedURL, fmt.Sprintf("/%s/%s", edig, eURL), "encoded url does not match")
+
+		info, err := DecodeURLWithInfo(hmacKey, edig, eURL)
+		assert.Nil(t, err, "decoded url failed to verify")
+		assert.Equal(t, info.URL, sURL, "decoded url does not match")
+		assert.Equal(t, info.Algorithm, alg, "decoded algorithm does not match")
+	}
+
+	// sha1 uses the legacy (unprefixed) digest format
+	f(
+		HexEncodeURLWithOptions, SHA1, "test", "0f6def1cb147b0e84f39cbddc5ea10c80253a6f3",
+		"687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67",
+		"http://golang.org/doc/gopher/frontpage.png",
+	)
+
+	// hex
+	f(
+		HexEncodeURLWithOptions, SHA256, "test",
+		"sha256.02d8165f5eb7c782bde03db648201c5e3b44ec1a6ca5811046e3e6c17d3b91bd",
+		"687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67",
+		"http://golang.org/doc/gopher/frontpage.png",
+	)
+	f(
+		HexEncodeURLWithOptions, SHA512_256, "test",
+		"sha512-256.32e624f2a484c5f89ac887a42d3aeb37a557932eb5d178419d6855530d5342e9",
+		"687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67",
+		"http://golang.org/doc/gopher/frontpage.png",
+	)
+
+	// base64
+	f(
+		B64EncodeURLWithOptions, SHA256, "test",
+		"sha256.AtgWX163x4K94D22SCAcXjtE7BpspYEQRuPmwX07kb0",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+		"http://golang.org/doc/gopher/frontpage.png",
+	)
+	f(
+		B64EncodeURLWithOptions, SHA512_256, "test",
+		"sha512-256.MuYk8qSExfiayIekLTrrN6VXky610XhBnWhVUw1TQuk",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+		"http://golang.org/doc/gopher/frontpage.png",
+	)
+
+	// only hmac algorithms can sign with an hmac key
+	for _, alg := range []Algorithm{XChaCha20Poly1305, Ed25519} {
+		for _, encoder := range []func([]byte, string, SignOptions) (string, error){
+			HexEncodeURLWithOptions, B64EncodeURLWithOptions, HexEncodeQueryURLWithOptions,
+		} {
+			_, err := encoder([]byte("test"), "http://golang.org/", SignOptions{Algorithm: alg})
+			assert.NotNil(t, err, alg.String())
+		}
+	}
+}
+
+func TestAlgorithmMeets(t *testing.T) {
+	t.Parallel()
+
+	f := func(alg, minimum Algorithm, expected bool) {
+		t.Helper()
+		assert.Equal(t, alg.Meets(minimum), expected, alg.String()+" "+minimum.String())
+	}
+
+	f(SHA1, 0, true)
+	f(SHA1, SHA1, true)
+	f(SHA1, SHA256, false)
+	f(SHA256, SHA256, true)
+	f(SHA256, SHA512_256, false)
+	f(SHA512_256, SHA256, true)
+	// non-hmac algorithms meet any minimum
+	f(XChaCha20Poly1305, SHA512_256, true)
+	f(Ed25519, SHA512_256, true)
+	// and do not raise the minimum for hmac algorithms
+	f(SHA512_256, Ed25519, true)
+
+	for _, name := range []string{"sha1", "sha256", "sha512-256"} {
+		alg, err := ParseMinAlgorithm(name)
+		assert.Nil(t, err)
+		assert.True(t, alg.IsHMAC(), name)
+	}
+	for _, name := range []string{"xchacha20-poly1305", "ed25519", "md5"} {
+		_, err := ParseMinAlgorithm(name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestBadDecodesWithAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	f := func(hmac, edig, eURL string) {
+		t.Helper()
+		info, err := DecodeURLWithInfo([]byte(hmac), edig, eURL)
+		assert.NotNil(t, err, "decoded url verfied when it shouldn't have")
+		assert.Nil(t, info, "decoded url result not empty")
+	}
+
+	// unknown algorithm
+	f(
+		"test", "md5.AtgWX163x4K94D22SCAcXjtE7BpspYEQRuPmwX07kb0",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+	// algorithm prefix swapped (prefix is covered by the mac)
+	f(
+		"test", "sha512-256.AtgWX163x4K94D22SCAcXjtE7BpspYEQRuPmwX07kb0",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+	// prefix stripped from a sha256 mac
+	f(
+		"test", "AtgWX163x4K94D22SCAcXjtE7BpspYEQRuPmwX07kb0",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+	// explicit sha1 prefix on an unprefixed mac
+	f(
+		"test", "sha1.D23vHLFHsOhPOcvdxeoQyAJTpvM",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+}
+
+func TestEncodeDecodeWithValidity(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+	notBefore := time.Unix(1700000000, 0)
+	expires := time.Unix(1700003600, 0)
+
+	for _, encoder := range []func([]byte, string, SignOptions) (string, error){HexEncodeURLWithOptions, B64EncodeURLWithOptions} {
+		encodedURL, err := encoder(hmacKey, sURL, SignOptions{Expires: expires, NotBefore: notBefore})
+		assert.Nil(t, err)
+		comp := strings.Split(encodedURL, "/")
+		assert.True(
+			t, strings.HasPrefix(comp[1], "sha1.e=1700003600.n=1700000000."),
+			"missing validity fields in digest",
+		)
+
+		info, err := DecodeURLWithInfo(hmacKey, comp[1], comp[2])
+		assert.Nil(t, err)
+		assert.Equal(t, info.URL, sURL)
+		assert.True(t, info.Expires.Equal(expires), "expires does not match")
+		assert.True(t, info.NotBefore.Equal(notBefore), "not-before does not match")
+
+		assert.Nil(t, info.CheckTime(notBefore))
+		assert.Nil(t, info.CheckTime(expires.Add(-time.Second)))
+		assert.Error(t, info.CheckTime(expires), ErrExpired)
+		assert.Error(t, info.CheckTime(notBefore.Add(-time.Second)), ErrNotYetValid)
+
+		// validity fields are covered by the mac
+		_, err = DecodeURLWithInfo(hmacKey, strings.Replace(comp[1], "e=1700003600", "e=1800003600", 1), comp[2])
+		assert.NotNil(t, err)
+		_, err = DecodeURLWithInfo(hmacKey, strings.Replace(comp[1], "n=1700000000.", "", 1), comp[2])
+		assert.NotNil(t, err)
+	}
+
+	// urls without validity fields never expire
+	info, err := DecodeURLWithInfo(
+		hmacKey, "D23vHLFHsOhPOcvdxeoQyAJTpvM",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, info.CheckTime(time.Now()))
+
+	// malformed times
+	for _, dig := range []string{"sha1.e=abc.D23vHLFHsOhPOcvdxeoQyAJTpvM", "sha1.e=-1.D23vHLFHsOhPOcvdxeoQyAJTpvM"} {
+		_, err = DecodeURLWithInfo(hmacKey, dig, "aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestEncodeDecodeWithURLOptions(t *testing.T) {
+	t.Parallel()
+
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+	opts := SignOptions{
+		Algorithm:      SHA256,
+		ContentClasses: ContentImage | ContentVideo,
+		MaxSize:        50 * 1024 * 1024,
+	}
+
+	for _, encoder := range []func([]byte, string, SignOptions) (string, error){HexEncodeURLWithOptions, B64EncodeURLWithOptions} {
+		encodedURL, err := encoder(hmacKey, sURL, opts)
+		assert.Nil(t, err)
+		comp := strings.Split(encodedURL, "/")
+		assert.True(
+			t, strings.HasPrefix(comp[1], "sha256.c=image,video.s=52428800."),
+			"missing option fields in digest",
+		)
+
+		info, err := DecodeURLWithInfo(hmacKey, comp[1], comp[2])
+		assert.Nil(t, err)
+		assert.Equal(t, info.URL, sURL)
+		assert.Equal(t, info.ContentClasses, ContentImage|ContentVideo)
+		assert.Equal(t, info.MaxSize, int64(52428800))
+
+		// option fields are covered by the mac
+		_, err = DecodeURLWithInfo(hmacKey, strings.Replace(comp[1], "c=image,video", "c=image,video,audio", 1), comp[2])
+		assert.NotNil(t, err)
+		_, err = DecodeURLWithInfo(hmacKey, strings.Replace(comp[1], "s=52428800", "s=92428800", 1), comp[2])
+		assert.NotNil(t, err)
+	}
+
+	// sha1 with options uses the versioned format
+	encodedURL, err := B64EncodeURLWithOptions(hmacKey, sURL, SignOptions{ContentClasses: ContentAudio})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(encodedURL, "/sha1.c=audio."), "missing option fields in digest")
+
+	// malformed options
+	for _, dig := range []string{
+		"sha1.c=text.D23vHLFHsOhPOcvdxeoQyAJTpvM",
+		"sha1.c=.D23vHLFHsOhPOcvdxeoQyAJTpvM",
+		"sha1.s=0.D23vHLFHsOhPOcvdxeoQyAJTpvM",
+		"sha1.s=10k.D23vHLFHsOhPOcvdxeoQyAJTpvM",
+	} {
+		_, err := DecodeURLWithInfo(hmacKey, dig, "aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestContentClass(t *testing.T) {
+	t.Parallel()
+
+	c, err := ParseContentClass("video,image")
+	assert.Nil(t, err)
+	assert.Equal(t, c, ContentImage|ContentVideo)
+	assert.Equal(t, c.String(), "image,video")
+	assert.True(t, c.Has(ContentVideo), "missing video class")
+	assert.False(t, c.Has(ContentAudio), "unexpected audio class")
+	assert.Equal(t, ContentAll.String(), "image,video,audio")
+
+	_, err = ParseContentClass("image,text")
+	assert.NotNil(t, err)
+}
+
+func TestFilenameSegment(t *testing.T) {
+	t.Parallel()
+
+	f := func(sURL, expected string) {
+		t.Helper()
+		assert.Equal(t, FilenameSegment(sURL), expected)
+	}
+
+	f("http://golang.org/doc/gopher/frontpage.png", "/frontpage.png")
+	f("http://golang.org/doc/gopher/frontpage.png?size=large#x", "/frontpage.png")
+	f("http://golang.org/doc/gopher/", "/gopher")
+	f("http://golang.org/doc/my%20photo.png", "/my%20photo.png")
+	f("http://golang.org/", "")
+	f("http://golang.org", "")
+	f("http://golang.org/%zz", "")
+}
+
 func BenchmarkHexEncoder(b *testing.B) {
 	for b.Loop() {
 		HexEncodeURL([]byte("test"), "http://golang.org/doc/gopher/frontpage.png")
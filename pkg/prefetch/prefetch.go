@@ -0,0 +1,324 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package prefetch provides an http handler that warms the go-camo response
+// cache, by fetching a list of urls through the proxy ahead of client
+// requests (eg. before a newsletter is sent).
+//
+// Urls are fetched as client requests are, so they are verified, checked
+// (eg. against the filter ruleset), and content type filtered the same way.
+// Requests are authenticated with a bearer token, or a verified TLS client
+// certificate, as with the url signing endpoint.
+package prefetch
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+// DefaultMaxURLs is the default maximum number of urls fetched per request.
+const DefaultMaxURLs = 100
+
+// DefaultConcurrency is the default maximum number of urls fetched at once.
+const DefaultConcurrency = 8
+
+// maxBodySize is the maximum size of a request body, in bytes
+const maxBodySize = 1 << 20
+
+// maxErrorSize is the maximum size of an error response body kept for a
+// result, in bytes
+const maxErrorSize = 512
+
+// Config holds configuration data used when creating a Handler with New.
+type Config struct {
+	// Handler is the go-camo proxy handler (eg. a *camo.Proxy) that urls are
+	// fetched through.
+	Handler http.Handler
+	// Keyring, if set, holds the key that origin urls are signed with.
+	// Urls are signed with the first HMAC key. If nil, only signed urls
+	// are accepted.
+	Keyring *encoding.Keyring
+	// Token is the bearer token that authorizes requests. If empty, only
+	// requests with a verified client certificate are authorized.
+	Token string
+	// Options are the signing options used for origin urls. The key id is
+	// set from the keyring.
+	Options encoding.SignOptions
+	// Concurrency is the maximum number of urls fetched at once. Defaults
+	// to DefaultConcurrency.
+	Concurrency int
+	// MaxURLs is the maximum number of urls fetched per request. Defaults
+	// to DefaultMaxURLs.
+	MaxURLs int
+}
+
+// A Handler is an http handler that fetches urls through the proxy, and
+// discards the responses.
+//
+// Urls are sent as a JSON body:
+//
+//	{"urls": ["https://img.example.org/<digest>/<encoded-url>"]}
+//
+// or as (repeated) url form parameters. Urls are signed go-camo urls (only
+// the path and query are used), or origin urls if origin is true, which are
+// signed with the keyring first.
+//
+// The response is a JSON body with a result for each url, in order. Each
+// result has the url, the proxy response status and size, and the reason
+// it failed (if it did):
+//
+//	{"urls": [{"url": "...", "status": 200, "size": 1024}]}
+type Handler struct {
+	handler     http.Handler
+	keyring     *encoding.Keyring
+	token       []byte
+	opts        encoding.SignOptions
+	concurrency int
+	maxURLs     int
+}
+
+// request is a prefetch request
+type request struct {
+	URLs   []string `json:"urls"`
+	Origin bool     `json:"origin"`
+}
+
+// result is the result of fetching a url
+type result struct {
+	URL     string `json:"url"`
+	CamoURL string `json:"camo_url,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// response is a prefetch response
+type response struct {
+	Error string   `json:"error,omitempty"`
+	URLs  []result `json:"urls,omitempty"`
+}
+
+// New returns a new Handler.
+func New(config Config) (*Handler, error) {
+	if config.Handler == nil {
+		return nil, errors.New("handler required")
+	}
+	if config.Options.Algorithm != 0 && !config.Options.Algorithm.IsHMAC() {
+		return nil, fmt.Errorf("can not sign urls with %s", config.Options.Algorithm)
+	}
+
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	maxURLs := config.MaxURLs
+	if maxURLs <= 0 {
+		maxURLs = DefaultMaxURLs
+	}
+
+	h := &Handler{
+		handler:     config.Handler,
+		keyring:     config.Keyring,
+		opts:        config.Options,
+		concurrency: concurrency,
+		maxURLs:     maxURLs,
+	}
+	if config.Token != "" {
+		h.token = []byte(config.Token)
+	}
+	return h, nil
+}
+
+// authorized reports whether the request has the bearer token, or a
+// verified client certificate.
+func (h *Handler) authorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if h.token == nil {
+		return false
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), h.token) == 1
+}
+
+// parseRequest reads the prefetch request from the JSON body, or the form
+func parseRequest(r *http.Request) (*request, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		req := &request{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid json body: %s", err)
+		}
+		return req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("invalid form body: %s", err)
+	}
+	origin, _ := strconv.ParseBool(r.Form.Get("origin"))
+	return &request{URLs: r.Form["url"], Origin: origin}, nil
+}
+
+// path returns the signed url path (and query) to fetch for the url
+func (h *Handler) path(rawURL string, origin bool) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.New("invalid url")
+	}
+	if !origin {
+		return u.RequestURI(), nil
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("Bad url scheme")
+	}
+	if u.Host == "" {
+		return "", errors.New("Bad url host")
+	}
+	return h.keyring.HexEncodeURL(rawURL, h.opts)
+}
+
+// fetch fetches the url through the proxy, and returns the result
+func (h *Handler) fetch(r *http.Request, rawURL string, origin bool) result {
+	res := result{URL: rawURL}
+	path, err := h.path(rawURL, origin)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if origin {
+		res.CamoURL = path
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path, nil)
+	if err != nil {
+		res.Error = "invalid url"
+		return res
+	}
+
+	w := &discardWriter{header: make(http.Header)}
+	h.handler.ServeHTTP(w, req)
+	if err := r.Context().Err(); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	res.Status = w.status
+	res.Size = w.size
+	switch {
+	case w.status < 300:
+	case w.status < 400:
+		res.Error = "redirected to " + w.header.Get("Location")
+	case w.errBody.Len() > 0:
+		res.Error = strings.TrimSpace(w.errBody.String())
+	default:
+		res.Error = http.StatusText(w.status)
+	}
+	return res
+}
+
+// writeJSON writes the response, with the status code
+func writeJSON(w http.ResponseWriter, code int, resp *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	// #nosec G104
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ServeHTTP fulfills the http server interface
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+		return
+	}
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-camo"`)
+		writeJSON(w, http.StatusUnauthorized, &response{Error: "unauthorized"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	req, err := parseRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+
+	if len(req.URLs) == 0 {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "no urls"})
+		return
+	}
+	if len(req.URLs) > h.maxURLs {
+		writeJSON(w, http.StatusBadRequest, &response{
+			Error: fmt.Sprintf("too many urls: %d (max %d)", len(req.URLs), h.maxURLs),
+		})
+		return
+	}
+	if req.Origin && h.keyring == nil {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "origin urls not supported"})
+		return
+	}
+
+	results := make([]result, len(req.URLs))
+	sem := make(chan struct{}, h.concurrency)
+	var wg sync.WaitGroup
+	for i, rawURL := range req.URLs {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			results[i] = h.fetch(r, rawURL, req.Origin)
+		})
+	}
+	wg.Wait()
+	writeJSON(w, http.StatusOK, &response{URLs: results})
+}
+
+// discardWriter is an http.ResponseWriter that discards the response body,
+// apart from the start of error responses.
+type discardWriter struct {
+	header  http.Header
+	errBody bytes.Buffer
+	status  int
+	size    int64
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status >= 400 && w.errBody.Len() < maxErrorSize {
+		w.errBody.Write(b[:min(len(b), maxErrorSize-w.errBody.Len())])
+	}
+	w.size += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package prefetch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+const (
+	testToken = "s3cret"
+	testURL   = "http://golang.org/doc/gopher/frontpage.png"
+)
+
+// testProxy is a stand-in for the go-camo proxy, that verifies path format
+// urls and answers by origin url path
+type testProxy struct {
+	keyring *encoding.Keyring
+	fetched map[string]int
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info, err := (&encoding.PathCodec{Keyring: p.keyring}).Decode(r.URL)
+	if err != nil {
+		http.Error(w, "Bad Signature", http.StatusForbidden)
+		return
+	}
+
+	p.mu.Lock()
+	p.fetched[info.URL]++
+	p.active++
+	p.maxSeen = max(p.maxSeen, p.active)
+	p.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+
+	u, _ := url.Parse(info.URL)
+	switch u.Path {
+	case "/missing.png":
+		http.Error(w, "Not Found", http.StatusNotFound)
+	case "/big.png":
+		http.Redirect(w, r, "https://example.org/too-big.png", http.StatusFound)
+	default:
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("image"))
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func newTestHandler(t *testing.T, config Config) (*Handler, *testProxy) {
+	t.Helper()
+	keyring, err := encoding.NewKeyring(encoding.Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+	proxy := &testProxy{keyring: keyring, fetched: make(map[string]int)}
+	if config.Handler == nil {
+		config.Handler = proxy
+	}
+	config.Keyring = keyring
+	h, err := New(config)
+	assert.Nil(t, err)
+	return h, proxy
+}
+
+func doRequest(t *testing.T, h http.Handler, req *http.Request) (int, *response) {
+	t.Helper()
+	record := httptest.NewRecorder()
+	h.ServeHTTP(record, req)
+	resp := &response{}
+	assert.Nil(t, json.NewDecoder(record.Body).Decode(resp))
+	assert.Equal(t, record.Header().Get("Content-Type"), "application/json")
+	return record.Code, resp
+}
+
+func jsonRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/prefetch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{})
+	assert.NotNil(t, err)
+	_, err = New(Config{Handler: http.NotFoundHandler(), Options: encoding.SignOptions{Algorithm: encoding.Ed25519}})
+	assert.NotNil(t, err)
+	_, err = New(Config{Handler: http.NotFoundHandler()})
+	assert.Nil(t, err)
+}
+
+func TestPrefetch(t *testing.T) {
+	t.Parallel()
+
+	h, proxy := newTestHandler(t, Config{Token: testToken, Concurrency: 2})
+
+	signed, err := proxy.keyring.HexEncodeURL(testURL, encoding.SignOptions{})
+	assert.Nil(t, err)
+	missing, err := proxy.keyring.B64EncodeURL("http://golang.org/missing.png", encoding.SignOptions{})
+	assert.Nil(t, err)
+
+	// signed urls, with or without the server url
+	code, resp := doRequest(t, h, jsonRequest(
+		`{"urls": ["https://img.example.org`+signed+`", "`+missing+`", "/0000/bad"]}`,
+	))
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(resp.URLs), 3)
+	assert.Equal(t, resp.URLs[0], result{URL: "https://img.example.org" + signed, Status: 200, Size: 5})
+	assert.Equal(t, resp.URLs[1], result{URL: missing, Status: 404, Size: 10, Error: "Not Found"})
+	assert.Equal(t, resp.URLs[2].Status, 403)
+	assert.Equal(t, resp.URLs[2].Error, "Bad Signature")
+	assert.Equal(t, proxy.fetched[testURL], 1)
+
+	// origin urls, signed by the handler
+	urls := []string{testURL, "http://golang.org/big.png", "file:///etc/passwd"}
+	for i := range 5 {
+		urls = append(urls, "http://golang.org/"+string(rune('a'+i))+".png")
+	}
+	body, err := json.Marshal(request{URLs: urls, Origin: true})
+	assert.Nil(t, err)
+	code, resp = doRequest(t, h, jsonRequest(string(body)))
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(resp.URLs), 8)
+	assert.Equal(t, resp.URLs[0], result{URL: testURL, CamoURL: signed, Status: 200, Size: 5})
+	assert.Equal(t, resp.URLs[1].Status, 302)
+	assert.Equal(t, resp.URLs[1].Error, "redirected to https://example.org/too-big.png")
+	assert.Equal(t, resp.URLs[2], result{URL: "file:///etc/passwd", Error: "Bad url scheme"})
+	for _, res := range resp.URLs[3:] {
+		assert.Equal(t, res.Status, 200, res.URL)
+	}
+	assert.Equal(t, proxy.fetched[testURL], 2)
+
+	// fetches are bounded by the concurrency
+	proxy.mu.Lock()
+	assert.Equal(t, proxy.maxSeen, 2)
+	proxy.mu.Unlock()
+
+	// form values
+	form := url.Values{"url": {testURL}, "origin": {"true"}}
+	req := httptest.NewRequest("POST", "/prefetch", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	code, resp = doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, resp.URLs[0].Status, 200)
+}
+
+func TestPrefetchBadRequest(t *testing.T) {
+	t.Parallel()
+
+	h, _ := newTestHandler(t, Config{Token: testToken, MaxURLs: 2})
+
+	f := func(body string) {
+		t.Helper()
+		code, resp := doRequest(t, h, jsonRequest(body))
+		assert.Equal(t, code, http.StatusBadRequest, body)
+		assert.NotEqual(t, resp.Error, "", body)
+	}
+
+	f(`{"urls": [`)
+	f(`{"urls": []}`)
+	f(`{"urls": ["` + testURL + `", "` + testURL + `", "` + testURL + `"]}`)
+
+	req := httptest.NewRequest("GET", "/prefetch?url="+url.QueryEscape(testURL), nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	code, _ := doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusMethodNotAllowed)
+
+	// origin urls need a keyring
+	h, err := New(Config{Handler: http.NotFoundHandler(), Token: testToken})
+	assert.Nil(t, err)
+	code, resp := doRequest(t, h, jsonRequest(`{"urls": ["`+testURL+`"], "origin": true}`))
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, resp.Error, "origin urls not supported")
+}
+
+func TestPrefetchAuthorization(t *testing.T) {
+	t.Parallel()
+
+	h, _ := newTestHandler(t, Config{Token: testToken})
+	body := `{"urls": ["` + testURL + `"], "origin": true}`
+
+	f := func(authorization string, expected int) {
+		t.Helper()
+		req := jsonRequest(body)
+		req.Header.Set("Authorization", authorization)
+		code, _ := doRequest(t, h, req)
+		assert.Equal(t, code, expected, authorization)
+	}
+
+	f("Bearer "+testToken, http.StatusOK)
+	f("Bearer wrong", http.StatusUnauthorized)
+	f("Basic "+testToken, http.StatusUnauthorized)
+	f("", http.StatusUnauthorized)
+
+	// verified client certificate, and no token
+	h, _ = newTestHandler(t, Config{})
+	req := jsonRequest(body)
+	req.Header.Del("Authorization")
+	code, _ := doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	req = jsonRequest(body)
+	req.Header.Del("Authorization")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	code, _ = doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusOK)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package rewrite
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlURLAttrs are the url attributes rewritten, by element
+var htmlURLAttrs = map[string][]string{
+	"img":    {"src"},
+	"video":  {"poster"},
+	"source": {"src"},
+}
+
+// htmlSrcsetElements are the elements with a srcset attribute rewritten
+var htmlSrcsetElements = map[string]bool{
+	"img":    true,
+	"source": true,
+}
+
+// cssURLRe matches css url() references, capturing the (double quoted,
+// single quoted, or unquoted) url
+var cssURLRe = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`)
+
+// HTML reads an HTML document (or fragment) from in, and writes it to out
+// with img src and srcset, video poster, source src and srcset, and inline
+// style url() references rewritten. The rest of the document is written as
+// it was read.
+func (r *Rewriter) HTML(out io.Writer, in io.Reader) error {
+	z := html.NewTokenizer(in)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if !errors.Is(z.Err(), io.EOF) {
+				return z.Err()
+			}
+			// any unterminated trailing tag
+			_, err := out.Write(z.Raw())
+			return err
+		}
+
+		raw := z.Raw()
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			// Token lowercases tag names in place, so keep the raw tag as
+			// it was read
+			raw = slices.Clone(raw)
+			token := z.Token()
+			changed, err := r.rewriteAttrs(&token)
+			if err != nil {
+				return err
+			}
+			if changed {
+				if _, err := io.WriteString(out, token.String()); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err := out.Write(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteAttrs rewrites the url attributes of the token, returning true if
+// any were changed.
+func (r *Rewriter) rewriteAttrs(token *html.Token) (bool, error) {
+	changed := false
+	urlAttrs := htmlURLAttrs[token.Data]
+	for i := range token.Attr {
+		attr := &token.Attr[i]
+		if attr.Namespace != "" {
+			continue
+		}
+
+		var val string
+		var err error
+		switch {
+		case attr.Key == "style":
+			val, err = r.CSS(attr.Val)
+		case attr.Key == "srcset" && htmlSrcsetElements[token.Data]:
+			val, err = r.Srcset(attr.Val)
+		case slices.Contains(urlAttrs, attr.Key):
+			val, err = r.URL(attr.Val)
+		default:
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if val != attr.Val {
+			attr.Val = val
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// Srcset rewrites the urls of a srcset attribute value
+// (eg. "a.png 1x, b.png 2x").
+func (r *Rewriter) Srcset(srcset string) (string, error) {
+	candidates := make([]string, 0, strings.Count(srcset, ",")+1)
+	changed := false
+	s := srcset
+	for {
+		s = strings.TrimLeft(s, " \t\n\r\f,")
+		if s == "" {
+			break
+		}
+
+		// the url runs to the next whitespace. a trailing comma ends the
+		// candidate, with no descriptors.
+		end := strings.IndexAny(s, " \t\n\r\f")
+		if end < 0 {
+			end = len(s)
+		}
+		u := s[:end]
+		s = s[end:]
+		descriptor := ""
+		if trimmed := strings.TrimRight(u, ","); trimmed != u {
+			u = trimmed
+		} else {
+			end = strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			descriptor = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+
+		newURL, err := r.URL(u)
+		if err != nil {
+			return "", err
+		}
+		if newURL != u {
+			changed = true
+		}
+		if descriptor != "" {
+			newURL += " " + descriptor
+		}
+		candidates = append(candidates, newURL)
+	}
+
+	if !changed {
+		return srcset, nil
+	}
+	return strings.Join(candidates, ", "), nil
+}
+
+// CSS rewrites the url() references in css (eg. an inline style
+// attribute value).
+func (r *Rewriter) CSS(css string) (string, error) {
+	var rerr error
+	out := cssURLRe.ReplaceAllStringFunc(css, func(m string) string {
+		sub := cssURLRe.FindStringSubmatch(m)
+		quote, u := "", sub[3]
+		switch {
+		case sub[1] != "":
+			quote, u = `"`, sub[1]
+		case sub[2] != "":
+			quote, u = "'", sub[2]
+		}
+
+		newURL, err := r.URL(u)
+		if err != nil {
+			rerr = err
+			return m
+		}
+		if newURL == u {
+			return m
+		}
+		return "url(" + quote + newURL + quote + ")"
+	})
+	if rerr != nil {
+		return "", rerr
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+// newTestRewriter returns a rewriter with a readable (unsigned) encoder:
+// http://a.org/1.png -> https://camo.example/x/a.org/1.png
+func newTestRewriter(t *testing.T) *Rewriter {
+	t.Helper()
+	r, err := New(Config{
+		Encoder: func(oURL string) (string, error) {
+			return "/x/" + strings.TrimPrefix(oURL, "http://"), nil
+		},
+		Prefix:           "https://camo.example",
+		ExcludeHosts:     []string{"static.example.org"},
+		PassthroughHTTPS: true,
+	})
+	assert.Nil(t, err)
+	return r
+}
+
+func TestHTML(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRewriter(t)
+	f := func(in string, want string) {
+		t.Helper()
+		var out bytes.Buffer
+		err := r.HTML(&out, strings.NewReader(in))
+		assert.Nil(t, err)
+		assert.Equal(t, out.String(), want)
+	}
+
+	f(
+		`<p>hi <img src="http://a.org/1.png" alt="one &amp; two"></p>`,
+		`<p>hi <img src="https://camo.example/x/a.org/1.png" alt="one &amp; two"></p>`,
+	)
+	f(
+		`<IMG SRC='http://a.org/1.png?a=1&amp;b=2'/>`,
+		`<img src="https://camo.example/x/a.org/1.png?a=1&amp;b=2"/>`,
+	)
+	f(
+		`<video poster="http://a.org/p.jpg" src="http://a.org/v.mp4"><source src="http://a.org/v.webm"></video>`,
+		`<video poster="https://camo.example/x/a.org/p.jpg" src="http://a.org/v.mp4"><source src="https://camo.example/x/a.org/v.webm"></video>`,
+	)
+	f(
+		`<picture><source srcset="http://a.org/1.webp 1x, http://a.org/2.webp 2x"><img src="/local.png"></picture>`,
+		`<picture><source srcset="https://camo.example/x/a.org/1.webp 1x, https://camo.example/x/a.org/2.webp 2x"><img src="/local.png"></picture>`,
+	)
+	f(
+		`<div style="background: url('http://a.org/bg.png') no-repeat">x</div>`,
+		`<div style="background: url(&#39;https://camo.example/x/a.org/bg.png&#39;) no-repeat">x</div>`,
+	)
+
+	// unchanged tags, and everything else, are written as they were read
+	for _, in := range []string{
+		`<!DOCTYPE html><HTML><Body CLASS=x><IMG SRC=/local.png></Body></HTML>`,
+		`<img src="https://a.org/1.png"><img src="http://static.example.org/1.png">`,
+		`<a href="http://a.org/1.png">link</a><iframe src="http://a.org/"></iframe>`,
+		`<script>var s = '<img src="http://a.org/1.png">';</script>`,
+		`<!-- <img src="http://a.org/1.png"> --> text &amp; <b>more</b>`,
+		`<img src="http://a.org/1.png`,
+	} {
+		f(in, in)
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRewriter(t)
+	f := func(in string, want string) {
+		t.Helper()
+		out, err := r.Srcset(in)
+		assert.Nil(t, err)
+		assert.Equal(t, out, want)
+	}
+
+	f("http://a.org/1.png", "https://camo.example/x/a.org/1.png")
+	f(
+		"http://a.org/1.png 100w,http://a.org/2.png   200w",
+		"https://camo.example/x/a.org/1.png 100w, https://camo.example/x/a.org/2.png 200w",
+	)
+	// urls run to the next whitespace, so may contain commas
+	f(
+		"http://a.org/1.png,http://a.org/2.png 2x",
+		"https://camo.example/x/a.org/1.png,http://a.org/2.png 2x",
+	)
+	f(
+		"\n  http://a.org/a,b.png 1x,\n  /local.png 2x\n",
+		"https://camo.example/x/a.org/a,b.png 1x, /local.png 2x",
+	)
+	// unchanged values are left as they are
+	f("/1.png 1x,  /2.png 2x", "/1.png 1x,  /2.png 2x")
+	f("", "")
+}
+
+func TestCSS(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRewriter(t)
+	f := func(in string, want string) {
+		t.Helper()
+		out, err := r.CSS(in)
+		assert.Nil(t, err)
+		assert.Equal(t, out, want)
+	}
+
+	f(`background:url(http://a.org/1.png)`, `background:url(https://camo.example/x/a.org/1.png)`)
+	f(`background: URL( "http://a.org/1.png" )`, `background: url("https://camo.example/x/a.org/1.png")`)
+	f(
+		`background-image: url('http://a.org/1.png'), url(/local.png)`,
+		`background-image: url('https://camo.example/x/a.org/1.png'), url(/local.png)`,
+	)
+	f(`color: red`, `color: red`)
+}
+
+func TestEncoderError(t *testing.T) {
+	t.Parallel()
+
+	errEncode := errors.New("encode failed")
+	r, err := New(Config{
+		Encoder: func(string) (string, error) {
+			return "", errEncode
+		},
+	})
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	err = r.HTML(&out, strings.NewReader(`<img srcset="http://a.org/1.png 2x">`))
+	assert.Error(t, err, errEncode)
+	_, err = r.CSS(`url(http://a.org/1.png)`)
+	assert.Error(t, err, errEncode)
+}
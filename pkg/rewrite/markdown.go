@@ -0,0 +1,419 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package rewrite
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// mdFenceRe matches the opening (or closing) line of a fenced code block
+var mdFenceRe = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+
+// mdDefinitionRe matches a link reference definition line, capturing the
+// part before the destination, the label, and the destination
+var mdDefinitionRe = regexp.MustCompile(`^( {0,3}\[((?:[^\]\\]|\\.)+)\]:[ \t]*)(<[^>\n]*>|[^\s<]\S*)`)
+
+// mdSegment is a run of markdown text, or of code that is left as it is
+type mdSegment struct {
+	text string
+	code bool
+}
+
+// Markdown reads a CommonMark document from in, and writes it to out with
+// image urls rewritten. Inline images, the reference definitions used by
+// reference style images, and embedded raw html (as for HTML) are
+// rewritten. Code spans and fenced code blocks are left as they are, as is
+// the rest of the document.
+func (r *Rewriter) Markdown(out io.Writer, in io.Reader) error {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	segments := splitMarkdown(string(b))
+
+	// labels of the reference definitions used by images
+	refs := make(map[string]bool)
+	for _, seg := range segments {
+		if seg.code {
+			continue
+		}
+		scanImages(seg.text, func(img mdImage) {
+			if !img.inline {
+				refs[normalizeLabel(img.label)] = true
+			}
+		})
+	}
+
+	lineStart := true
+	for _, seg := range segments {
+		text := seg.text
+		if !seg.code {
+			text, err = r.rewriteMarkdownText(text, refs, lineStart)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(out, text); err != nil {
+			return err
+		}
+		lineStart = strings.HasSuffix(seg.text, "\n")
+	}
+	return nil
+}
+
+// rewriteMarkdownText rewrites the images, reference definitions, and raw
+// html of a (non code) markdown segment. lineStart is false if the segment
+// starts part way through a line (after a code span).
+func (r *Rewriter) rewriteMarkdownText(text string, refs map[string]bool, lineStart bool) (string, error) {
+	var b strings.Builder
+	var rerr error
+	last := 0
+	scanImages(text, func(img mdImage) {
+		if !img.inline || rerr != nil {
+			return
+		}
+		newURL, changed, err := r.markdownURL(img.dest)
+		if err != nil {
+			rerr = err
+			return
+		}
+		if changed {
+			b.WriteString(text[last:img.destStart])
+			b.WriteString(newURL)
+			last = img.destEnd
+		}
+	})
+	if rerr != nil {
+		return "", rerr
+	}
+	b.WriteString(text[last:])
+	text = b.String()
+
+	if len(refs) > 0 {
+		lines := strings.SplitAfter(text, "\n")
+		for i, line := range lines {
+			if i == 0 && !lineStart {
+				continue
+			}
+			m := mdDefinitionRe.FindStringSubmatchIndex(line)
+			if m == nil || !refs[normalizeLabel(line[m[4]:m[5]])] {
+				continue
+			}
+			newURL, changed, err := r.markdownURL(line[m[6]:m[7]])
+			if err != nil {
+				return "", err
+			}
+			if changed {
+				lines[i] = line[:m[6]] + newURL + line[m[7]:]
+			}
+		}
+		text = strings.Join(lines, "")
+	}
+
+	// embedded raw html
+	if !strings.Contains(text, "<") {
+		return text, nil
+	}
+	var out bytes.Buffer
+	if err := r.HTML(&out, strings.NewReader(text)); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// markdownURL rewrites a markdown link destination, which may be in angle
+// brackets, and contain backslash escapes and entities
+func (r *Rewriter) markdownURL(dest string) (string, bool, error) {
+	inner, bracketed := strings.CutPrefix(dest, "<")
+	if bracketed {
+		inner = strings.TrimSuffix(inner, ">")
+	}
+	oURL := html.UnescapeString(unescapeMarkdown(inner))
+
+	newURL, err := r.URL(oURL)
+	if err != nil || newURL == oURL {
+		return dest, false, err
+	}
+	if bracketed {
+		newURL = "<" + newURL + ">"
+	}
+	return newURL, true, nil
+}
+
+// splitMarkdown splits a markdown document into fenced code blocks, code
+// spans, and the text between them.
+func splitMarkdown(doc string) []mdSegment {
+	segments := make([]mdSegment, 0)
+	var text, code strings.Builder
+	fence := ""
+
+	for _, line := range strings.SplitAfter(doc, "\n") {
+		if fence != "" {
+			code.WriteString(line)
+			// closing fence: at least as long as the opening one, with
+			// nothing after it
+			m := mdFenceRe.FindStringSubmatch(line)
+			if m != nil && m[1][0] == fence[0] && len(m[1]) >= len(fence) &&
+				strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), fence[:1])) == "" {
+				segments = append(segments, mdSegment{text: code.String(), code: true})
+				code.Reset()
+				fence = ""
+			}
+			continue
+		}
+
+		m := mdFenceRe.FindStringSubmatch(line)
+		// backtick fence info strings may not contain backticks
+		if m != nil && (m[1][0] == '~' || !strings.Contains(line[len(m[0]):], "`")) {
+			segments = append(segments, splitCodeSpans(text.String())...)
+			text.Reset()
+			fence = m[1]
+			code.WriteString(line)
+			continue
+		}
+		text.WriteString(line)
+	}
+
+	segments = append(segments, splitCodeSpans(text.String())...)
+	if code.Len() > 0 {
+		// unclosed fences run to the end of the document
+		segments = append(segments, mdSegment{text: code.String(), code: true})
+	}
+	return segments
+}
+
+// splitCodeSpans splits markdown text into code spans, and the text between
+// them.
+func splitCodeSpans(text string) []mdSegment {
+	segments := make([]mdSegment, 0, 1)
+	start := 0
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '\\':
+			i += 2
+			continue
+		case '`':
+		default:
+			i++
+			continue
+		}
+
+		n := backtickRun(text, i)
+		// a code span ends at the next run of the same length
+		end := -1
+		for j := i + n; j < len(text); {
+			if text[j] != '`' {
+				j++
+				continue
+			}
+			m := backtickRun(text, j)
+			if m == n {
+				end = j + m
+				break
+			}
+			j += m
+		}
+		if end < 0 {
+			// literal backticks
+			i += n
+			continue
+		}
+
+		if i > start {
+			segments = append(segments, mdSegment{text: text[start:i]})
+		}
+		segments = append(segments, mdSegment{text: text[i:end], code: true})
+		start, i = end, end
+	}
+	if start < len(text) {
+		segments = append(segments, mdSegment{text: text[start:]})
+	}
+	return segments
+}
+
+func backtickRun(text string, i int) int {
+	n := 0
+	for i+n < len(text) && text[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// mdImage is an inline image (with the destination offsets set), or a
+// reference style image (with the label set)
+type mdImage struct {
+	dest      string
+	label     string
+	destStart int
+	destEnd   int
+	inline    bool
+}
+
+// scanImages calls fn for each image in the markdown text
+func scanImages(text string, fn func(mdImage)) {
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\':
+			i += 2
+		case strings.HasPrefix(text[i:], "!["):
+			img, end, ok := parseImage(text, i)
+			if !ok {
+				i += 2
+				continue
+			}
+			fn(img)
+			i = end
+		default:
+			i++
+		}
+	}
+}
+
+// parseImage parses the image starting at text[i] ("!["), returning the
+// image and the offset of its end.
+func parseImage(text string, i int) (mdImage, int, bool) {
+	img := mdImage{}
+
+	// alt text, which may contain balanced brackets
+	altStart := i + 2
+	j, ok := matchBracket(text, altStart, '[', ']')
+	if !ok {
+		return img, 0, false
+	}
+	alt := text[altStart:j]
+	j++
+
+	switch {
+	case j < len(text) && text[j] == '(':
+		k := skipSpace(text, j+1)
+		img.inline = true
+		img.destStart = k
+		if k < len(text) && text[k] == '<' {
+			gt := strings.IndexAny(text[k:], ">\n")
+			if gt < 0 || text[k+gt] != '>' {
+				return img, 0, false
+			}
+			k += gt + 1
+		} else {
+			depth := 0
+		dest:
+			for ; k < len(text); k++ {
+				switch c := text[k]; {
+				case c == '\\':
+					k++
+				case c == '(':
+					depth++
+				case c == ')' && depth == 0:
+					break dest
+				case c == ')':
+					depth--
+				case c <= ' ':
+					break dest
+				}
+			}
+		}
+		img.destEnd = min(k, len(text))
+		img.dest = text[img.destStart:img.destEnd]
+
+		// optional title
+		k = skipSpace(text, k)
+		if k < len(text) && (text[k] == '"' || text[k] == '\'' || text[k] == '(') {
+			closer := text[k]
+			if closer == '(' {
+				closer = ')'
+			}
+			k++
+			for ; k < len(text) && text[k] != closer; k++ {
+				if text[k] == '\\' {
+					k++
+				}
+			}
+			k = skipSpace(text, k+1)
+		}
+		if k >= len(text) || text[k] != ')' {
+			return img, 0, false
+		}
+		return img, k + 1, true
+	case j < len(text) && text[j] == '[':
+		k, ok := matchBracket(text, j+1, '[', ']')
+		if !ok {
+			return img, 0, false
+		}
+		img.label = text[j+1 : k]
+		if strings.TrimSpace(img.label) == "" {
+			// collapsed reference (![label][])
+			img.label = alt
+		}
+		return img, k + 1, true
+	default:
+		// shortcut reference (![label])
+		img.label = alt
+		return img, j, true
+	}
+}
+
+// matchBracket returns the offset of the closing bracket matching an
+// already opened one, starting at text[i]
+func matchBracket(text string, i int, open byte, closer byte) (int, bool) {
+	depth := 1
+	for ; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case open:
+			depth++
+		case closer:
+			depth--
+			if depth == 0 {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// skipSpace skips spaces, tabs, and up to one line ending
+func skipSpace(text string, i int) int {
+	newline := false
+	for ; i < len(text); i++ {
+		switch text[i] {
+		case ' ', '\t':
+		case '\n':
+			if newline {
+				return i
+			}
+			newline = true
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// normalizeLabel returns the case folded, whitespace collapsed form of a
+// reference label
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// unescapeMarkdown removes the backslash from backslash escaped ascii
+// punctuation
+func unescapeMarkdown(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestMarkdown(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRewriter(t)
+	f := func(in string, want string) {
+		t.Helper()
+		var out bytes.Buffer
+		err := r.Markdown(&out, strings.NewReader(in))
+		assert.Nil(t, err)
+		assert.Equal(t, out.String(), want)
+	}
+
+	// inline images
+	f(
+		"see ![a gopher](http://a.org/1.png) here\n",
+		"see ![a gopher](https://camo.example/x/a.org/1.png) here\n",
+	)
+	f(
+		`![alt [nested]](http://a.org/1.png "title") ![](<http://a.org/2 .png>)`,
+		`![alt [nested]](https://camo.example/x/a.org/1.png "title") ![](<https://camo.example/x/a.org/2 .png>)`,
+	)
+	f(
+		"![x](\n  http://a.org/(1).png\n  'title'\n)",
+		"![x](\n  https://camo.example/x/a.org/(1).png\n  'title'\n)",
+	)
+	f(
+		`![x](http://a.org/1.png?a=1&amp;b=\_2)`,
+		`![x](https://camo.example/x/a.org/1.png?a=1&b=_2)`,
+	)
+	// images in links are rewritten, but not the links
+	f(
+		"[![x](http://a.org/1.png)](http://a.org/page)",
+		"[![x](https://camo.example/x/a.org/1.png)](http://a.org/page)",
+	)
+
+	// reference definitions used by images
+	f(
+		"![one][img] ![Two][] ![three] [link]\n\n"+
+			"[img]: http://a.org/1.png\n"+
+			"[two]: <http://a.org/2.png> \"title\"\n"+
+			"  [THREE]:   http://a.org/3.png\n"+
+			"[link]: http://a.org/page\n",
+		"![one][img] ![Two][] ![three] [link]\n\n"+
+			"[img]: https://camo.example/x/a.org/1.png\n"+
+			"[two]: <https://camo.example/x/a.org/2.png> \"title\"\n"+
+			"  [THREE]:   https://camo.example/x/a.org/3.png\n"+
+			"[link]: http://a.org/page\n",
+	)
+
+	// raw html
+	f(
+		"text <img src=\"http://a.org/1.png\" width=10> text\n\n<div>\n<img src='http://a.org/2.png'>\n</div>\n",
+		"text <img src=\"https://camo.example/x/a.org/1.png\" width=\"10\"> text\n\n<div>\n<img src=\"https://camo.example/x/a.org/2.png\">\n</div>\n",
+	)
+
+	// left as they are
+	for _, in := range []string{
+		"`![x](http://a.org/1.png)` and ``code with ` ![x](http://a.org/1.png)``",
+		"```\n![x](http://a.org/1.png)\n<img src=\"http://a.org/1.png\">\n```\n",
+		"~~~~ md\n![x](http://a.org/1.png)\n~~~\n![x](http://a.org/1.png)\n~~~~\n",
+		"````\nunclosed ![x](http://a.org/1.png)\n",
+		`\![x](http://a.org/1.png) ![x](/local.png) ![x](https://a.org/1.png)`,
+		"[x](http://a.org/1.png) ![x](http://a.org/1.png \"unclosed\"",
+		"[img]: http://a.org/unused.png\n",
+		"unmatched `backtick <b>bold</b>",
+	} {
+		f(in, in)
+	}
+
+	// code spans and fences split the document, but not the surrounding text
+	f(
+		"`code` ![x](http://a.org/1.png)\n```go\n![x](http://a.org/1.png)\n```\n![x](http://a.org/2.png)\n",
+		"`code` ![x](https://camo.example/x/a.org/1.png)\n```go\n![x](http://a.org/1.png)\n```\n![x](https://camo.example/x/a.org/2.png)\n",
+	)
+	// definitions only start at the start of a line
+	f(
+		"![x] `code` [x]: http://a.org/1.png\n",
+		"![x] `code` [x]: http://a.org/1.png\n",
+	)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package rewrite provides rewriting of image (and other media) urls in
+// documents into signed go-camo urls.
+package rewrite
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+// Config holds configuration data used when creating a Rewriter with New.
+type Config struct {
+	// Encoder signs an origin url, returning the url path partial. If not
+	// set, urls are signed with encoding.B64EncodeURL using HMACKey.
+	Encoder func(oURL string) (string, error)
+	// Prefix is the go-camo server url that signed url path partials are
+	// appended to (eg. https://img.example.org).
+	Prefix string
+	// HMACKey is the key urls are signed with, if Encoder is not set.
+	HMACKey []byte
+	// ExcludeHosts are hosts whose urls are left as they are. A leading
+	// "*." matches any subdomain (eg. *.example.org).
+	ExcludeHosts []string
+	// PassthroughHTTPS leaves https urls as they are, rather than proxying
+	// them.
+	PassthroughHTTPS bool
+}
+
+// A Rewriter rewrites urls into signed go-camo urls.
+type Rewriter struct {
+	encoder      func(oURL string) (string, error)
+	prefix       string
+	excludeHosts map[string]struct{}
+	excludeSubs  []string
+	passHTTPS    bool
+}
+
+// New returns a new Rewriter.
+func New(config Config) (*Rewriter, error) {
+	r := &Rewriter{
+		encoder:      config.Encoder,
+		prefix:       strings.TrimRight(config.Prefix, "/"),
+		excludeHosts: make(map[string]struct{}),
+		passHTTPS:    config.PassthroughHTTPS,
+	}
+
+	if r.encoder == nil {
+		if len(config.HMACKey) == 0 {
+			return nil, errors.New("HMAC key or encoder required")
+		}
+		hmacKey := config.HMACKey
+		r.encoder = func(oURL string) (string, error) {
+			return encoding.B64EncodeURL(hmacKey, oURL), nil
+		}
+	}
+
+	for _, host := range config.ExcludeHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if sub, ok := strings.CutPrefix(host, "*."); ok {
+			r.excludeSubs = append(r.excludeSubs, "."+sub)
+			continue
+		}
+		r.excludeHosts[host] = struct{}{}
+	}
+	return r, nil
+}
+
+// skip reports whether the url should be left as it is.
+func (r *Rewriter) skip(oURL string) bool {
+	// already proxied
+	if r.prefix != "" && strings.HasPrefix(oURL, r.prefix+"/") {
+		return true
+	}
+
+	u, err := url.Parse(oURL)
+	if err != nil {
+		return true
+	}
+	// relative (and data:, etc) urls can't be proxied
+	switch u.Scheme {
+	case "http":
+	case "https":
+		if r.passHTTPS {
+			return true
+		}
+	default:
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return true
+	}
+	if _, ok := r.excludeHosts[host]; ok {
+		return true
+	}
+	for _, sub := range r.excludeSubs {
+		if strings.HasSuffix(host, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// URL returns the signed go-camo url for the url, or the url as it is if
+// it is excluded by the policy, or can't be proxied (eg. relative urls).
+func (r *Rewriter) URL(oURL string) (string, error) {
+	trimmed := strings.TrimSpace(oURL)
+	if r.skip(trimmed) {
+		return oURL, nil
+	}
+	encURL, err := r.encoder(trimmed)
+	if err != nil {
+		return "", err
+	}
+	return r.prefix + encURL, nil
+}
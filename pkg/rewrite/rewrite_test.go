@@ -0,0 +1,71 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package rewrite
+
+import (
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestURL(t *testing.T) {
+	t.Parallel()
+
+	r, err := New(Config{
+		HMACKey:      []byte("test"),
+		Prefix:       "https://img.example.org/",
+		ExcludeHosts: []string{"static.example.org", "*.cdn.example.org"},
+	})
+	assert.Nil(t, err)
+
+	f := func(in string, want string) {
+		t.Helper()
+		out, err := r.URL(in)
+		assert.Nil(t, err)
+		assert.Equal(t, out, want)
+	}
+
+	f(
+		"http://golang.org/doc/gopher/frontpage.png",
+		"https://img.example.org/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+	f(
+		" http://golang.org/doc/gopher/frontpage.png ",
+		"https://img.example.org/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+	)
+
+	// left as they are
+	for _, u := range []string{
+		"/relative.png",
+		"relative.png",
+		"//golang.org/scheme-relative.png",
+		"data:image/png;base64,iVBORw0KGgo=",
+		"ftp://golang.org/image.png",
+		"http://static.example.org/image.png",
+		"http://a.cdn.example.org/image.png",
+		"http://A.B.CDN.EXAMPLE.ORG/image.png",
+		"https://img.example.org/D23vHLFHsOhPOcvdxeoQyAJTpvM/aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n",
+		"",
+	} {
+		f(u, u)
+	}
+
+	// subdomain patterns don't match the domain itself
+	out, err := r.URL("http://cdn.example.org/image.png")
+	assert.Nil(t, err)
+	assert.NotEqual(t, out, "http://cdn.example.org/image.png")
+
+	// https is proxied unless passed through
+	out, err = r.URL("https://golang.org/image.png")
+	assert.Nil(t, err)
+	assert.NotEqual(t, out, "https://golang.org/image.png")
+
+	r, err = New(Config{HMACKey: []byte("test"), PassthroughHTTPS: true})
+	assert.Nil(t, err)
+	f("https://golang.org/image.png", "https://golang.org/image.png")
+
+	_, err = New(Config{})
+	assert.NotNil(t, err)
+}
@@ -14,6 +14,12 @@ type DumbRouter struct {
 	CamoHandler http.Handler
 	AddHeaders  map[string]string
 	ServerName  string
+	// AllowQueryFormat routes original camo query string format requests
+	// (/<digest>?url=<escaped-url>) to the CamoHandler.
+	AllowQueryFormat bool
+	// AllowTokenFormat routes signed token format requests (/<token>) to
+	// the CamoHandler.
+	AllowTokenFormat bool
 }
 
 // SetHeaders sets the headers on the response
@@ -47,8 +53,20 @@ func (dr *DumbRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// /<digest>/<encoded-url>, with an optional unsigned trailing
+	// /<filename> segment (ignored by signature checks)
 	components := strings.Split(r.URL.Path, "/")
-	if len(components) == 3 {
+	if len(components) == 3 || (len(components) == 4 && components[3] != "") {
+		dr.CamoHandler.ServeHTTP(w, r)
+		return
+	}
+
+	if dr.AllowQueryFormat && len(components) == 2 && r.URL.Query().Has("url") {
+		dr.CamoHandler.ServeHTTP(w, r)
+		return
+	}
+
+	if dr.AllowTokenFormat && len(components) == 2 && strings.Count(components[1], ".") == 2 {
 		dr.CamoHandler.ServeHTTP(w, r)
 		return
 	}
@@ -0,0 +1,51 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ruleset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// A Case is the expected result of evaluating a url, from a test cases file.
+type Case struct {
+	URL *url.URL
+	Line
+	// Allow is true if the url is expected to be allowed.
+	Allow bool
+}
+
+// ParseCases reads test cases, with one expected result and url per line
+// (eg. "allow http://example.org/a.png", or "deny http://example.net/").
+// Blank lines and comment lines (starting with #) are ignored.
+func ParseCases(r io.Reader) ([]Case, error) {
+	cases := make([]Case, 0)
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := Line{Text: strings.TrimSpace(scanner.Text()), Number: number}
+		if line.Text == "" || strings.HasPrefix(line.Text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line.Text)
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("line %d: expected 'allow <url>' or 'deny <url>'", number)
+		}
+		u, err := url.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err)
+		}
+		cases = append(cases, Case{URL: u, Line: line, Allow: fields[0] == "allow"})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cases, nil
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ruleset
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/cactus/go-camo/v2/pkg/htrie"
+)
+
+// Severity is the severity of a lint Issue.
+type Severity int
+
+const (
+	// Warning is a rule that works, but likely not as intended.
+	Warning Severity = iota
+	// Error is a rule that go-camo fails to load.
+	Error
+)
+
+// String returns "error" or "warning".
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// An Issue is a problem found by Lint.
+type Issue struct {
+	Message string
+	// Line is the line with the problem. Zero for problems with the
+	// ruleset as a whole.
+	Line
+	Severity Severity
+}
+
+// String returns the issue formatted for display, with the line number.
+func (i Issue) String() string {
+	if i.Number == 0 {
+		return fmt.Sprintf("%s: %s", i.Severity, i.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", i.Number, i.Severity, i.Message)
+}
+
+// scope is the set of urls a rule matches
+type scope struct {
+	// host is the rule hostname, empty for any host
+	host string
+	// path is the rule path glob, empty for any path
+	path string
+	// base is true if the rule matches the host itself
+	base bool
+	// subdomains is true if the rule matches subdomains of the host
+	subdomains bool
+	// icase is true for case insensitive path matching
+	icase bool
+}
+
+// parseScope returns the scope of a (valid) htrie url matcher rule
+// (eg. |s|example.org|i|/some/path/*).
+func parseScope(rule string) scope {
+	if strings.Count(rule, "|") > 4 {
+		rule = strings.TrimRight(rule, "|")
+	}
+	parts := strings.Split(rule[1:], "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	sc := scope{
+		path:  parts[3],
+		base:  true,
+		icase: strings.Contains(parts[2], "i"),
+	}
+	if sc.path == "*" {
+		sc.path = ""
+	}
+	if sc.icase {
+		sc.path = strings.ToLower(sc.path)
+	}
+
+	host := strings.ToLower(strings.Trim(parts[1], "."))
+	sc.subdomains = strings.Contains(parts[0], "s")
+	if host == "*" {
+		host = ""
+	}
+	if after, ok := strings.CutPrefix(host, "*."); ok {
+		host = after
+		sc.base = false
+		sc.subdomains = true
+	}
+	if host == "" {
+		sc.base = false
+		sc.subdomains = true
+	}
+	if clean, err := htrie.CleanHostname(host); err == nil {
+		host = clean
+	}
+	sc.host = host
+	return sc
+}
+
+// isUnder reports whether host is the same as, or a subdomain of, parent
+func isUnder(host string, parent string) bool {
+	return parent == "" || host == parent || strings.HasSuffix(host, "."+parent)
+}
+
+// coversHost reports whether every host sc matches is matched by other
+func (sc scope) coversHost(other scope) bool {
+	switch {
+	case sc.host == "" && sc.subdomains:
+		return true
+	case sc.base && sc.subdomains:
+		return isUnder(other.host, sc.host)
+	case sc.subdomains:
+		return other.host != sc.host && isUnder(other.host, sc.host) ||
+			other.host == sc.host && !other.base
+	default:
+		return other.host == sc.host && other.base && !other.subdomains
+	}
+}
+
+// coversPath reports whether every path sc matches is matched by other.
+// Only exact and prefix (trailing glob) matches are detected.
+func (sc scope) coversPath(other scope) bool {
+	if sc.path == "" {
+		return true
+	}
+	if other.path == "" {
+		return false
+	}
+	otherPath := other.path
+	switch {
+	case sc.icase:
+		otherPath = strings.ToLower(otherPath)
+	case other.icase && strings.ToLower(otherPath) != strings.ToUpper(otherPath):
+		// other matches case variants that sc does not
+		return false
+	}
+	if sc.path == otherPath {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(sc.path, "*")
+	return ok && !strings.Contains(prefix, "*") && strings.HasPrefix(otherPath, prefix)
+}
+
+// covers reports whether every url other matches is matched by sc
+func (sc scope) covers(other scope) bool {
+	return sc.coversHost(other) && sc.coversPath(other)
+}
+
+// overlapsHost reports whether any host is matched by both sc and other
+func (sc scope) overlapsHost(other scope) bool {
+	// host scopes are nested or disjoint
+	return sc.coversHost(other) || other.coversHost(sc)
+}
+
+// Lint checks a ruleset, returning every problem found, rather than
+// stopping at the first malformed rule as Parse does. Blank lines and
+// comment lines (starting with #) are allowed. Other problems reported are
+// rules that can never match, rules shadowed by another rule, and the
+// interaction of allow and deny rules.
+func Lint(r io.Reader) ([]Issue, error) {
+	issues := make([]Issue, 0)
+	rules := make([]*Rule, 0)
+	scopes := make([]scope, 0)
+
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := Line{Text: strings.TrimSpace(scanner.Text()), Number: number}
+		if line.Text == "" || strings.HasPrefix(line.Text, "#") {
+			continue
+		}
+
+		var rule string
+		var allow bool
+		if after, ok := strings.CutPrefix(line.Text, "allow|"); ok {
+			rule, allow = "|"+after, true
+		} else if after, ok := strings.CutPrefix(line.Text, "deny|"); ok {
+			rule = "|" + after
+		} else {
+			// go-camo loads the file without it, so it is not an error
+			issues = append(issues, Issue{
+				Line:     line,
+				Severity: Warning,
+				Message:  "not an allow or deny rule (ignored by go-camo)",
+			})
+			continue
+		}
+
+		if _, err := htrie.NewURLMatcherWithRules([]string{rule}); err != nil {
+			issues = append(issues, Issue{Line: line, Severity: Error, Message: err.Error()})
+			continue
+		}
+
+		sc := parseScope(rule)
+		if strings.ContainsAny(sc.host, ":/") {
+			issues = append(issues, Issue{
+				Line:     line,
+				Severity: Warning,
+				Message:  fmt.Sprintf("never matches: hostname %q contains a port or path", sc.host),
+			})
+		}
+		if sc.path != "" && !strings.HasPrefix(sc.path, "/") && !strings.HasPrefix(sc.path, "*") {
+			issues = append(issues, Issue{
+				Line:     line,
+				Severity: Warning,
+				Message:  fmt.Sprintf("never matches: url paths start with '/', and %q does not", sc.path),
+			})
+		}
+
+		rules = append(rules, &Rule{Line: line, Allow: allow})
+		scopes = append(scopes, sc)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	hasAllow, hasDeny := false, false
+	for i, rule := range rules {
+		if rule.Allow {
+			hasAllow = true
+		} else {
+			hasDeny = true
+		}
+
+	others:
+		for j, other := range rules {
+			if i == j || !scopes[j].covers(scopes[i]) {
+				continue
+			}
+			switch {
+			case other.Allow == rule.Allow && scopes[i].covers(scopes[j]):
+				// the same urls. report the later rule.
+				if j > i {
+					continue
+				}
+				issues = append(issues, Issue{
+					Line:     rule.Line,
+					Severity: Warning,
+					Message:  fmt.Sprintf("duplicates line %d", other.Number),
+				})
+			case other.Allow == rule.Allow:
+				issues = append(issues, Issue{
+					Line:     rule.Line,
+					Severity: Warning,
+					Message:  fmt.Sprintf("shadowed by line %d, which matches every url this rule does", other.Number),
+				})
+			case rule.Allow:
+				issues = append(issues, Issue{
+					Line:     rule.Line,
+					Severity: Warning,
+					Message:  fmt.Sprintf("never allows anything: every url it matches is denied by line %d", other.Number),
+				})
+			default:
+				continue
+			}
+			break others
+		}
+	}
+
+	if hasAllow && hasDeny {
+		issues = append(issues, Issue{
+			Severity: Warning,
+			Message: "allow and deny rules both supplied. " +
+				"Anything not matching an allow rule is denied, THEN deny rules are evaluated.",
+		})
+
+		// deny rules only matching urls that are not allowed anyway
+		for i, rule := range rules {
+			if rule.Allow {
+				continue
+			}
+			overlaps := false
+			for j, other := range rules {
+				if other.Allow && scopes[i].overlapsHost(scopes[j]) {
+					overlaps = true
+					break
+				}
+			}
+			if !overlaps {
+				issues = append(issues, Issue{
+					Line:     rule.Line,
+					Severity: Warning,
+					Message:  "has no effect: no allow rule matches its hosts, so they are denied anyway",
+				})
+			}
+		}
+	}
+
+	// by line, with ruleset issues last
+	slices.SortStableFunc(issues, func(a, b Issue) int {
+		if a.Number == 0 || b.Number == 0 {
+			return cmp.Compare(b.Number, a.Number)
+		}
+		return cmp.Compare(a.Number, b.Number)
+	})
+	return issues, nil
+}
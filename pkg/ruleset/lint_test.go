@@ -0,0 +1,104 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ruleset
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+
+	issues, err := Lint(strings.NewReader(testRules))
+	assert.Nil(t, err)
+	// the cdn allow rule is denied by the cdn deny rule, and the allow and
+	// deny interaction
+	assert.Equal(t, len(issues), 2)
+	assert.Equal(t, issues[0].Number, 3)
+	assert.Equal(t, issues[0].Message, "never allows anything: every url it matches is denied by line 6")
+	assert.Equal(t, issues[1].Number, 0)
+	assert.Equal(t, issues[1].Severity, Warning)
+
+	rules := `# comment
+alow|s|example.org||
+allow|s|bad
+deny|s|ex*ample.com||
+allow|s|example.org||
+allow||img.example.org|i|/images/*
+allow|s|example.org||
+allow|s|example.com:8080||
+allow|s|example.net||images/*
+allow|s|*.cdn.example.io|i|/images/*
+deny|s|cdn.example.io||
+deny|s|example.edu||
+`
+	issues, err = Lint(strings.NewReader(rules))
+	assert.Nil(t, err)
+
+	got := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		got = append(got, issue.String())
+	}
+	assert.Equal(t, got, []string{
+		"line 2: warning: not an allow or deny rule (ignored by go-camo)",
+		"line 3: error: bad rule format: |s|bad",
+		"line 4: error: bad domain format: * cannot be mix matched in domain",
+		"line 6: warning: shadowed by line 5, which matches every url this rule does",
+		"line 7: warning: duplicates line 5",
+		`line 8: warning: never matches: hostname "example.com:8080" contains a port or path`,
+		`line 9: warning: never matches: url paths start with '/', and "images/*" does not`,
+		"line 10: warning: never allows anything: every url it matches is denied by line 11",
+		"line 12: warning: has no effect: no allow rule matches its hosts, so they are denied anyway",
+		"warning: allow and deny rules both supplied. Anything not matching an allow rule is denied, THEN deny rules are evaluated.",
+	})
+}
+
+func TestScopeCovers(t *testing.T) {
+	t.Parallel()
+
+	f := func(a string, b string, covers bool) {
+		t.Helper()
+		assert.Equal(t, parseScope(a).covers(parseScope(b)), covers, a+" covers "+b)
+	}
+
+	f("||*||", "|s|example.org|i|/a/*", true)
+	f("|s|example.org||", "||example.org||", true)
+	f("|s|example.org||", "||a.example.org||", true)
+	f("|s|example.org||", "||*.example.org||", true)
+	f("||*.example.org||", "||a.b.example.org||", true)
+	f("||*.example.org||", "||example.org||", false)
+	f("||example.org||", "|s|example.org||", false)
+	f("||example.org||", "||*.example.org||", false)
+	f("||example.org||", "||example.net||", false)
+	f("|s|example.org||", "||badexample.org||", false)
+
+	f("||example.org||/a/*", "||example.org||/a/b.png", true)
+	f("||example.org||/a/*", "||example.org||/b/a.png", false)
+	f("||example.org||/a/*", "||example.org||", false)
+	f("||example.org|i|/A/*", "||example.org||/a/B.png", true)
+	f("||example.org||/a/*", "||example.org|i|/a/b.png", false)
+	f("||example.org||/1/*", "||example.org|i|/1/2.", true)
+	f("||example.org||*.png", "||example.org||/a.png", false)
+}
+
+func TestParseCases(t *testing.T) {
+	t.Parallel()
+
+	cases, err := ParseCases(strings.NewReader("# cases\nallow http://example.org/a.png\n\ndeny  http://example.net/\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(cases), 2)
+	assert.Equal(t, cases[0].Number, 2)
+	assert.True(t, cases[0].Allow, "expected allow case")
+	assert.Equal(t, cases[0].URL.Host, "example.org")
+	assert.Equal(t, cases[1].Number, 4)
+	assert.False(t, cases[1].Allow, "expected deny case")
+
+	_, err = ParseCases(strings.NewReader("allow http://example.org/a.png\nmaybe http://example.org/\n"))
+	assert.NotNil(t, err)
+	assert.MatchesRegex(t, err.Error(), "^line 2: ")
+}
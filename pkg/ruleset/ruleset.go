@@ -0,0 +1,205 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ruleset provides parsing and evaluation of go-camo filter
+// rulesets (allow and deny url rules, one per line).
+package ruleset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/cactus/go-camo/v2/pkg/htrie"
+)
+
+// A Line is a line of a ruleset file.
+type Line struct {
+	// Text is the line, with surrounding whitespace trimmed.
+	Text string
+	// Number is the (1 based) line number.
+	Number int
+}
+
+// A Rule is an allow or deny rule.
+type Rule struct {
+	matcher *htrie.URLMatcher
+	Line
+	// Allow is true for allow rules, and false for deny rules.
+	Allow bool
+}
+
+// Action returns "allow" or "deny".
+func (r *Rule) Action() string {
+	if r.Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// Match reports whether the url matches the rule.
+func (r *Rule) Match(u *url.URL) (bool, error) {
+	return r.matcher.CheckURL(u)
+}
+
+// A Ruleset is a list of allow and deny rules.
+//
+// Urls must match at least one allow rule (if there are any), and must not
+// match any deny rule.
+type Ruleset struct {
+	allowMatcher *htrie.URLMatcher
+	denyMatcher  *htrie.URLMatcher
+	// Rules are the allow and deny rules, in file order.
+	Rules []*Rule
+	// Ignored are the lines that are not rules.
+	Ignored  []Line
+	hasAllow bool
+	hasDeny  bool
+}
+
+// Parse reads a ruleset, with one allow (allow|<rule>) or deny
+// (deny|<rule>) rule per line. Other lines are ignored.
+func Parse(r io.Reader) (*Ruleset, error) {
+	rs := &Ruleset{
+		allowMatcher: htrie.NewURLMatcher(),
+		denyMatcher:  htrie.NewURLMatcher(),
+	}
+
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := Line{Text: strings.TrimSpace(scanner.Text()), Number: number}
+
+		var rule string
+		var allow bool
+		var matcher *htrie.URLMatcher
+		if after, ok := strings.CutPrefix(line.Text, "allow|"); ok {
+			rule, allow, matcher = "|"+after, true, rs.allowMatcher
+		} else if after, ok := strings.CutPrefix(line.Text, "deny|"); ok {
+			rule, allow, matcher = "|"+after, false, rs.denyMatcher
+		} else {
+			rs.Ignored = append(rs.Ignored, line)
+			continue
+		}
+
+		if err := matcher.AddRule(rule); err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err)
+		}
+		ruleMatcher, err := htrie.NewURLMatcherWithRules([]string{rule})
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err)
+		}
+		rs.Rules = append(rs.Rules, &Rule{Line: line, Allow: allow, matcher: ruleMatcher})
+		if allow {
+			rs.hasAllow = true
+		} else {
+			rs.hasDeny = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Load reads the named ruleset file. See Parse.
+func Load(fname string) (*Ruleset, error) {
+	// #nosec
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not open filter-ruleset file: %s", err)
+	}
+	// #nosec
+	defer file.Close()
+
+	rs, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("error building filter ruleset: %s", err)
+	}
+	return rs, nil
+}
+
+// HasAllow reports whether the ruleset has any allow rules.
+func (rs *Ruleset) HasAllow() bool {
+	return rs.hasAllow
+}
+
+// HasDeny reports whether the ruleset has any deny rules.
+func (rs *Ruleset) HasDeny() bool {
+	return rs.hasDeny
+}
+
+// Filters returns the ruleset as filter functions, for use with camo.New.
+// Each returns false if the url is rejected.
+func (rs *Ruleset) Filters() []func(*url.URL) (bool, error) {
+	// append in order. allow first, then deny filters.
+	// first false value aborts the request.
+	filters := make([]func(*url.URL) (bool, error), 0, 2)
+
+	if rs.hasAllow {
+		filters = append(filters, rs.allowMatcher.CheckURL)
+	}
+
+	// denyMatcher returns true on a match. we want to invert this for a
+	// deny rule, so any deny rule match should return false, and anything
+	// _not_ matching should return true.
+	if rs.hasDeny {
+		filters = append(filters, func(u *url.URL) (bool, error) {
+			chk, err := rs.denyMatcher.CheckURL(u)
+			return !chk, err
+		})
+	}
+	return filters
+}
+
+// A Result is the outcome of evaluating a url against a ruleset.
+type Result struct {
+	// Rule is the rule that decided the result: the matching deny rule
+	// for a rejected url, or the first matching allow rule for an allowed
+	// one. Nil if the url was rejected for not matching any allow rule, or
+	// allowed with no rules matching.
+	Rule *Rule
+	// Allowed is true if the url is allowed.
+	Allowed bool
+}
+
+// Evaluate evaluates the url against the ruleset, returning the result and
+// the rule that decided it. Returns an error (with the url rejected) if the
+// url hostname is malformed.
+func (rs *Ruleset) Evaluate(u *url.URL) (Result, error) {
+	result := Result{Allowed: !rs.hasAllow}
+	for _, rule := range rs.Rules {
+		if !rule.Allow || result.Allowed {
+			continue
+		}
+		ok, err := rule.Match(u)
+		if err != nil {
+			return Result{}, err
+		}
+		if ok {
+			result = Result{Rule: rule, Allowed: true}
+		}
+	}
+	if !result.Allowed {
+		return result, nil
+	}
+
+	for _, rule := range rs.Rules {
+		if rule.Allow {
+			continue
+		}
+		ok, err := rule.Match(u)
+		if err != nil {
+			return Result{}, err
+		}
+		if ok {
+			return Result{Rule: rule, Allowed: false}, nil
+		}
+	}
+	return result, nil
+}
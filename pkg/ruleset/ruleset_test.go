@@ -0,0 +1,97 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ruleset
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+)
+
+const testRules = `# images from example.org and its cdn
+allow||example.org||
+allow|s|*.cdn.example.org|i|*.png
+
+deny|s|example.org|i|/private/*
+deny|s|*.cdn.example.org||
+`
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	rs, err := Parse(strings.NewReader(testRules))
+	assert.Nil(t, err)
+	assert.Equal(t, len(rs.Rules), 4)
+	assert.True(t, rs.HasAllow(), "missing allow rules")
+	assert.True(t, rs.HasDeny(), "missing deny rules")
+
+	assert.Equal(t, rs.Rules[1].Number, 3)
+	assert.Equal(t, rs.Rules[1].Text, "allow|s|*.cdn.example.org|i|*.png")
+	assert.Equal(t, rs.Rules[1].Action(), "allow")
+	assert.Equal(t, rs.Rules[2].Action(), "deny")
+
+	assert.Equal(t, len(rs.Ignored), 2)
+	assert.Equal(t, rs.Ignored[0].Number, 1)
+	assert.Equal(t, rs.Ignored[1], Line{Text: "", Number: 4})
+
+	_, err = Parse(strings.NewReader("allow|s|example.org||\ndeny|s|bad"))
+	assert.NotNil(t, err)
+	assert.MatchesRegex(t, err.Error(), "^line 2: ")
+}
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+
+	rs, err := Parse(strings.NewReader(testRules))
+	assert.Nil(t, err)
+
+	f := func(sURL string, allowed bool, ruleLine int) {
+		t.Helper()
+		u, err := url.Parse(sURL)
+		assert.Nil(t, err)
+		result, err := rs.Evaluate(u)
+		assert.Nil(t, err)
+		assert.Equal(t, result.Allowed, allowed, sURL)
+		if ruleLine == 0 {
+			assert.Nil(t, result.Rule, sURL)
+		} else {
+			assert.NotNil(t, result.Rule, sURL)
+			assert.Equal(t, result.Rule.Number, ruleLine, sURL)
+		}
+
+		// filters agree with the evaluation
+		filtered := true
+		for _, filter := range rs.Filters() {
+			if ok, err := filter(u); err != nil || !ok {
+				filtered = false
+				break
+			}
+		}
+		assert.Equal(t, filtered, allowed, sURL)
+	}
+
+	f("http://example.org/image.png", true, 2)
+	f("http://EXAMPLE.org/image.png", true, 2)
+	f("http://example.org/private/image.png", false, 5)
+	f("http://example.net/image.png", false, 0)
+	f("http://img.cdn.example.org/image.gif", false, 0)
+	// allowed by the path rule, then denied
+	f("http://img.cdn.example.org/image.PNG", false, 6)
+	f("http://sub.example.org/image.png", false, 0)
+
+	// with no allow rules, anything not denied is allowed
+	rs, err = Parse(strings.NewReader("deny|s|example.org||"))
+	assert.Nil(t, err)
+	f("http://example.net/image.png", true, 0)
+	f("http://example.org/image.png", false, 1)
+	assert.Equal(t, len(rs.Filters()), 1)
+
+	rs, err = Parse(strings.NewReader(""))
+	assert.Nil(t, err)
+	f("http://example.net/image.png", true, 0)
+	assert.Equal(t, len(rs.Filters()), 0)
+}
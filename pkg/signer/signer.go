@@ -0,0 +1,271 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package signer provides an http handler that signs go-camo urls, for
+// clients that can not be given the HMAC key (eg. front-end build pipelines
+// and third party integrations).
+//
+// Requests are authenticated with a bearer token, or a verified TLS client
+// certificate. Urls are checked before signing (eg. against the filter
+// ruleset, with camo.Proxy.CheckURL), so urls the proxy would reject are
+// not signed.
+package signer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+// DefaultMaxURLs is the default maximum number of urls signed per request.
+const DefaultMaxURLs = 100
+
+// maxBodySize is the maximum size of a request body, in bytes
+const maxBodySize = 1 << 20
+
+// Config holds configuration data used when creating a Handler with New.
+type Config struct {
+	// Keyring holds the signing key. Urls are signed with the first HMAC
+	// key.
+	Keyring *encoding.Keyring
+	// CheckURL, if set, is called with each url before it is signed. Urls
+	// it returns an error for are not signed.
+	CheckURL func(*url.URL) error
+	// BaseURL is the go-camo server url that signed url paths are appended
+	// to (eg. https://img.example.org). If empty, url paths are returned.
+	BaseURL string
+	// Token is the bearer token that authorizes requests. If empty, only
+	// requests with a verified client certificate are authorized.
+	Token string
+	// Options are the signing options used. The key id is set from the
+	// keyring.
+	Options encoding.SignOptions
+	// MaxURLs is the maximum number of urls signed per request. Defaults
+	// to DefaultMaxURLs.
+	MaxURLs int
+}
+
+// A Handler is an http handler that signs urls.
+//
+// Urls are sent as a JSON body:
+//
+//	{"urls": ["http://example.org/a.png"], "encoding": "base64", "ttl": "24h"}
+//
+// or as (repeated) url form or query parameters, along with optional
+// encoding and ttl parameters. The encoding is "hex" (the default) or
+// "base64", and the ttl, if set, is the lifetime of the signed urls.
+//
+// The response is a JSON body with a result for each url, in order. Each
+// result has the url, and either the signed url or the reason it was not
+// signed:
+//
+//	{"urls": [{"url": "http://example.org/a.png", "camo_url": "..."}]}
+type Handler struct {
+	keyring  *encoding.Keyring
+	checkURL func(*url.URL) error
+	baseURL  string
+	token    []byte
+	opts     encoding.SignOptions
+	maxURLs  int
+}
+
+// request is a sign request
+type request struct {
+	Encoding string   `json:"encoding"`
+	TTL      string   `json:"ttl"`
+	URLs     []string `json:"urls"`
+}
+
+// result is the result of signing a url
+type result struct {
+	URL     string `json:"url"`
+	CamoURL string `json:"camo_url,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// response is a sign response
+type response struct {
+	Error string   `json:"error,omitempty"`
+	URLs  []result `json:"urls,omitempty"`
+}
+
+// New returns a new Handler.
+func New(config Config) (*Handler, error) {
+	if config.Keyring == nil {
+		return nil, errors.New("keyring required")
+	}
+	if _, ok := config.Keyring.SigningKey(); !ok {
+		return nil, errors.New("keyring has no signing key")
+	}
+	if config.Options.Algorithm != 0 && !config.Options.Algorithm.IsHMAC() {
+		return nil, fmt.Errorf("can not sign urls with %s", config.Options.Algorithm)
+	}
+
+	maxURLs := config.MaxURLs
+	if maxURLs <= 0 {
+		maxURLs = DefaultMaxURLs
+	}
+
+	h := &Handler{
+		keyring:  config.Keyring,
+		checkURL: config.CheckURL,
+		baseURL:  strings.TrimRight(config.BaseURL, "/"),
+		opts:     config.Options,
+		maxURLs:  maxURLs,
+	}
+	if config.Token != "" {
+		h.token = []byte(config.Token)
+	}
+	return h, nil
+}
+
+// authorized reports whether the request has the bearer token, or a
+// verified client certificate.
+func (h *Handler) authorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if h.token == nil {
+		return false
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), h.token) == 1
+}
+
+// parseRequest reads the sign request from the JSON body, or the form
+func parseRequest(r *http.Request) (*request, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method == http.MethodPost && mediaType == "application/json" {
+		req := &request{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid json body: %s", err)
+		}
+		return req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("invalid form body: %s", err)
+	}
+	return &request{
+		URLs:     r.Form["url"],
+		Encoding: r.Form.Get("encoding"),
+		TTL:      r.Form.Get("ttl"),
+	}, nil
+}
+
+// sign returns the signed url for the url
+func (h *Handler) sign(oURL string, encoder func(string, encoding.SignOptions) (string, error), opts encoding.SignOptions) (string, error) {
+	u, err := url.Parse(oURL)
+	if err != nil {
+		return "", errors.New("invalid url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("Bad url scheme")
+	}
+	if u.Host == "" {
+		return "", errors.New("Bad url host")
+	}
+	if h.checkURL != nil {
+		if err := h.checkURL(u); err != nil {
+			return "", err
+		}
+	}
+
+	encURL, err := encoder(oURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return h.baseURL + encURL, nil
+}
+
+// writeJSON writes the response, with the status code
+func writeJSON(w http.ResponseWriter, code int, resp *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	// #nosec G104
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ServeHTTP fulfills the http server interface
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+		return
+	}
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-camo"`)
+		writeJSON(w, http.StatusUnauthorized, &response{Error: "unauthorized"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	req, err := parseRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+
+	if len(req.URLs) == 0 {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "no urls"})
+		return
+	}
+	if len(req.URLs) > h.maxURLs {
+		writeJSON(w, http.StatusBadRequest, &response{
+			Error: fmt.Sprintf("too many urls: %d (max %d)", len(req.URLs), h.maxURLs),
+		})
+		return
+	}
+
+	var encoder func(string, encoding.SignOptions) (string, error)
+	switch req.Encoding {
+	case "", "hex":
+		encoder = h.keyring.HexEncodeURL
+	case "base64":
+		encoder = h.keyring.B64EncodeURL
+	default:
+		writeJSON(w, http.StatusBadRequest, &response{
+			Error: fmt.Sprintf("unknown encoding: %q", req.Encoding),
+		})
+		return
+	}
+
+	opts := h.opts
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			writeJSON(w, http.StatusBadRequest, &response{
+				Error: fmt.Sprintf("invalid ttl: %q", req.TTL),
+			})
+			return
+		}
+		opts.Expires = time.Now().Add(ttl)
+	}
+
+	results := make([]result, 0, len(req.URLs))
+	for _, oURL := range req.URLs {
+		res := result{URL: oURL}
+		camoURL, err := h.sign(oURL, encoder, opts)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.CamoURL = camoURL
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, http.StatusOK, &response{URLs: results})
+}
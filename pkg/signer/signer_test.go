@@ -0,0 +1,198 @@
+// Copyright (c) 2012-2023 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/v2/pkg/assert"
+	"github.com/cactus/go-camo/v2/pkg/encoding"
+)
+
+const (
+	testToken = "s3cret"
+	testURL   = "http://golang.org/doc/gopher/frontpage.png"
+)
+
+func newTestHandler(t *testing.T, config Config) (*Handler, *encoding.Keyring) {
+	t.Helper()
+	keyring, err := encoding.NewKeyring(encoding.Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+	config.Keyring = keyring
+	h, err := New(config)
+	assert.Nil(t, err)
+	return h, keyring
+}
+
+func doRequest(t *testing.T, h http.Handler, req *http.Request) (int, *response) {
+	t.Helper()
+	record := httptest.NewRecorder()
+	h.ServeHTTP(record, req)
+	resp := &response{}
+	assert.Nil(t, json.NewDecoder(record.Body).Decode(resp))
+	assert.Equal(t, record.Header().Get("Content-Type"), "application/json")
+	return record.Code, resp
+}
+
+func jsonRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/sign", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{})
+	assert.NotNil(t, err)
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	keyring, err := encoding.NewKeyring(encoding.Key{PublicKey: pub})
+	assert.Nil(t, err)
+	_, err = New(Config{Keyring: keyring})
+	assert.NotNil(t, err)
+
+	keyring, err = encoding.NewKeyring(encoding.Key{Secret: []byte("test")})
+	assert.Nil(t, err)
+	_, err = New(Config{Keyring: keyring, Options: encoding.SignOptions{Algorithm: encoding.Ed25519}})
+	assert.NotNil(t, err)
+}
+
+func TestSign(t *testing.T) {
+	t.Parallel()
+
+	h, keyring := newTestHandler(t, Config{
+		BaseURL: "https://img.example.org/",
+		Token:   testToken,
+		Options: encoding.SignOptions{Algorithm: encoding.SHA256},
+		CheckURL: func(u *url.URL) error {
+			if u.Hostname() == "bad.example.org" {
+				return errors.New("Rejected due to filter-ruleset")
+			}
+			return nil
+		},
+	})
+
+	code, resp := doRequest(t, h, jsonRequest(
+		`{"urls": ["`+testURL+`", "http://bad.example.org/a.png", "file:///etc/passwd", "/a.png"]}`,
+	))
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(resp.URLs), 4)
+
+	expected, err := keyring.HexEncodeURL(testURL, encoding.SignOptions{Algorithm: encoding.SHA256})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.URLs[0], result{URL: testURL, CamoURL: "https://img.example.org" + expected})
+	assert.Equal(t, resp.URLs[1].Error, "Rejected due to filter-ruleset")
+	assert.Equal(t, resp.URLs[2].Error, "Bad url scheme")
+	assert.Equal(t, resp.URLs[3].Error, "Bad url scheme")
+
+	// base64, with a ttl
+	code, resp = doRequest(t, h, jsonRequest(`{"urls": ["`+testURL+`"], "encoding": "base64", "ttl": "1h"}`))
+	assert.Equal(t, code, http.StatusOK)
+	u, err := url.Parse(strings.TrimPrefix(resp.URLs[0].CamoURL, "https://img.example.org"))
+	assert.Nil(t, err)
+	info, err := (&encoding.PathCodec{Keyring: keyring}).Decode(u)
+	assert.Nil(t, err)
+	assert.Equal(t, info.URL, testURL)
+	assert.Equal(t, info.Algorithm, encoding.SHA256)
+	assert.True(t, info.Expires.After(time.Now().Add(59*time.Minute)))
+
+	// form values
+	form := url.Values{"url": {testURL, testURL}, "encoding": {"base64"}}
+	req := httptest.NewRequest("POST", "/sign", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	code, resp = doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(resp.URLs), 2)
+	assert.Equal(t, resp.URLs[0], resp.URLs[1])
+
+	req = httptest.NewRequest("GET", "/sign?"+form.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	code, resp = doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(resp.URLs), 2)
+}
+
+func TestSignBadRequest(t *testing.T) {
+	t.Parallel()
+
+	h, _ := newTestHandler(t, Config{Token: testToken, MaxURLs: 2})
+
+	f := func(body string) {
+		t.Helper()
+		code, resp := doRequest(t, h, jsonRequest(body))
+		assert.Equal(t, code, http.StatusBadRequest, body)
+		assert.NotEqual(t, resp.Error, "", body)
+	}
+
+	f(`{"urls": [`)
+	f(`{"urls": []}`)
+	f(`{"urls": ["` + testURL + `", "` + testURL + `", "` + testURL + `"]}`)
+	f(`{"urls": ["` + testURL + `"], "encoding": "token"}`)
+	f(`{"urls": ["` + testURL + `"], "ttl": "-1h"}`)
+	f(`{"urls": ["` + testURL + `"], "ttl": "tomorrow"}`)
+
+	req := httptest.NewRequest("PUT", "/sign", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	code, _ := doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusMethodNotAllowed)
+}
+
+func TestSignAuthorization(t *testing.T) {
+	t.Parallel()
+
+	h, _ := newTestHandler(t, Config{Token: testToken})
+	body := `{"urls": ["` + testURL + `"]}`
+
+	f := func(authorization string, expected int) {
+		t.Helper()
+		req := jsonRequest(body)
+		req.Header.Set("Authorization", authorization)
+		code, _ := doRequest(t, h, req)
+		assert.Equal(t, code, expected, authorization)
+	}
+
+	f("Bearer "+testToken, http.StatusOK)
+	f("bearer "+testToken, http.StatusOK)
+	f("Bearer wrong", http.StatusUnauthorized)
+	f("Bearer", http.StatusUnauthorized)
+	f("Basic "+testToken, http.StatusUnauthorized)
+	f("", http.StatusUnauthorized)
+
+	record := httptest.NewRecorder()
+	h.ServeHTTP(record, httptest.NewRequest("POST", "/sign", nil))
+	assert.MatchesRegex(t, record.Header().Get("WWW-Authenticate"), "^Bearer ")
+
+	// verified client certificate, and no token
+	h, _ = newTestHandler(t, Config{})
+	req := jsonRequest(body)
+	req.Header.Del("Authorization")
+	code, _ := doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	req = jsonRequest(body)
+	req.Header.Del("Authorization")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	code, _ = doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusOK)
+
+	// an unverified certificate is not enough
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+	code, _ = doRequest(t, h, req)
+	assert.Equal(t, code, http.StatusUnauthorized)
+}